@@ -5,63 +5,271 @@ import (
 	"net"
 	"reflect"
 	"strings"
+	"sync"
 	"sync/atomic"
 
 	"github.com/pyihe/gogame/network"
+	"github.com/pyihe/gogame/pkg"
 	"github.com/pyihe/gogame/pkg/log"
+	"github.com/pyihe/gogame/route"
 )
 
 type AgentHook interface {
 	OnConnect(Agent)
+	// OnClose 开启会话恢复时，连接断开后会话保留期结束才调用
 	OnClose(Agent)
 }
 
 type Agent interface {
 	WriteMsg(msg interface{})
+	// Reply 响应客户端的请求req，req必须是路由给handler的请求消息本身(按指针识别请求)，不能是它的拷贝
+	// 每个请求只能响应一次，等待响应的请求超过Gate.MaxPending时最早的请求被丢弃，之后无法再响应
+	// Processor未开启信封模式时等同于WriteMsg(resp)
+	Reply(req interface{}, resp interface{})
+	// ReplyError 以错误码code响应客户端的请求req
+	ReplyError(req interface{}, code uint16)
 	LocalAddr() net.Addr
 	RemoteAddr() net.Addr
 	Close()
+	// Kick 以reason为原因断开连接，AgentHook.OnClose中可以通过CloseReason获取
+	Kick(reason error)
+	// CloseReason 连接断开的原因，比如pkg.ErrIdleTimeout、io.EOF或者Kick的原因，连接未断开时为nil
+	CloseReason() error
 	UserData() interface{}
 	SetUserData(data interface{})
+	// ProtocolVersion 客户端的协议版本，未进行版本握手时为0
+	ProtocolVersion() uint16
+	// Stats 当前连接的发送统计，比如等待发送的字节数与因为客户端接收太慢而丢弃的消息数量
+	Stats() network.ConnStats
 }
 
 type gateAgent struct {
 	conn     network.Conn // 底层连接
 	gate     *Gate        // 所属gate
 	userData atomic.Value // 附加数据
+	version  uint16       // 协议版本
+	text     bool         // 是否以文本格式收发消息
+
+	mu       sync.Mutex
+	writeMu  sync.Mutex                 // 开启会话恢复时保证会话缓冲区的顺序与发送的顺序一致
+	pending  map[interface{}]pendingReq // 信封模式下尚未响应的请求
+	received uint64                     // 信封模式下收到的请求数量
+
+	mailbox route.Mailbox // 有序模式下handler的执行邮箱
+
+	reason error // 断开原因，guard by mu
+
+	session   *session   // 可恢复的会话，未开启会话恢复时为nil
+	logical   *gateAgent // 连接所属的逻辑agent，恢复会话时为旧的agent
+	closed    bool       // 主动关闭，不再保留会话，guard by mu
+	closeOnce sync.Once
+	rejected  bool // gate正在排空，连接没有通知AgentHook
 }
 
 func (a *gateAgent) Run() {
+	if a.gate.isDraining() {
+		return
+	}
+	if a.gate.ProtocolVersion > 0 && !a.handshakeVersion() {
+		return
+	}
+	if a.gate.ResumeTimeout <= 0 {
+		a.setCloseReason(a.serve(a.conn))
+		return
+	}
+
+	// 会话建立后a.conn可能被恢复会话的新连接替换，这里使用本连接
+	conn := a.conn
+	agent := a.handshakeResume()
+	if agent == nil {
+		return
+	}
+	a.logical = agent
+	agent.detach(conn, agent.serve(conn))
+}
+
+// serve 读取conn上的消息并路由，返回连接断开的原因
+func (a *gateAgent) serve(conn network.Conn) error {
 	for {
-		data, err := a.conn.ReadMsg()
+		data, err := conn.ReadMsg()
 		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				err = pkg.ErrIdleTimeout
+			}
 			if err != io.EOF && !strings.Contains(err.Error(), "use of closed network connection") {
 				log.Printf("read message: %v", err)
 			}
-			break
+			return err
+		}
+		if a.onHeartbeat(conn, data) {
+			continue
 		}
 		if a.gate.Processor != nil {
-			msg, err := a.gate.Processor.Unmarshal(data)
+			msg, err := a.gate.Processor.UnmarshalWith(data, a)
+			// 协商了版本的连接，收到本服务器不认识的消息(比如更新版本的客户端)时跳过
+			if err == pkg.ErrNotRegistered && a.version > 0 {
+				log.Printf("skip unknown message from %v (protocol version %d)", a.RemoteAddr(), a.version)
+				continue
+			}
 			if err != nil {
 				log.Printf("unmarshal message error: %v", err)
-				break
+				return err
+			}
+			if env, ok := msg.(*route.Envelope); ok {
+				msg = a.onEnvelope(env)
+				if msg == nil {
+					continue
+				}
 			}
 			err = a.gate.Processor.Route(msg, a)
 			if err != nil {
 				log.Printf("route message error: %v", err)
-				break
+				return err
 			}
 		}
 	}
 }
 
+// pendingReq 等待响应的请求
+type pendingReq struct {
+	seq   uint32 // 请求序列号
+	order uint64 // 收到的顺序，用于丢弃最早的请求
+}
+
+// onEnvelope 记录请求的序列号，返回需要路由的消息
+// 请求以消息对象本身为key，handler不响应的请求超过Gate.MaxPending时丢弃最早的一个
+func (a *gateAgent) onEnvelope(env *route.Envelope) interface{} {
+	if env.Flag != route.FlagRequest || env.Msg == nil {
+		return env.Msg
+	}
+	a.mu.Lock()
+	if a.pending == nil {
+		a.pending = make(map[interface{}]pendingReq)
+	}
+	if len(a.pending) >= a.gate.maxPending() {
+		a.evictPending()
+	}
+	a.received++
+	a.pending[env.Msg] = pendingReq{seq: env.Seq, order: a.received}
+	a.mu.Unlock()
+	return env.Msg
+}
+
+// evictPending 丢弃最早的请求，只有在请求数量达到上限时才会调用，guard by mu
+func (a *gateAgent) evictPending() {
+	var oldest interface{}
+	var order uint64
+	for req, p := range a.pending {
+		if oldest == nil || p.order < order {
+			oldest, order = req, p.order
+		}
+	}
+	delete(a.pending, oldest)
+	log.Printf("too many pending requests from %v, drop request %v", a.conn.RemoteAddr(), reflect.TypeOf(oldest))
+}
+
+func (a *gateAgent) takeSeq(req interface{}) (uint32, bool) {
+	a.mu.Lock()
+	p, ok := a.pending[req]
+	delete(a.pending, req)
+	a.mu.Unlock()
+	return p.seq, ok
+}
+
+func (a *gateAgent) reply(req interface{}, env *route.Envelope) {
+	seq, ok := a.takeSeq(req)
+	if !ok {
+		log.Printf("reply message %v error: request not found", reflect.TypeOf(req))
+		return
+	}
+	env.Seq = seq
+	data, err := a.gate.Processor.MarshalEnvelope(env, a)
+	if err == pkg.ErrMessageFiltered {
+		return
+	}
+	if err != nil {
+		log.Printf("marshal reply %v error: %v", reflect.TypeOf(req), err)
+		return
+	}
+	// 丢弃的消息计入Stats，不再单独记录日志
+	if err = a.write(data); err != nil && err != pkg.ErrMessageDropped {
+		log.Printf("write reply %v error: %v", reflect.TypeOf(req), err)
+	}
+}
+
+func (a *gateAgent) Reply(req interface{}, resp interface{}) {
+	if a.gate.Processor == nil {
+		return
+	}
+	if !a.gate.Processor.Envelope() {
+		a.WriteMsg(resp)
+		return
+	}
+	a.reply(req, &route.Envelope{
+		Flag: route.FlagResponse,
+		Msg:  resp,
+	})
+}
+
+func (a *gateAgent) ReplyError(req interface{}, code uint16) {
+	if a.gate.Processor == nil || !a.gate.Processor.Envelope() {
+		return
+	}
+	id, _ := a.gate.Processor.MessageID(req)
+	a.reply(req, &route.Envelope{
+		ID:   id,
+		Flag: route.FlagError,
+		Code: code,
+	})
+}
+
+func (a *gateAgent) TextMode() bool {
+	return a.text
+}
+
+func (a *gateAgent) Mailbox() *route.Mailbox {
+	return &a.mailbox
+}
+
 func (a *gateAgent) OnClose() {
-	if handler := a.gate.AgentHandler; handler != nil {
-		handler.OnClose(a)
+	// 开启会话恢复时，Run结束后会话进入保留期，由保留期结束或者主动关闭触发finalize
+	if a.gate.ResumeTimeout > 0 || a.rejected {
+		return
 	}
+	a.finalize()
+}
+
+// finalize 逻辑agent关闭，只执行一次
+func (a *gateAgent) finalize() {
+	a.closeOnce.Do(func() {
+		a.mu.Lock()
+		a.pending = nil
+		a.mu.Unlock()
+
+		if a.session != nil {
+			a.gate.removeSession(a)
+		}
+		a.gate.removeAgent(a)
+		if handler := a.gate.AgentHandler; handler != nil {
+			handler.OnClose(a)
+		}
+	})
 }
 
 func (a *gateAgent) OnConnect() {
+	// 开启会话恢复时，握手确认为新会话后才通知AgentHook
+	if a.gate.ResumeTimeout > 0 {
+		return
+	}
+	if a.gate.isDraining() {
+		a.rejected = true
+		return
+	}
+	a.connected()
+}
+
+func (a *gateAgent) connected() {
+	a.gate.addAgent(a)
 	if handler := a.gate.AgentHandler; handler != nil {
 		handler.OnConnect(a)
 	}
@@ -69,28 +277,108 @@ func (a *gateAgent) OnConnect() {
 
 func (a *gateAgent) WriteMsg(msg interface{}) {
 	if a.gate.Processor != nil {
-		data, err := a.gate.Processor.Marshal(msg)
+		data, err := a.gate.Processor.MarshalWith(msg, a)
+		if err == pkg.ErrMessageFiltered {
+			return
+		}
 		if err != nil {
 			log.Printf("marshal message %v error: %v", reflect.TypeOf(msg), err)
 			return
 		}
-		err = a.conn.WriteMsg(data)
-		if err != nil {
+		// 丢弃的消息计入Stats，不再单独记录日志
+		err = a.write(data)
+		if err != nil && err != pkg.ErrMessageDropped {
 			log.Printf("write message %v error: %v", reflect.TypeOf(msg), err)
 		}
 	}
 }
 
+// write 发送编码后的消息，开启会话恢复时记录到会话的缓冲区，会话保留期间只记录不发送
+// 写入连接时不持有a.mu，SlowBlock等待期间不影响读取与关闭
+func (a *gateAgent) write(data []byte) error {
+	if a.session == nil {
+		return a.conn.WriteMsg(data)
+	}
+	a.writeMu.Lock()
+	defer a.writeMu.Unlock()
+
+	a.mu.Lock()
+	conn, detached := a.conn, a.session.detached
+	if detached {
+		a.session.push(data, a.gate.resumeBuffer())
+	}
+	a.mu.Unlock()
+	if detached {
+		return nil
+	}
+
+	err := conn.WriteMsg(data)
+	switch err {
+	case nil, pkg.ErrConnClosed, pkg.ErrSlowConsumer:
+		// 连接正在断开时拒绝的消息排在已经发送的消息之后，与保留期间的消息一样在恢复时重发
+		a.mu.Lock()
+		a.session.push(data, a.gate.resumeBuffer())
+		a.mu.Unlock()
+		return nil
+	default:
+		// 丢弃的消息不计数，否则客户端上报的数量与会话对不上
+		return err
+	}
+}
+
+// getConn 当前绑定的连接，恢复会话时会被替换
+func (a *gateAgent) getConn() network.Conn {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.conn
+}
+
+func (a *gateAgent) Stats() network.ConnStats {
+	return a.getConn().Stats()
+}
+
 func (a *gateAgent) LocalAddr() net.Addr {
-	return a.conn.LocalAddr()
+	return a.getConn().LocalAddr()
 }
 
 func (a *gateAgent) RemoteAddr() net.Addr {
-	return a.conn.RemoteAddr()
+	return a.getConn().RemoteAddr()
 }
 
 func (a *gateAgent) Close() {
-	a.conn.Close()
+	a.mu.Lock()
+	a.closed = true
+	conn, detached := a.conn, a.detached()
+	a.mu.Unlock()
+
+	if detached {
+		a.finalize()
+		return
+	}
+	conn.Close()
+}
+
+func (a *gateAgent) Kick(reason error) {
+	if reason == nil {
+		reason = pkg.ErrKicked
+	}
+	a.setCloseReason(reason)
+	a.Close()
+}
+
+// setCloseReason 记录断开原因，只保留第一个
+func (a *gateAgent) setCloseReason(reason error) {
+	a.mu.Lock()
+	if a.reason == nil {
+		a.reason = reason
+	}
+	a.mu.Unlock()
+}
+
+func (a *gateAgent) CloseReason() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.reason
 }
 
 func (a *gateAgent) UserData() interface{} {
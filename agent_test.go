@@ -0,0 +1,30 @@
+package gogame
+
+import (
+	"testing"
+
+	"github.com/pyihe/gogame/route"
+)
+
+func TestPendingLimit(t *testing.T) {
+	a := &gateAgent{conn: newPipeConn(), gate: &Gate{MaxPending: 2}}
+	reqs := []*resumeMsg{{N: 1}, {N: 2}, {N: 3}}
+	for i, req := range reqs {
+		a.onEnvelope(&route.Envelope{Flag: route.FlagRequest, Seq: uint32(i + 1), Msg: req})
+	}
+
+	// 超过上限时丢弃最早的请求
+	if _, ok := a.takeSeq(reqs[0]); ok {
+		t.Fatal("oldest request not dropped")
+	}
+	for i, req := range reqs[1:] {
+		if seq, ok := a.takeSeq(req); !ok || seq != uint32(i+2) {
+			t.Fatalf("request %d: got seq %d, %v", i+2, seq, ok)
+		}
+	}
+	// 请求按指针识别，内容相同的拷贝无法响应
+	a.onEnvelope(&route.Envelope{Flag: route.FlagRequest, Seq: 4, Msg: &resumeMsg{N: 4}})
+	if _, ok := a.takeSeq(&resumeMsg{N: 4}); ok {
+		t.Fatal("copy of request matched")
+	}
+}
@@ -0,0 +1,182 @@
+package gogame
+
+import (
+	"fmt"
+	"hash/crc32"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pyihe/gogame/pkg"
+)
+
+// Balancer 负载均衡策略，从导出了同一模块的节点中选择一个作为调用目标
+type Balancer interface {
+	// Select 从nodes中选择一个节点，nodes不为空
+	// key由调用方提供，比如玩家ID或者Agent，不需要key的策略可以忽略
+	Select(nodes []uint16, key interface{}) uint16
+}
+
+// RoundRobin 轮询
+func RoundRobin() Balancer {
+	return &roundRobin{}
+}
+
+type roundRobin struct {
+	next uint32
+}
+
+func (rr *roundRobin) Select(nodes []uint16, _ interface{}) uint16 {
+	n := atomic.AddUint32(&rr.next, 1)
+	return nodes[int(n-1)%len(nodes)]
+}
+
+// LeastPending 选择尚未返回的同步调用数量最少的节点
+func LeastPending() Balancer {
+	return leastPending{}
+}
+
+type leastPending struct{}
+
+func (leastPending) Select(nodes []uint16, _ interface{}) uint16 {
+	target, min := nodes[0], ClusterPending(nodes[0])
+	for _, nodeID := range nodes[1:] {
+		if n := ClusterPending(nodeID); n < min {
+			target, min = nodeID, n
+		}
+	}
+	return target
+}
+
+// ConsistentHash 根据key做一致性哈希，节点增减时只有少部分key会迁移
+// replicas为每个节点的虚拟节点数
+func ConsistentHash(replicas int) Balancer {
+	if replicas <= 0 {
+		replicas = 100
+	}
+	return &consistentHash{replicas: replicas}
+}
+
+type consistentHash struct {
+	replicas int
+
+	mu     sync.Mutex
+	sign   string            // 构建哈希环时的节点列表
+	ring   []uint32          // 排好序的虚拟节点哈希值
+	owners map[uint32]uint16 // 虚拟节点哈希值 -> 节点ID
+}
+
+func (h *consistentHash) build(nodes []uint16) {
+	h.ring = make([]uint32, 0, len(nodes)*h.replicas)
+	h.owners = make(map[uint32]uint16, len(nodes)*h.replicas)
+	for _, nodeID := range nodes {
+		for i := 0; i < h.replicas; i++ {
+			hv := crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + "#" + strconv.Itoa(int(nodeID))))
+			if _, ok := h.owners[hv]; ok {
+				continue
+			}
+			h.owners[hv] = nodeID
+			h.ring = append(h.ring, hv)
+		}
+	}
+	sort.Slice(h.ring, func(i, j int) bool {
+		return h.ring[i] < h.ring[j]
+	})
+}
+
+func (h *consistentHash) Select(nodes []uint16, key interface{}) uint16 {
+	sorted := make([]uint16, len(nodes))
+	copy(sorted, nodes)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+	sign := fmt.Sprint(sorted)
+	hv := crc32.ChecksumIEEE([]byte(fmt.Sprint(key)))
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if sign != h.sign {
+		h.sign = sign
+		h.build(sorted)
+	}
+	i := sort.Search(len(h.ring), func(i int) bool {
+		return h.ring[i] >= hv
+	})
+	if i == len(h.ring) {
+		i = 0
+	}
+	return h.owners[h.ring[i]]
+}
+
+// StickyBalancer 粘性负载均衡：同一个key首次由内部策略选出节点后，后续一直使用该节点，直到该节点不可用
+// key为Agent时，以Agent的UserData作为粘性依据(UserData为空或者不可比较时使用Agent本身)
+type StickyBalancer struct {
+	b Balancer
+	m pkg.Map
+}
+
+func Sticky(b Balancer) *StickyBalancer {
+	if b == nil {
+		b = RoundRobin()
+	}
+	return &StickyBalancer{b: b}
+}
+
+func stickyKey(key interface{}) interface{} {
+	a, ok := key.(Agent)
+	if !ok {
+		return key
+	}
+	data := a.UserData()
+	if data == nil || !reflect.TypeOf(data).Comparable() {
+		return a
+	}
+	return data
+}
+
+func (s *StickyBalancer) Select(nodes []uint16, key interface{}) uint16 {
+	k := stickyKey(key)
+	if nodeID, ok := s.m.Get(k).(uint16); ok {
+		for _, n := range nodes {
+			if n == nodeID {
+				return nodeID
+			}
+		}
+	}
+	nodeID := s.b.Select(nodes, key)
+	s.m.Set(k, nodeID)
+	return nodeID
+}
+
+// Unbind 解除key与节点的绑定，比如玩家下线时
+func (s *StickyBalancer) Unbind(key interface{}) {
+	s.m.Del(stickyKey(key))
+}
+
+// BalancedServer 集群中所有导出了名为name的chanrpc server的节点，调用前通过Pick按策略选择其中一个
+type BalancedServer struct {
+	name     string
+	balancer Balancer
+}
+
+func NewBalancedServer(name string, balancer Balancer) *BalancedServer {
+	if balancer == nil {
+		balancer = RoundRobin()
+	}
+	return &BalancedServer{
+		name:     name,
+		balancer: balancer,
+	}
+}
+
+// Pick 根据key选择一个节点上的chanrpc server
+func (bs *BalancedServer) Pick(key interface{}) (*RemoteServer, error) {
+	nodes := ClusterNodesWith(bs.name)
+	if len(nodes) == 0 {
+		return nil, pkg.ErrNoAvailableNode
+	}
+	return NewRemoteServer(bs.balancer.Select(nodes, key), bs.name), nil
+}
@@ -0,0 +1,83 @@
+package gogame
+
+import (
+	"testing"
+)
+
+func TestRoundRobin(t *testing.T) {
+	b := RoundRobin()
+	nodes := []uint16{1, 2, 3}
+	for i := 0; i < 6; i++ {
+		if n := b.Select(nodes, nil); n != nodes[i%3] {
+			t.Fatalf("round %d: got %d, want %d", i, n, nodes[i%3])
+		}
+	}
+}
+
+func TestConsistentHash(t *testing.T) {
+	b := ConsistentHash(0)
+	nodes := []uint16{1, 2, 3}
+
+	picked := make(map[int]uint16)
+	for key := 0; key < 1000; key++ {
+		picked[key] = b.Select(nodes, key)
+	}
+	// 节点顺序不影响结果
+	for key := 0; key < 1000; key++ {
+		if n := b.Select([]uint16{3, 1, 2}, key); n != picked[key] {
+			t.Fatalf("key %d: got %d, want %d", key, n, picked[key])
+		}
+	}
+	// 移除节点3后，原本落在1、2上的key不受影响
+	for key := 0; key < 1000; key++ {
+		n := b.Select([]uint16{1, 2}, key)
+		if picked[key] != 3 && n != picked[key] {
+			t.Fatalf("key %d moved from %d to %d", key, picked[key], n)
+		}
+	}
+}
+
+func TestSticky(t *testing.T) {
+	b := Sticky(RoundRobin())
+	first := b.Select([]uint16{1, 2}, "player")
+	for i := 0; i < 5; i++ {
+		if n := b.Select([]uint16{1, 2}, "player"); n != first {
+			t.Fatalf("got %d, want %d", n, first)
+		}
+	}
+	// 绑定的节点不可用时重新选择
+	var other uint16 = 1
+	if first == 1 {
+		other = 2
+	}
+	if n := b.Select([]uint16{other}, "player"); n != other {
+		t.Fatalf("got %d, want %d", n, other)
+	}
+	b.Unbind("player")
+}
+
+func TestBalancedServer(t *testing.T) {
+	ids := []uint16{105, 103, 109, 101}
+	for _, id := range ids {
+		addClusterNode(&clusterAgent{nodeID: id, modules: []string{"balancer.test"}})
+	}
+	addClusterNode(&clusterAgent{nodeID: 102})
+	defer func() {
+		for _, id := range append(ids, 102) {
+			delClusterNode(getClusterNode(id))
+		}
+	}()
+
+	// 节点按ID排序后再交给Balancer，RoundRobin按固定顺序轮转
+	bs := NewBalancedServer("balancer.test", RoundRobin())
+	want := []uint16{101, 103, 105, 109}
+	for i := 0; i < 8; i++ {
+		rs, err := bs.Pick(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rs.nodeID != want[i%len(want)] {
+			t.Fatalf("round %d: got %d, want %d", i, rs.nodeID, want[i%len(want)])
+		}
+	}
+}
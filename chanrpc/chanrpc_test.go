@@ -0,0 +1,270 @@
+package chanrpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pyihe/gogame/pkg"
+)
+
+func runServer(s *Server) {
+	go func() {
+		for ci := range s.Chan() {
+			s.Exec(ci)
+		}
+	}()
+}
+
+func TestCallContext(t *testing.T) {
+	s := NewServer(1)
+	s.Register("sleep", func(args ...interface{}) interface{} {
+		time.Sleep(args[0].(time.Duration))
+		return "done"
+	})
+	runServer(s)
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := s.Call1Context(ctx, "sleep", 100*time.Millisecond); err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// 迟到的结果不会被后续调用读到
+	c := s.Open(0)
+	_, err := c.Call1Context(ctx, "sleep", time.Duration(0))
+	if err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	v, err := c.Call1Context(context.Background(), "sleep", time.Millisecond)
+	if err != nil || v != "done" {
+		t.Fatalf("got %v, %v", v, err)
+	}
+}
+
+type addReq struct {
+	A, B int
+}
+
+func TestGeneric(t *testing.T) {
+	s := NewServer(10)
+	errNegative := errors.New("negative")
+	err := Register(s, "add", func(req *addReq) (int, error) {
+		if req.A < 0 || req.B < 0 {
+			return 0, errNegative
+		}
+		return req.A + req.B, nil
+	})
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	runServer(s)
+	defer s.Close()
+
+	if v, err := Call[*addReq, int](s, "add", &addReq{A: 1, B: 2}); err != nil || v != 3 {
+		t.Fatalf("got %v, %v", v, err)
+	}
+	if _, err := Call[*addReq, int](s, "add", &addReq{A: -1}); err != errNegative {
+		t.Fatalf("got %v, want %v", err, errNegative)
+	}
+	if _, err := Call[string, int](s, "add", "1+2"); err != pkg.ErrArgsMismatch {
+		t.Fatalf("got %v, want %v", err, pkg.ErrArgsMismatch)
+	}
+	if _, err := Call[*addReq, string](s, "add", &addReq{}); err != pkg.ErrResultMismatch {
+		t.Fatalf("got %v, want %v", err, pkg.ErrResultMismatch)
+	}
+}
+
+func TestInterceptor(t *testing.T) {
+	s := NewServer(10)
+	s.Register("echo", func(args ...interface{}) interface{} {
+		return args[0]
+	})
+	s.Register("panic", func(args ...interface{}) {
+		panic("boom")
+	})
+
+	var trace []string
+	errDenied := errors.New("denied")
+	errPanic := errors.New("panic")
+	s.Use(
+		Recovery(func(id interface{}, r interface{}) error {
+			return errPanic
+		}),
+		func(id interface{}, args []interface{}, next Handler) (interface{}, error) {
+			trace = append(trace, "outer")
+			return next(id, args)
+		},
+		func(id interface{}, args []interface{}, next Handler) (interface{}, error) {
+			trace = append(trace, "inner")
+			if args[0] == "deny" {
+				return nil, errDenied
+			}
+			v, err := next(id, args)
+			return fmt.Sprintf("%v!", v), err
+		},
+	)
+	runServer(s)
+	defer s.Close()
+
+	if v, err := s.Call1("echo", "hi"); err != nil || v != "hi!" {
+		t.Fatalf("got %v, %v", v, err)
+	}
+	if _, err := s.Call1("echo", "deny"); err != errDenied {
+		t.Fatalf("got %v, want %v", err, errDenied)
+	}
+	if err := s.Call0("panic", "x"); err != errPanic {
+		t.Fatalf("got %v, want %v", err, errPanic)
+	}
+	if len(trace) != 6 || trace[0] != "outer" || trace[1] != "inner" {
+		t.Fatalf("unexpected trace: %v", trace)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	s := NewServer(10)
+	s.EnableMetrics("test", time.Millisecond)
+	s.Register("sleep", func(args ...interface{}) {
+		time.Sleep(args[0].(time.Duration))
+	})
+	s.Register("fail", func(args ...interface{}) (interface{}, error) {
+		return nil, errors.New("fail")
+	})
+	runServer(s)
+
+	s.Call0("sleep", time.Duration(0))
+	s.Call0("sleep", 5*time.Millisecond)
+	s.Call0("fail")
+
+	stats := s.Stats()
+	if stats.Total.Enqueued != 3 || stats.Total.Executed != 3 || stats.Total.Failed != 1 {
+		t.Fatalf("unexpected total: %+v", stats.Total)
+	}
+	if cs := stats.Calls["sleep"]; cs == nil || cs.Slow != 1 || cs.Exec.Count != 2 {
+		t.Fatalf("unexpected sleep stats: %+v", cs)
+	}
+	if len(AllStats()) != 1 {
+		t.Fatalf("server not registered")
+	}
+	s.Close()
+	if len(AllStats()) != 0 {
+		t.Fatalf("server not unregistered")
+	}
+}
+
+func TestOverflowPolicy(t *testing.T) {
+	var dead []interface{}
+	newServer := func(policy OverflowPolicy) *Server {
+		s := NewServer(1)
+		s.Register("f", func(args ...interface{}) {})
+		s.SetOverflowPolicy(policy)
+		s.SetDeadLetter(func(id interface{}, args []interface{}, err error) {
+			dead = append(dead, args[0])
+		})
+		return s
+	}
+
+	s := newServer(OverflowError)
+	if err := s.Post("f", 1); err != nil {
+		t.Fatalf("post: %v", err)
+	}
+	if err := s.Post("f", 2); err != pkg.ErrFullChannel {
+		t.Fatalf("got %v, want %v", err, pkg.ErrFullChannel)
+	}
+	if err := s.Post("g", 3); err != pkg.ErrNotRegistered {
+		t.Fatalf("got %v, want %v", err, pkg.ErrNotRegistered)
+	}
+
+	s = newServer(OverflowDropNewest)
+	s.Go("f", 4)
+	if err := s.Post("f", 5); err != nil {
+		t.Fatalf("post: %v", err)
+	}
+	if ci := <-s.Chan(); ci.args[0] != 4 {
+		t.Fatalf("got %v, want 4", ci.args[0])
+	}
+
+	s = newServer(OverflowDropOldest)
+	s.Go("f", 6)
+	s.Go("f", 7)
+	if ci := <-s.Chan(); ci.args[0] != 7 {
+		t.Fatalf("got %v, want 7", ci.args[0])
+	}
+
+	if fmt.Sprint(dead) != "[2 3 5 6]" {
+		t.Fatalf("unexpected dead letters: %v", dead)
+	}
+}
+
+func TestFuture(t *testing.T) {
+	s1, s2 := NewServer(10), NewServer(10)
+	for i, s := range []*Server{s1, s2} {
+		n := i + 1
+		s.Register("id", func(args ...interface{}) interface{} {
+			return n
+		})
+		s.Register("fail", func(args ...interface{}) (interface{}, error) {
+			return nil, errors.New("fail")
+		})
+		runServer(s)
+	}
+	defer s1.Close()
+	defer s2.Close()
+
+	if v, err := s1.CallAsync("id").Wait(); err != nil || v != 1 {
+		t.Fatalf("got %v, %v", v, err)
+	}
+
+	v, err := All(s1.CallAsync("id"), s2.CallAsync("id")).Wait()
+	if err != nil || fmt.Sprint(v) != "[1 2]" {
+		t.Fatalf("got %v, %v", v, err)
+	}
+	if _, err = All(s1.CallAsync("id"), s2.CallAsync("fail")).Wait(); err == nil {
+		t.Fatalf("all should fail")
+	}
+	if v, err = Any(s1.CallAsync("fail"), s2.CallAsync("id")).Wait(); err != nil || v != 2 {
+		t.Fatalf("got %v, %v", v, err)
+	}
+
+	done := make(chan interface{}, 1)
+	s2.CallAsync("id").Then(func(v interface{}, err error) {
+		done <- v
+	})
+	if v := <-done; v != 2 {
+		t.Fatalf("got %v, want 2", v)
+	}
+
+	if _, err = s1.CallAsync("none").Wait(); err != pkg.ErrNotRegistered {
+		t.Fatalf("got %v, want %v", err, pkg.ErrNotRegistered)
+	}
+}
+
+func TestCloseWhileGo(t *testing.T) {
+	for _, policy := range []OverflowPolicy{OverflowBlock, OverflowDropOldest} {
+		s := NewServer(1)
+		s.Register("f", func(args ...interface{}) {})
+		s.SetOverflowPolicy(policy)
+
+		// 队列已满时并发投递与关闭，不能向已关闭的chanCall发送
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					s.Go("f", j)
+				}
+			}()
+		}
+		time.Sleep(time.Millisecond)
+		s.Close()
+		wg.Wait()
+		if err := s.Post("f", 0); err != pkg.ErrServerClosed {
+			t.Fatalf("got %v, want %v", err, pkg.ErrServerClosed)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package chanrpc
 
 import (
+	"context"
 	"runtime"
 	"sync"
 
@@ -57,6 +58,7 @@ func (c *Client) Call0(id interface{}, args ...interface{}) (err error) {
 	}
 
 	request := &CallInfo{
+		id:         id,
 		f:          f,
 		args:       args,
 		resultChan: c.chanSyncRet,
@@ -80,6 +82,7 @@ func (c *Client) Call1(id interface{}, args ...interface{}) (value interface{},
 	}
 
 	request := &CallInfo{
+		id:         id,
 		f:          f,
 		args:       args,
 		resultChan: c.chanSyncRet,
@@ -104,6 +107,7 @@ func (c *Client) CallN(id interface{}, args ...interface{}) (value []interface{}
 	}
 
 	request := &CallInfo{
+		id:         id,
 		f:          f,
 		args:       args,
 		resultChan: c.chanSyncRet,
@@ -117,15 +121,66 @@ func (c *Client) CallN(id interface{}, args ...interface{}) (value []interface{}
 	return
 }
 
-func (c *Client) asynCall(id interface{}, args []interface{}, cb interface{}) {
-	result := &Result{}
-
+// callContext 同步调用，ctx结束时立即返回ctx.Err()
+// 每次调用使用独立的结果通道，超时后迟到的结果会被直接丢弃，不会影响该Client后续的调用
+func (c *Client) callContext(ctx context.Context, id interface{}, args []interface{}) (*Result, error) {
 	if c.s == nil {
+		return nil, pkg.ErrServerNotAttached
+	}
+	f := c.s.getFunc(id)
+	if f == nil {
+		return nil, pkg.ErrNotRegistered
+	}
+
+	request := &CallInfo{
+		id:         id,
+		f:          f,
+		args:       args,
+		resultChan: make(chan *Result, 1),
+		ctx:        ctx,
+	}
+	if err := c.s.callContext(ctx, request); err != nil {
+		return nil, err
+	}
+
+	select {
+	case result := <-request.resultChan:
+		return result, result.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *Client) Call0Context(ctx context.Context, id interface{}, args ...interface{}) error {
+	_, err := c.callContext(ctx, id, args)
+	return err
+}
+
+func (c *Client) Call1Context(ctx context.Context, id interface{}, args ...interface{}) (interface{}, error) {
+	result, err := c.callContext(ctx, id, args)
+	if result == nil {
+		return nil, err
+	}
+	return result.value, err
+}
+
+func (c *Client) CallNContext(ctx context.Context, id interface{}, args ...interface{}) ([]interface{}, error) {
+	result, err := c.callContext(ctx, id, args)
+	if result == nil {
+		return nil, err
+	}
+	return assert(result.value), err
+}
+
+func (c *Client) asynCall(s *Server, id interface{}, args []interface{}, cb interface{}) {
+	result := &Result{cb: cb}
+
+	if s == nil {
 		result.err = pkg.ErrServerNotAttached
 		c.ChanAsynRet <- result
 		return
 	}
-	f := c.s.getFunc(id)
+	f := s.getFunc(id)
 	if f == nil {
 		result.err = pkg.ErrNotRegistered
 		c.ChanAsynRet <- result
@@ -133,12 +188,13 @@ func (c *Client) asynCall(id interface{}, args []interface{}, cb interface{}) {
 	}
 
 	request := &CallInfo{
+		id:         id,
 		f:          f,
 		args:       args,
 		resultChan: c.ChanAsynRet,
 		cb:         cb,
 	}
-	err := c.s.call(request, false)
+	err := s.call(request, false)
 	if err != nil {
 		result.err = err
 		c.ChanAsynRet <- result
@@ -146,6 +202,12 @@ func (c *Client) asynCall(id interface{}, args []interface{}, cb interface{}) {
 }
 
 func (c *Client) AsynCall(id interface{}, args ...interface{}) {
+	c.AsynCallServer(c.s, id, args...)
+}
+
+// AsynCallServer 异步调用指定的Server，结果与AsynCall一样通过ChanAsynRet返回
+// 同一个Client可以同时异步调用多个Server，不需要AttachSever
+func (c *Client) AsynCallServer(s *Server, id interface{}, args ...interface{}) {
 	if len(args) < 1 {
 		panic("callback function required")
 	}
@@ -167,7 +229,7 @@ func (c *Client) AsynCall(id interface{}, args ...interface{}) {
 		return
 	}
 
-	c.asynCall(id, _args, cb)
+	c.asynCall(s, id, _args, cb)
 	c.pendingAsynCall++
 }
 
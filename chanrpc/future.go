@@ -0,0 +1,175 @@
+package chanrpc
+
+import (
+	"context"
+	"runtime"
+	"sync"
+
+	"github.com/pyihe/gogame/pkg"
+	"github.com/pyihe/gogame/pkg/log"
+)
+
+// Future 异步调用的结果，可以在任意goroutine中等待或者设置回调
+type Future struct {
+	once  sync.Once
+	done  chan struct{}
+	value interface{}
+	err   error
+
+	mu        sync.Mutex
+	callbacks []func(interface{}, error)
+}
+
+func newFuture() *Future {
+	return &Future{done: make(chan struct{})}
+}
+
+func (f *Future) complete(value interface{}, err error) {
+	f.once.Do(func() {
+		f.value, f.err = value, err
+
+		f.mu.Lock()
+		callbacks := f.callbacks
+		f.callbacks = nil
+		close(f.done)
+		f.mu.Unlock()
+
+		for _, cb := range callbacks {
+			runCallback(cb, value, err)
+		}
+	})
+}
+
+func runCallback(cb func(interface{}, error), value interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			buf := make([]byte, pkg.StackSize)
+			n := runtime.Stack(buf, false)
+			log.Printf("RPC Future: callback failed: %v: %s", r, buf[:n])
+		}
+	}()
+	cb(value, err)
+}
+
+// Done 调用完成时关闭
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait 等待调用完成，返回值与Call1一致，CallN类型的函数返回[]interface{}
+func (f *Future) Wait() (interface{}, error) {
+	<-f.done
+	return f.value, f.err
+}
+
+// WaitContext 等待调用完成，ctx结束时立即返回ctx.Err()，调用结果不受影响
+func (f *Future) WaitContext(ctx context.Context) (interface{}, error) {
+	select {
+	case <-f.done:
+		return f.value, f.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Then 设置调用完成后的回调，回调在完成调用的goroutine(一般为目标Server所在的goroutine)中执行，不能阻塞
+// 如果调用已经完成，回调立即在当前goroutine中执行
+// 需要在模块goroutine中执行回调时，请使用Skeleton.Await
+func (f *Future) Then(cb func(interface{}, error)) *Future {
+	if cb == nil {
+		return f
+	}
+	f.mu.Lock()
+	select {
+	case <-f.done:
+		f.mu.Unlock()
+		runCallback(cb, f.value, f.err)
+	default:
+		f.callbacks = append(f.callbacks, cb)
+		f.mu.Unlock()
+	}
+	return f
+}
+
+// All 所有调用都成功时完成，结果为按顺序排列的[]interface{}；任意一个调用失败时立即以该错误完成
+func All(futures ...*Future) *Future {
+	all := newFuture()
+	if len(futures) == 0 {
+		all.complete([]interface{}{}, nil)
+		return all
+	}
+
+	var mu sync.Mutex
+	var remain = len(futures)
+	var values = make([]interface{}, len(futures))
+	for i, f := range futures {
+		i := i
+		f.Then(func(value interface{}, err error) {
+			if err != nil {
+				all.complete(nil, err)
+				return
+			}
+			mu.Lock()
+			values[i] = value
+			remain--
+			finished := remain == 0
+			mu.Unlock()
+			if finished {
+				all.complete(values, nil)
+			}
+		})
+	}
+	return all
+}
+
+// Any 以第一个成功的调用结果完成；所有调用都失败时，以最后一个错误完成
+func Any(futures ...*Future) *Future {
+	first := newFuture()
+	if len(futures) == 0 {
+		first.complete(nil, pkg.ErrNoFuture)
+		return first
+	}
+
+	var mu sync.Mutex
+	var remain = len(futures)
+	for _, f := range futures {
+		f.Then(func(value interface{}, err error) {
+			if err == nil {
+				first.complete(value, nil)
+				return
+			}
+			mu.Lock()
+			remain--
+			finished := remain == 0
+			mu.Unlock()
+			if finished {
+				first.complete(nil, err)
+			}
+		})
+	}
+	return first
+}
+
+// CallAsync 发起异步调用并返回Future，不需要Client，也不需要在Skeleton中使用
+// 队列已满时Future以ErrFullChannel完成
+// goroutine safe
+func (s *Server) CallAsync(id interface{}, args ...interface{}) *Future {
+	future := newFuture()
+
+	f := s.getFunc(id)
+	if f == nil {
+		future.complete(nil, pkg.ErrNotRegistered)
+		return future
+	}
+
+	request := &CallInfo{
+		id:     id,
+		f:      f,
+		args:   args,
+		future: future,
+	}
+	if err := s.call(request, false); err != nil {
+		future.complete(nil, err)
+	}
+	return future
+}
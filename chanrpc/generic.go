@@ -0,0 +1,60 @@
+package chanrpc
+
+import (
+	"context"
+
+	"github.com/pyihe/gogame/pkg"
+)
+
+// Register 注册类型安全的RPC函数，f返回的error会传递给调用方
+// 通过Call/CallContext调用，也可以通过Call1/AsynCall以单个参数调用
+func Register[Req, Resp any](s *Server, id interface{}, f func(Req) (Resp, error)) error {
+	if f == nil {
+		return pkg.ErrFunctionTypeNotSupported
+	}
+	return s.Register(id, func(args ...interface{}) (interface{}, error) {
+		if len(args) != 1 {
+			return nil, pkg.ErrArgsMismatch
+		}
+		req, ok := args[0].(Req)
+		if !ok && args[0] != nil {
+			return nil, pkg.ErrArgsMismatch
+		}
+		return f(req)
+	})
+}
+
+func convert[Resp any](value interface{}, err error) (resp Resp, _ error) {
+	if err != nil || value == nil {
+		return resp, err
+	}
+	resp, ok := value.(Resp)
+	if !ok {
+		return resp, pkg.ErrResultMismatch
+	}
+	return resp, nil
+}
+
+// Call 类型安全的同步调用
+// goroutine safe
+func Call[Req, Resp any](s *Server, id interface{}, req Req) (Resp, error) {
+	return convert[Resp](s.Call1(id, req))
+}
+
+// CallContext 类型安全的同步调用，ctx结束时立即返回ctx.Err()
+// goroutine safe
+func CallContext[Req, Resp any](ctx context.Context, s *Server, id interface{}, req Req) (Resp, error) {
+	return convert[Resp](s.Call1Context(ctx, id, req))
+}
+
+// Go 类型安全的异步调用，不关心结果
+// goroutine safe
+func Go[Req any](s *Server, id interface{}, req Req) {
+	s.Go(id, req)
+}
+
+// Post 类型安全的异步调用，返回投递的结果
+// goroutine safe
+func Post[Req any](s *Server, id interface{}, req Req) error {
+	return s.Post(id, req)
+}
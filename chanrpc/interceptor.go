@@ -0,0 +1,41 @@
+package chanrpc
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/pyihe/gogame/pkg"
+)
+
+// Handler 执行一次RPC，返回值与错误会传递给调用方
+type Handler func(id interface{}, args []interface{}) (interface{}, error)
+
+// Interceptor RPC拦截器，可以在调用next前后检查或修改参数、返回值与错误，也可以不调用next直接返回
+// 比如：耗时统计、鉴权、审计日志、链路追踪
+type Interceptor func(id interface{}, args []interface{}, next Handler) (interface{}, error)
+
+func chain(i Interceptor, next Handler) Handler {
+	return func(id interface{}, args []interface{}) (interface{}, error) {
+		return i(id, args, next)
+	}
+}
+
+// Recovery 将RPC执行过程中的panic转换为返回给调用方的错误
+// handler为nil时，错误信息中包含堆栈
+func Recovery(handler func(id interface{}, r interface{}) error) Interceptor {
+	return func(id interface{}, args []interface{}, next Handler) (value interface{}, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				value = nil
+				if handler != nil {
+					err = handler(id, r)
+					return
+				}
+				buf := make([]byte, pkg.StackSize)
+				n := runtime.Stack(buf, false)
+				err = fmt.Errorf("RPC: %v exec failed: %v: %s", id, r, buf[:n])
+			}
+		}()
+		return next(id, args)
+	}
+}
@@ -0,0 +1,207 @@
+package chanrpc
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pyihe/gogame/pkg/log"
+)
+
+// LatencyBuckets 耗时直方图的桶边界
+var LatencyBuckets = []time.Duration{
+	100 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+// Histogram 耗时直方图
+type Histogram struct {
+	Count uint64        `json:"count"`
+	Sum   time.Duration `json:"sum"`
+	Max   time.Duration `json:"max"`
+	// Buckets[i]为耗时不超过LatencyBuckets[i]的次数，最后一个为超过所有边界的次数
+	Buckets []uint64 `json:"buckets"`
+}
+
+func (h *Histogram) observe(d time.Duration) {
+	if h.Buckets == nil {
+		h.Buckets = make([]uint64, len(LatencyBuckets)+1)
+	}
+	h.Count++
+	h.Sum += d
+	if d > h.Max {
+		h.Max = d
+	}
+	i := sort.Search(len(LatencyBuckets), func(i int) bool {
+		return d <= LatencyBuckets[i]
+	})
+	h.Buckets[i]++
+}
+
+func (h Histogram) clone() Histogram {
+	h.Buckets = append([]uint64(nil), h.Buckets...)
+	return h
+}
+
+// CallStats 调用统计
+type CallStats struct {
+	Enqueued uint64    `json:"enqueued"` // 投递成功的调用次数
+	Executed uint64    `json:"executed"` // 执行完成的调用次数
+	Failed   uint64    `json:"failed"`   // 返回错误的调用次数(包括panic)
+	Panicked uint64    `json:"panicked"` // 执行过程中panic的调用次数
+	Slow     uint64    `json:"slow"`     // 执行耗时超过慢调用阈值的次数
+	Dropped  uint64    `json:"dropped"`  // 未注册或者因为队列已满被丢弃的Go调用次数
+	Exec     Histogram `json:"exec"`     // 执行耗时
+	Wait     Histogram `json:"wait"`     // 在队列中的等待耗时
+}
+
+func (cs *CallStats) clone() *CallStats {
+	c := *cs
+	c.Exec = cs.Exec.clone()
+	c.Wait = cs.Wait.clone()
+	return &c
+}
+
+// ServerStats Server的统计快照
+type ServerStats struct {
+	Name        string                `json:"name"`
+	QueueLen    int                   `json:"queue_len"`     // 当前排队的调用数量
+	QueueCap    int                   `json:"queue_cap"`     // 队列容量
+	MaxQueueLen int                   `json:"max_queue_len"` // 投递时观察到的最大排队数量
+	Total       *CallStats            `json:"total"`         // 所有调用的汇总
+	Calls       map[string]*CallStats `json:"calls"`         // 按调用ID统计
+}
+
+type metrics struct {
+	name string
+	slow time.Duration
+
+	mu          sync.Mutex
+	maxQueueLen int
+	total       CallStats
+	calls       map[interface{}]*CallStats
+}
+
+func (m *metrics) get(id interface{}) *CallStats {
+	cs, ok := m.calls[id]
+	if !ok {
+		cs = &CallStats{}
+		m.calls[id] = cs
+	}
+	return cs
+}
+
+func (m *metrics) onEnqueue(id interface{}, queueLen int) {
+	m.mu.Lock()
+	m.total.Enqueued++
+	m.get(id).Enqueued++
+	if queueLen > m.maxQueueLen {
+		m.maxQueueLen = queueLen
+	}
+	m.mu.Unlock()
+}
+
+func (m *metrics) onDrop(id interface{}) {
+	m.mu.Lock()
+	m.total.Dropped++
+	m.get(id).Dropped++
+	m.mu.Unlock()
+}
+
+func (m *metrics) onExec(ci *CallInfo, start time.Time, err error, panicked bool) {
+	cost := time.Since(start)
+	slow := m.slow > 0 && cost > m.slow
+
+	m.mu.Lock()
+	for _, cs := range []*CallStats{&m.total, m.get(ci.id)} {
+		cs.Executed++
+		if err != nil {
+			cs.Failed++
+		}
+		if panicked {
+			cs.Panicked++
+		}
+		if slow {
+			cs.Slow++
+		}
+		cs.Exec.observe(cost)
+		if !ci.enqueueTime.IsZero() {
+			cs.Wait.observe(start.Sub(ci.enqueueTime))
+		}
+	}
+	m.mu.Unlock()
+
+	if slow {
+		log.Printf("RPC: slow call on %s: id=%v args=%v cost=%v", m.name, ci.id, ci.args, cost)
+	}
+}
+
+var servers struct {
+	mu sync.RWMutex
+	m  map[*Server]struct{}
+}
+
+// EnableMetrics 开启调用统计，name用于区分不同的Server
+// slow大于0时，执行耗时超过slow的调用会打印调用ID与参数
+// you must call the function before calling Open and Go
+func (s *Server) EnableMetrics(name string, slow time.Duration) {
+	s.metrics = &metrics{
+		name:  name,
+		slow:  slow,
+		calls: make(map[interface{}]*CallStats),
+	}
+
+	servers.mu.Lock()
+	if servers.m == nil {
+		servers.m = make(map[*Server]struct{})
+	}
+	servers.m[s] = struct{}{}
+	servers.mu.Unlock()
+}
+
+// Stats 获取统计快照，未开启统计时返回nil
+func (s *Server) Stats() *ServerStats {
+	m := s.metrics
+	if m == nil {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stats := &ServerStats{
+		Name:        m.name,
+		QueueLen:    len(s.chanCall),
+		QueueCap:    cap(s.chanCall),
+		MaxQueueLen: m.maxQueueLen,
+		Total:       m.total.clone(),
+		Calls:       make(map[string]*CallStats, len(m.calls)),
+	}
+	for id, cs := range m.calls {
+		stats.Calls[fmt.Sprint(id)] = cs.clone()
+	}
+	return stats
+}
+
+// AllStats 获取所有开启了统计的Server的统计快照
+func AllStats() []*ServerStats {
+	servers.mu.RLock()
+	all := make([]*ServerStats, 0, len(servers.m))
+	for s := range servers.m {
+		all = append(all, s.Stats())
+	}
+	servers.mu.RUnlock()
+
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].Name < all[j].Name
+	})
+	return all
+}
@@ -0,0 +1,37 @@
+package chanrpc
+
+// OverflowPolicy Go调用时队列已满的处理策略
+type OverflowPolicy uint8
+
+const (
+	OverflowBlock      OverflowPolicy = iota // 阻塞直到队列有空位(默认)
+	OverflowDropNewest                       // 丢弃本次调用
+	OverflowDropOldest                       // 丢弃队列中最早的调用，再投递本次调用
+	OverflowError                            // 不投递，返回ErrFullChannel
+)
+
+// DeadLetter 未能执行的Go调用：调用ID未注册，或者因为队列已满被丢弃
+type DeadLetter func(id interface{}, args []interface{}, err error)
+
+// SetOverflowPolicy 设置Go调用时队列已满的处理策略
+// you must call the function before calling Open and Go
+func (s *Server) SetOverflowPolicy(policy OverflowPolicy) {
+	s.overflow = policy
+}
+
+// SetDeadLetter 设置未能执行的Go调用的回调，f在调用Go的goroutine中执行
+// you must call the function before calling Open and Go
+func (s *Server) SetDeadLetter(f DeadLetter) {
+	s.deadLetter = f
+}
+
+func (s *Server) drop(ci *CallInfo, err error) {
+	if s.metrics != nil {
+		s.metrics.onDrop(ci.id)
+	}
+	// 被丢弃的同步调用需要通知调用方
+	s.ret(ci, &Result{err: err})
+	if s.deadLetter != nil {
+		s.deadLetter(ci.id, ci.args, err)
+	}
+}
@@ -1,20 +1,27 @@
 package chanrpc
 
 import (
+	"context"
 	"fmt"
 	"runtime"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/pyihe/gogame/pkg"
 )
 
 // RPC调用信息
 type CallInfo struct {
+	id         interface{}
 	f          interface{}
 	args       []interface{}
 	resultChan chan *Result
 	cb         interface{}
+	ctx        context.Context // 调用方取消或者超时后不再执行
+	future     *Future         // 通过CallAsync发起的调用
+
+	enqueueTime time.Time // 投递时间，开启统计时有效
 }
 
 // RPC调用结果
@@ -39,18 +46,26 @@ type Server struct {
 	// func(args ...interface{})
 	// func(args ...interface{}) interface{}
 	// func(args ...interface{}) []interface{}
-	closed int32
+	// func(args ...interface{}) (interface{}, error)
+	closed  int32
+	closeMu sync.RWMutex  // 投递调用时持有读锁，Close关闭chanCall时持有写锁
+	done    chan struct{} // Close时关闭，通知阻塞中的投递
 
-	mu        sync.RWMutex
-	functions map[interface{}]interface{}
+	mu           sync.RWMutex
+	functions    map[interface{}]interface{}
+	interceptors []Interceptor
 
-	chanCall chan *CallInfo
+	chanCall   chan *CallInfo
+	metrics    *metrics
+	overflow   OverflowPolicy
+	deadLetter DeadLetter
 }
 
 func NewServer(maxCall int) *Server {
 	s := new(Server)
 	s.functions = make(map[interface{}]interface{})
 	s.chanCall = make(chan *CallInfo, maxCall)
+	s.done = make(chan struct{})
 	s.closed = pkg.StatusRunning
 	return s
 }
@@ -69,6 +84,10 @@ func (s *Server) getFunc(id interface{}) (fn interface{}) {
 }
 
 func (s *Server) ret(ci *CallInfo, ri *Result) {
+	if ci.future != nil {
+		ci.future.complete(ri.value, ri.err)
+		return
+	}
 	if ci.resultChan == nil {
 		return
 	}
@@ -77,14 +96,39 @@ func (s *Server) ret(ci *CallInfo, ri *Result) {
 	ci.resultChan <- ri
 }
 
+func (s *Server) beforeEnqueue(request *CallInfo) {
+	if s.metrics != nil {
+		request.enqueueTime = time.Now()
+	}
+}
+
+func (s *Server) afterEnqueue(request *CallInfo) {
+	if s.metrics != nil {
+		s.metrics.onEnqueue(request.id, len(s.chanCall))
+	}
+}
+
 func (s *Server) call(request *CallInfo, block bool) (err error) {
+	s.closeMu.RLock()
+	defer s.closeMu.RUnlock()
 	if atomic.LoadInt32(&s.closed) == pkg.StatusClosed {
 		return pkg.ErrServerClosed
 	}
 
+	s.beforeEnqueue(request)
+	defer func() {
+		if err == nil {
+			s.afterEnqueue(request)
+		}
+	}()
+
 	switch block {
 	case true:
-		s.chanCall <- request
+		select {
+		case s.chanCall <- request:
+		case <-s.done:
+			err = pkg.ErrServerClosed
+		}
 	default:
 		select {
 		case s.chanCall <- request:
@@ -95,11 +139,39 @@ func (s *Server) call(request *CallInfo, block bool) (err error) {
 	return
 }
 
+// callContext 阻塞投递调用请求，直到投递成功或者ctx结束
+func (s *Server) callContext(ctx context.Context, request *CallInfo) error {
+	s.closeMu.RLock()
+	defer s.closeMu.RUnlock()
+	if atomic.LoadInt32(&s.closed) == pkg.StatusClosed {
+		return pkg.ErrServerClosed
+	}
+
+	s.beforeEnqueue(request)
+	select {
+	case s.chanCall <- request:
+		s.afterEnqueue(request)
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-s.done:
+		return pkg.ErrServerClosed
+	}
+}
+
 func (s *Server) Close() {
 	if !atomic.CompareAndSwapInt32(&s.closed, pkg.StatusRunning, pkg.StatusClosed) {
 		return
 	}
+	// 先唤醒阻塞中的投递，再等待所有投递结束后关闭chanCall
+	close(s.done)
+	s.closeMu.Lock()
 	close(s.chanCall)
+	s.closeMu.Unlock()
+
+	servers.mu.Lock()
+	delete(servers.m, s)
+	servers.mu.Unlock()
 
 	for ci := range s.chanCall {
 		s.ret(ci, &Result{
@@ -117,11 +189,12 @@ func (s *Server) Register(id interface{}, f interface{}) error {
 	if atomic.LoadInt32(&s.closed) == pkg.StatusClosed {
 		return pkg.ErrServerClosed
 	}
-	// 只支持一下三种类型的Function
+	// 只支持以下四种类型的Function
 	switch f.(type) {
 	case func(...interface{}):
 	case func(...interface{}) interface{}:
 	case func(...interface{}) []interface{}:
+	case func(...interface{}) (interface{}, error):
 	default:
 		return pkg.ErrFunctionTypeNotSupported
 	}
@@ -135,56 +208,189 @@ func (s *Server) Register(id interface{}, f interface{}) error {
 	return nil
 }
 
+// Unregister 注销id对应的函数，之后可以重新注册，已经投递的调用仍然会执行
+func (s *Server) Unregister(id interface{}) {
+	s.mu.Lock()
+	delete(s.functions, id)
+	s.mu.Unlock()
+}
+
+// Use 添加拦截器，按添加顺序由外向内包裹每一次RPC执行
+// you must call the function before calling Open and Go
+func (s *Server) Use(interceptors ...Interceptor) {
+	s.mu.Lock()
+	for _, i := range interceptors {
+		if i != nil {
+			s.interceptors = append(s.interceptors, i)
+		}
+	}
+	s.mu.Unlock()
+}
+
+func (s *Server) getInterceptors() (interceptors []Interceptor) {
+	s.mu.RLock()
+	interceptors = s.interceptors
+	s.mu.RUnlock()
+	return
+}
+
+func invoke(f interface{}, args []interface{}) (interface{}, error) {
+	switch fn := f.(type) {
+	case func(...interface{}): // 没有返回值的函数
+		fn(args...)
+		return nil, nil
+
+	case func(...interface{}) interface{}:
+		return fn(args...), nil
+
+	case func(...interface{}) []interface{}:
+		return fn(args...), nil
+
+	case func(...interface{}) (interface{}, error): // 返回的error会传递给调用方
+		return fn(args...)
+
+	default:
+		panic(fmt.Sprintf("unsupported call function: %v", f))
+	}
+}
+
 func (s *Server) Exec(callInfo *CallInfo) {
+	var start = time.Now()
+	var result = &Result{}
+	var panicked bool
+
 	defer func() {
 		if r := recover(); r != nil {
 			buf := make([]byte, pkg.StackSize)
 			n := runtime.Stack(buf, false)
-			retInfo := &Result{err: fmt.Errorf("RPC: %v exec failed: %s", callInfo.f, buf[:n])}
-			s.ret(callInfo, retInfo)
+			panicked = true
+			result = &Result{err: fmt.Errorf("RPC: %v exec failed: %s", callInfo.f, buf[:n])}
+			s.ret(callInfo, result)
+		}
+		if s.metrics != nil {
+			s.metrics.onExec(callInfo, start, result.err, panicked)
 		}
 	}()
 
-	result := &Result{
-		cb: callInfo.cb, // 将请求中的回调赋值给返回结果
+	// 调用方已经放弃等待，不再执行
+	if callInfo.ctx != nil && callInfo.ctx.Err() != nil {
+		result.err = callInfo.ctx.Err()
+		s.ret(callInfo, result)
+		return
 	}
 
-	switch callInfo.f.(type) {
-	case func(...interface{}): // 没有返回值的函数
-		fn := callInfo.f.(func(...interface{}))
-		fn(callInfo.args...)
-		if callInfo.resultChan != nil {
-			callInfo.resultChan <- result
-		}
+	var handler Handler = func(_ interface{}, args []interface{}) (interface{}, error) {
+		return invoke(callInfo.f, args)
+	}
+	interceptors := s.getInterceptors()
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		handler = chain(interceptors[i], handler)
+	}
 
-	case func(...interface{}) interface{}:
-		fn := callInfo.f.(func(...interface{}) interface{})
-		result.value = fn(callInfo.args...)
-		if callInfo.resultChan != nil {
-			callInfo.resultChan <- result
-		}
+	result.value, result.err = handler(callInfo.id, callInfo.args)
+	s.ret(callInfo, result)
+}
 
-	case func(...interface{}) []interface{}:
-		fn := callInfo.f.(func(...interface{}) []interface{})
-		result.value = fn(callInfo.args...)
-		if callInfo.resultChan != nil {
-			callInfo.resultChan <- result
-		}
+// goroutine safe
+// 队列已满时按照SetOverflowPolicy设置的策略处理，不关心投递结果时使用，需要投递结果时使用Post
+func (s *Server) Go(id interface{}, args ...interface{}) {
+	s.Post(id, args...)
+}
 
-	default:
-		panic(fmt.Sprintf("unsupported call function: %v", callInfo))
+// Post 与Go相同，返回投递的结果
+// 调用ID未注册时返回pkg.ErrNotRegistered，OverflowError时队列已满返回pkg.ErrFullChannel，server已经关闭时返回pkg.ErrServerClosed
+// goroutine safe
+func (s *Server) Post(id interface{}, args ...interface{}) error {
+	request := &CallInfo{
+		id:   id,
+		f:    s.getFunc(id),
+		args: args,
 	}
+	if request.f == nil {
+		s.drop(request, pkg.ErrNotRegistered)
+		return pkg.ErrNotRegistered
+	}
+
+	return s.post(request, s.overflow)
 }
 
+// TryPost 与Post相同，但是不会阻塞，溢出策略为OverflowBlock时按照OverflowError处理
 // goroutine safe
-func (s *Server) Go(id interface{}, args ...interface{}) {
-	f := s.getFunc(id)
-	if f != nil {
-		s.chanCall <- &CallInfo{
-			f:    f,
-			args: args,
+func (s *Server) TryPost(id interface{}, args ...interface{}) error {
+	policy := s.overflow
+	if policy == OverflowBlock {
+		policy = OverflowError
+	}
+	request := &CallInfo{
+		id:   id,
+		f:    s.getFunc(id),
+		args: args,
+	}
+	if request.f == nil {
+		s.drop(request, pkg.ErrNotRegistered)
+		return pkg.ErrNotRegistered
+	}
+	return s.post(request, policy)
+}
+
+func (s *Server) post(request *CallInfo, policy OverflowPolicy) error {
+	// 死信回调可能再次投递，在锁外执行
+	dropped, err := s.enqueue(request, policy)
+	for _, ci := range dropped {
+		s.drop(ci, pkg.ErrFullChannel)
+	}
+	return err
+}
+
+// enqueue 按照溢出策略投递request，返回被丢弃的调用
+func (s *Server) enqueue(request *CallInfo, policy OverflowPolicy) (dropped []*CallInfo, err error) {
+	s.closeMu.RLock()
+	defer s.closeMu.RUnlock()
+	if atomic.LoadInt32(&s.closed) == pkg.StatusClosed {
+		return nil, pkg.ErrServerClosed
+	}
+
+	s.beforeEnqueue(request)
+	switch policy {
+	case OverflowDropNewest:
+		select {
+		case s.chanCall <- request:
+		default:
+			return []*CallInfo{request}, nil
+		}
+
+	case OverflowDropOldest:
+		for sent := false; !sent; {
+			select {
+			case s.chanCall <- request:
+				sent = true
+			default:
+				select {
+				case oldest, ok := <-s.chanCall:
+					if ok {
+						dropped = append(dropped, oldest)
+					}
+				default:
+				}
+			}
+		}
+
+	case OverflowError:
+		select {
+		case s.chanCall <- request:
+		default:
+			return []*CallInfo{request}, pkg.ErrFullChannel
+		}
+
+	default:
+		select {
+		case s.chanCall <- request:
+		case <-s.done:
+			return nil, pkg.ErrServerClosed
 		}
 	}
+	s.afterEnqueue(request)
+	return
 }
 
 // goroutine safe
@@ -211,6 +417,30 @@ func (s *Server) CallN(id interface{}, args ...interface{}) (result []interface{
 	return
 }
 
+// goroutine safe
+func (s *Server) Call0Context(ctx context.Context, id interface{}, args ...interface{}) (err error) {
+	client := s.Open(0)
+	err = client.Call0Context(ctx, id, args...)
+	client.Close()
+	return
+}
+
+// goroutine safe
+func (s *Server) Call1Context(ctx context.Context, id interface{}, args ...interface{}) (result interface{}, err error) {
+	client := s.Open(0)
+	result, err = client.Call1Context(ctx, id, args...)
+	client.Close()
+	return
+}
+
+// goroutine safe
+func (s *Server) CallNContext(ctx context.Context, id interface{}, args ...interface{}) (result []interface{}, err error) {
+	client := s.Open(0)
+	result, err = client.CallNContext(ctx, id, args...)
+	client.Close()
+	return
+}
+
 // goroutine safe
 func (s *Server) Open(size int) *Client {
 	c := NewClient(size)
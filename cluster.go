@@ -1,21 +1,603 @@
 package gogame
 
 import (
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pyihe/gogame/chanrpc"
+	"github.com/pyihe/gogame/internal/gopool"
 	"github.com/pyihe/gogame/network"
+	"github.com/pyihe/gogame/pkg"
+	"github.com/pyihe/gogame/pkg/log"
 )
 
+var cluster struct {
+	mu           sync.RWMutex
+	servers      map[string]*chanrpc.Server // 本节点导出的chanrpc server
+	nodes        map[uint16]*clusterAgent   // 已完成握手的节点，为links中优先使用的连接
+	links        map[uint16][]*clusterAgent // 节点的全部连接，双方互相配置了连接地址时会有两条
+	localPending int32                      // 本节点正在执行的同步调用数量
+	upHandlers   []func(nodeID uint16)      // 节点上线回调
+	downHandlers []func(nodeID uint16)      // 节点下线回调
+}
+
+const (
+	defaultClusterPingInterval = 5 * time.Second
+	defaultClusterCallTimeout  = 10 * time.Second
+	deadTimeoutFactor          = 3
+)
+
+func clusterPingInterval() time.Duration {
+	if server.opts == nil || server.opts.ClusterPingInterval <= 0 {
+		return defaultClusterPingInterval
+	}
+	return server.opts.ClusterPingInterval
+}
+
+func clusterCallTimeout() time.Duration {
+	if server.opts == nil || server.opts.ClusterCallTimeout <= 0 {
+		return defaultClusterCallTimeout
+	}
+	return server.opts.ClusterCallTimeout
+}
+
+func clusterDeadTimeout() time.Duration {
+	if server.opts == nil || server.opts.ClusterDeadTimeout <= 0 {
+		return deadTimeoutFactor * clusterPingInterval()
+	}
+	return server.opts.ClusterDeadTimeout
+}
+
+// OnNodeUp 订阅节点上线事件：与nodeID节点完成握手后执行f
+// f在集群连接的goroutine中执行，不能阻塞，模块中请使用Skeleton.OnNodeUp
+func OnNodeUp(f func(nodeID uint16)) {
+	if f == nil {
+		return
+	}
+	cluster.mu.Lock()
+	cluster.upHandlers = append(cluster.upHandlers, f)
+	cluster.mu.Unlock()
+}
+
+// OnNodeDown 订阅节点下线事件：与nodeID节点的连接断开(包括心跳超时)后执行f
+// f在集群连接的goroutine中执行，不能阻塞，模块中请使用Skeleton.OnNodeDown
+func OnNodeDown(f func(nodeID uint16)) {
+	if f == nil {
+		return
+	}
+	cluster.mu.Lock()
+	cluster.downHandlers = append(cluster.downHandlers, f)
+	cluster.mu.Unlock()
+}
+
+func notifyNode(nodeID uint16, up bool) {
+	cluster.mu.RLock()
+	handlers := cluster.downHandlers
+	if up {
+		handlers = cluster.upHandlers
+	}
+	cluster.mu.RUnlock()
+
+	for _, f := range handlers {
+		f(nodeID)
+	}
+}
+
+// RegisterClusterServer 将本节点的chanrpc server以name导出，供集群中的其他节点调用
+// 需要在模块Init中调用
+func RegisterClusterServer(name string, s *chanrpc.Server) {
+	if s == nil {
+		return
+	}
+	cluster.mu.Lock()
+	if cluster.servers == nil {
+		cluster.servers = make(map[string]*chanrpc.Server)
+	}
+	cluster.servers[name] = s
+	cluster.mu.Unlock()
+}
+
+func getClusterServer(name string) *chanrpc.Server {
+	cluster.mu.RLock()
+	s := cluster.servers[name]
+	cluster.mu.RUnlock()
+	return s
+}
+
+func clusterServerNames() []string {
+	cluster.mu.RLock()
+	names := make([]string, 0, len(cluster.servers))
+	for name := range cluster.servers {
+		names = append(names, name)
+	}
+	cluster.mu.RUnlock()
+	return names
+}
+
+func getClusterNode(nodeID uint16) *clusterAgent {
+	cluster.mu.RLock()
+	a := cluster.nodes[nodeID]
+	cluster.mu.RUnlock()
+	return a
+}
+
+// addClusterNode 返回是否为新上线的节点
+// 同一个节点有多条连接时，优先使用由节点ID较小的一方发起的连接，两端选择的是同一条连接
+func addClusterNode(a *clusterAgent) bool {
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+
+	if cluster.nodes == nil {
+		cluster.nodes = make(map[uint16]*clusterAgent)
+		cluster.links = make(map[uint16][]*clusterAgent)
+	}
+	links := cluster.links[a.nodeID]
+	for _, link := range links {
+		if link == a {
+			return false
+		}
+	}
+	cluster.links[a.nodeID] = append(links, a)
+	if cur := cluster.nodes[a.nodeID]; cur == nil || (!cur.preferred() && a.preferred()) {
+		cluster.nodes[a.nodeID] = a
+	}
+	return len(links) == 0
+}
+
+// delClusterNode 返回节点是否因此下线，节点还有其他连接时改用其他连接
+func delClusterNode(a *clusterAgent) bool {
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+
+	links := cluster.links[a.nodeID]
+	rest := make([]*clusterAgent, 0, len(links))
+	for _, link := range links {
+		if link != a {
+			rest = append(rest, link)
+		}
+	}
+	if len(rest) == len(links) {
+		return false
+	}
+	if len(rest) == 0 {
+		delete(cluster.links, a.nodeID)
+		delete(cluster.nodes, a.nodeID)
+		return true
+	}
+	cluster.links[a.nodeID] = rest
+	if cluster.nodes[a.nodeID] == a {
+		cluster.nodes[a.nodeID] = rest[0]
+		for _, link := range rest {
+			if link.preferred() {
+				cluster.nodes[a.nodeID] = link
+				break
+			}
+		}
+	}
+	return false
+}
+
 type clusterAgent struct {
-	conn *network.TCPConn
+	conn     *network.TCPConn
+	nodeID   uint16   // 对端节点ID，握手完成后有效
+	modules  []string // 对端导出的chanrpc server名，握手完成后有效
+	outbound bool     // 是否由本节点主动发起连接
+
+	done      chan struct{} // 连接断开时关闭，用于停止心跳
+	handshake bool          // 是否已完成握手
+
+	mu      sync.Mutex
+	seq     uint64
+	pending map[uint64]chan *clusterMsg // 等待响应的请求
+	closed  bool
+	tasks   []func()      // 等待按顺序投递的Go调用和事件
+	posted  chan struct{} // 有新的task时通知dispatch
+}
+
+// newOutboundClusterAgent 本节点主动发起的连接
+func newOutboundClusterAgent(conn *network.TCPConn) network.Agent {
+	a := newClusterAgent(conn).(*clusterAgent)
+	a.outbound = true
+	return a
 }
 
 func newClusterAgent(conn *network.TCPConn) network.Agent {
 	a := new(clusterAgent)
 	a.conn = conn
+	a.pending = make(map[uint64]chan *clusterMsg)
+	a.done = make(chan struct{})
+	a.posted = make(chan struct{}, 1)
 	return a
 }
 
-func (a *clusterAgent) Run() {}
+func (a *clusterAgent) Run() {
+	for {
+		// 对端需要在超时时间内发送任意消息(至少是心跳)，否则视为已失效
+		a.conn.SetReadDeadline(time.Now().Add(clusterDeadTimeout()))
+		data, err := a.conn.ReadMsg()
+		if err != nil {
+			if err != io.EOF && !strings.Contains(err.Error(), "use of closed network connection") {
+				log.Printf("read cluster message: %v", err)
+			}
+			break
+		}
+		m, err := decodeClusterMsg(data)
+		if err != nil {
+			log.Printf("decode cluster message error: %v", err)
+			break
+		}
+		switch m.Type {
+		case clusterMsgHandshake:
+			a.nodeID = m.NodeID
+			a.modules = m.Modules
+			a.handshake = true
+			if addClusterNode(a) {
+				notifyNode(a.nodeID, true)
+			}
+		case clusterMsgRequest:
+			a.handleRequest(m)
+		case clusterMsgResponse:
+			a.handleResponse(m)
+		case clusterMsgEvent:
+			a.post(func() {
+				publishLocal(m.Topic, m.Args)
+			})
+		case clusterMsgPing:
+			a.write(&clusterMsg{Type: clusterMsgPong})
+		case clusterMsgPong:
+		default:
+			log.Printf("unknown cluster message type: %d", m.Type)
+		}
+	}
+}
+
+func (a *clusterAgent) OnConnect() {
+	err := a.write(&clusterMsg{
+		Type:    clusterMsgHandshake,
+		NodeID:  server.opts.ServeId,
+		Modules: clusterServerNames(),
+	})
+	if err != nil {
+		log.Printf("cluster handshake error: %v", err)
+	}
+
+	gopool.AddTask(a.heartbeat)
+	gopool.AddTask(a.dispatch)
+}
+
+// post 将task放入队列，由dispatch按接收顺序执行
+// chanrpc server队列已满时Go可能阻塞，不能在读循环中执行，否则会连同心跳一起阻塞整个连接
+func (a *clusterAgent) post(task func()) {
+	a.mu.Lock()
+	a.tasks = append(a.tasks, task)
+	a.mu.Unlock()
+
+	select {
+	case a.posted <- struct{}{}:
+	default:
+	}
+}
+
+// dispatch 依次执行post的task，连接断开后执行完已经收到的task再退出
+func (a *clusterAgent) dispatch() {
+	for {
+		var done bool
+		select {
+		case <-a.posted:
+		case <-a.done:
+			done = true
+		}
+
+		a.mu.Lock()
+		tasks := a.tasks
+		a.tasks = nil
+		a.mu.Unlock()
+		for _, task := range tasks {
+			task()
+		}
+		if done {
+			return
+		}
+	}
+}
+
+func (a *clusterAgent) heartbeat() {
+	ticker := time.NewTicker(clusterPingInterval())
+	defer ticker.Stop()
 
-func (a *clusterAgent) OnConnect() {}
+	for {
+		select {
+		case <-a.done:
+			return
+		case <-ticker.C:
+			if err := a.write(&clusterMsg{Type: clusterMsgPing}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (a *clusterAgent) OnClose() {
+	close(a.done)
+	if a.handshake && delClusterNode(a) {
+		notifyNode(a.nodeID, false)
+	}
+
+	a.mu.Lock()
+	a.closed = true
+	pending := a.pending
+	a.pending = make(map[uint64]chan *clusterMsg)
+	a.mu.Unlock()
+
+	// 连接断开后，未返回的请求全部失败
+	for seq, ch := range pending {
+		ch <- &clusterMsg{
+			Type: clusterMsgResponse,
+			Seq:  seq,
+			Err:  pkg.ErrNodeDown.Error(),
+		}
+	}
+}
+
+// preferred 是否为优先使用的连接，即由节点ID较小的一方发起的连接
+func (a *clusterAgent) preferred() bool {
+	var local uint16
+	if server.opts != nil {
+		local = server.opts.ServeId
+	}
+	return a.outbound == (local < a.nodeID)
+}
+
+func (a *clusterAgent) hasModule(name string) bool {
+	for _, m := range a.modules {
+		if m == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *clusterAgent) pendingCount() int {
+	a.mu.Lock()
+	n := len(a.pending)
+	a.mu.Unlock()
+	return n
+}
+
+func (a *clusterAgent) write(m *clusterMsg) error {
+	data, err := encodeClusterMsg(m)
+	if err != nil {
+		return err
+	}
+	return a.conn.WriteMsg(data)
+}
+
+func (a *clusterAgent) handleRequest(m *clusterMsg) {
+	s := getClusterServer(m.Server)
+
+	// Go调用不需要返回结果，按顺序投递以保证调用顺序
+	if m.CallType == clusterCallGo {
+		if s != nil {
+			a.post(func() {
+				s.Go(m.ID, m.Args...)
+			})
+		}
+		return
+	}
+
+	gopool.AddTask(func() {
+		var err error
+		var resp = &clusterMsg{
+			Type: clusterMsgResponse,
+			Seq:  m.Seq,
+		}
+
+		switch {
+		case s == nil:
+			err = pkg.ErrNotRegistered
+		case m.CallType == clusterCall0:
+			err = s.Call0(m.ID, m.Args...)
+		case m.CallType == clusterCall1:
+			resp.Value, err = s.Call1(m.ID, m.Args...)
+		case m.CallType == clusterCallN:
+			resp.Values, err = s.CallN(m.ID, m.Args...)
+		default:
+			err = pkg.ErrFunctionTypeNotSupported
+		}
+		resp.Err = errorString(err)
+
+		// 返回值无法编码时，仍然需要让调用方得到响应
+		if err = a.write(resp); err != nil {
+			err = a.write(&clusterMsg{
+				Type: clusterMsgResponse,
+				Seq:  m.Seq,
+				Err:  err.Error(),
+			})
+		}
+		if err != nil {
+			log.Printf("write cluster response error: %v", err)
+		}
+	})
+}
+
+func (a *clusterAgent) handleResponse(m *clusterMsg) {
+	a.mu.Lock()
+	ch, ok := a.pending[m.Seq]
+	delete(a.pending, m.Seq)
+	a.mu.Unlock()
+
+	if ok {
+		ch <- m
+	}
+}
+
+func (a *clusterAgent) call(name string, callType uint8, id interface{}, args []interface{}) (*clusterMsg, error) {
+	var ch chan *clusterMsg
+	var req = &clusterMsg{
+		Type:     clusterMsgRequest,
+		Server:   name,
+		CallType: callType,
+		ID:       id,
+		Args:     args,
+	}
+
+	if callType != clusterCallGo {
+		ch = make(chan *clusterMsg, 1)
+		a.mu.Lock()
+		if a.closed {
+			a.mu.Unlock()
+			return nil, pkg.ErrNodeDown
+		}
+		a.seq++
+		req.Seq = a.seq
+		a.pending[req.Seq] = ch
+		a.mu.Unlock()
+	}
+
+	if err := a.write(req); err != nil {
+		a.mu.Lock()
+		delete(a.pending, req.Seq)
+		a.mu.Unlock()
+		return nil, err
+	}
+	if ch == nil {
+		return nil, nil
+	}
 
-func (a *clusterAgent) OnClose() {}
+	// 对端连接正常但是一直没有响应时，不能无限等待
+	t := time.NewTimer(clusterCallTimeout())
+	defer t.Stop()
+	select {
+	case resp := <-ch:
+		return resp, stringError(resp.Err)
+	case <-t.C:
+		a.mu.Lock()
+		delete(a.pending, req.Seq)
+		a.mu.Unlock()
+		return nil, pkg.ErrCallTimeout
+	}
+}
+
+// ClusterNodes 返回当前已连接的节点ID
+func ClusterNodes() []uint16 {
+	cluster.mu.RLock()
+	nodes := make([]uint16, 0, len(cluster.nodes))
+	for nodeID := range cluster.nodes {
+		nodes = append(nodes, nodeID)
+	}
+	cluster.mu.RUnlock()
+	return nodes
+}
+
+// ClusterNodesWith 返回导出了名为name的chanrpc server的节点ID，包括本节点，按节点ID升序排列
+// 顺序固定才能让依赖节点顺序的Balancer(例如RoundRobin)按预期轮转
+func ClusterNodesWith(name string) []uint16 {
+	var nodes []uint16
+	if server.opts != nil && getClusterServer(name) != nil {
+		nodes = append(nodes, server.opts.ServeId)
+	}
+	cluster.mu.RLock()
+	for nodeID, a := range cluster.nodes {
+		if a.hasModule(name) {
+			nodes = append(nodes, nodeID)
+		}
+	}
+	cluster.mu.RUnlock()
+
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i] < nodes[j]
+	})
+	return nodes
+}
+
+// ClusterPending 返回发往nodeID节点且尚未返回的同步调用数量
+func ClusterPending(nodeID uint16) int {
+	if isLocalNode(nodeID) {
+		return int(atomic.LoadInt32(&cluster.localPending))
+	}
+	a := getClusterNode(nodeID)
+	if a == nil {
+		return 0
+	}
+	return a.pendingCount()
+}
+
+func isLocalNode(nodeID uint16) bool {
+	return server.opts != nil && server.opts.ServeId == nodeID
+}
+
+// 目标为本节点时直接调用本地的chanrpc server，不经过网络
+func localCall(name string, callType uint8, id interface{}, args []interface{}) (resp *clusterMsg, err error) {
+	s := getClusterServer(name)
+	if s == nil {
+		return nil, pkg.ErrNotRegistered
+	}
+
+	if callType != clusterCallGo {
+		atomic.AddInt32(&cluster.localPending, 1)
+		defer atomic.AddInt32(&cluster.localPending, -1)
+	}
+
+	resp = &clusterMsg{}
+	switch callType {
+	case clusterCallGo:
+		err = s.Post(id, args...)
+	case clusterCall0:
+		err = s.Call0(id, args...)
+	case clusterCall1:
+		resp.Value, err = s.Call1(id, args...)
+	case clusterCallN:
+		resp.Values, err = s.CallN(id, args...)
+	default:
+		err = pkg.ErrFunctionTypeNotSupported
+	}
+	return
+}
+
+func clusterCall(nodeID uint16, name string, callType uint8, id interface{}, args []interface{}) (*clusterMsg, error) {
+	if isLocalNode(nodeID) {
+		return localCall(name, callType, id, args)
+	}
+	a := getClusterNode(nodeID)
+	if a == nil {
+		return nil, pkg.ErrNodeNotConnected
+	}
+	return a.call(name, callType, id, args)
+}
+
+// ClusterGo 调用nodeID节点上名为name的chanrpc server，不等待执行结果
+func ClusterGo(nodeID uint16, name string, id interface{}, args ...interface{}) error {
+	_, err := clusterCall(nodeID, name, clusterCallGo, id, args)
+	return err
+}
+
+// ClusterCall0 同步调用nodeID节点上名为name的chanrpc server，对应chanrpc.Server.Call0
+// 远程调用超过Options.ClusterCallTimeout没有响应时返回pkg.ErrCallTimeout
+func ClusterCall0(nodeID uint16, name string, id interface{}, args ...interface{}) error {
+	_, err := clusterCall(nodeID, name, clusterCall0, id, args)
+	return err
+}
+
+// ClusterCall1 同步调用nodeID节点上名为name的chanrpc server，对应chanrpc.Server.Call1
+// 远程调用超过Options.ClusterCallTimeout没有响应时返回pkg.ErrCallTimeout
+func ClusterCall1(nodeID uint16, name string, id interface{}, args ...interface{}) (interface{}, error) {
+	resp, err := clusterCall(nodeID, name, clusterCall1, id, args)
+	if resp == nil {
+		return nil, err
+	}
+	return resp.Value, err
+}
+
+// ClusterCallN 同步调用nodeID节点上名为name的chanrpc server，对应chanrpc.Server.CallN
+// 远程调用超过Options.ClusterCallTimeout没有响应时返回pkg.ErrCallTimeout
+func ClusterCallN(nodeID uint16, name string, id interface{}, args ...interface{}) ([]interface{}, error) {
+	resp, err := clusterCall(nodeID, name, clusterCallN, id, args)
+	if resp == nil {
+		return nil, err
+	}
+	return resp.Values, err
+}
@@ -0,0 +1,90 @@
+package gogame
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+
+	"github.com/pyihe/gogame/pkg"
+)
+
+// 集群节点间传输的消息类型
+const (
+	clusterMsgHandshake uint8 = iota + 1 // 握手：交换节点ID
+	clusterMsgRequest                    // 请求：调用对端的chanrpc server
+	clusterMsgResponse                   // 响应：返回调用结果
+	clusterMsgPing                       // 心跳
+	clusterMsgPong                       // 心跳回复
+	clusterMsgEvent                      // 事件：发布给对端订阅了Topic的模块
+)
+
+// 集群请求的调用方式，与chanrpc.Server的调用方式一一对应
+const (
+	clusterCallGo uint8 = iota + 1 // Go
+	clusterCall0                   // Call0
+	clusterCall1                   // Call1
+	clusterCallN                   // CallN
+)
+
+// clusterMsg 集群节点间通信的消息封装，使用gob编码
+// Args/Value/Values中的自定义类型需要调用方通过gob.Register注册
+type clusterMsg struct {
+	Type     uint8         // 消息类型
+	Seq      uint64        // 请求序列号，响应中原样返回，Go调用时为0
+	NodeID   uint16        // 握手时携带的节点ID
+	Modules  []string      // 握手时携带的节点导出的chanrpc server名
+	Server   string        // 目标chanrpc server名
+	Topic    string        // 事件主题
+	CallType uint8         // 调用方式
+	ID       interface{}   // chanrpc函数ID
+	Args     []interface{} // 调用参数
+	Value    interface{}   // Call1的返回值
+	Values   []interface{} // CallN的返回值
+	Err      string        // 调用错误
+}
+
+func encodeClusterMsg(m *clusterMsg) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(m); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeClusterMsg(data []byte) (*clusterMsg, error) {
+	m := &clusterMsg{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// 能够跨节点还原的错误，便于调用方通过 == 判断
+var clusterErrors = []error{
+	pkg.ErrNotRegistered,
+	pkg.ErrFunctionTypeNotSupported,
+	pkg.ErrTooManyCalls,
+	pkg.ErrFullChannel,
+	pkg.ErrServerClosed,
+	pkg.ErrConnClosed,
+	pkg.ErrNodeDown,
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func stringError(s string) error {
+	if s == "" {
+		return nil
+	}
+	for _, err := range clusterErrors {
+		if err.Error() == s {
+			return err
+		}
+	}
+	return errors.New(s)
+}
@@ -0,0 +1,210 @@
+package gogame
+
+import (
+	"math"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pyihe/gogame/chanrpc"
+	"github.com/pyihe/gogame/network/packet"
+	"github.com/pyihe/gogame/pkg"
+)
+
+// clusterPeer 通过TCP连接与本节点通信的对端节点，直接收发集群消息
+type clusterPeer struct {
+	t      *testing.T
+	conn   net.Conn
+	parser packet.Parser
+}
+
+func (p *clusterPeer) write(m *clusterMsg) {
+	data, err := encodeClusterMsg(m)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	if data, err = p.parser.Packet(data); err != nil {
+		p.t.Fatal(err)
+	}
+	if _, err = p.conn.Write(data); err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+// read 读取下一个类型为typ的消息，跳过心跳
+func (p *clusterPeer) read(typ uint8) *clusterMsg {
+	p.conn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		data, err := p.parser.UnPacket(p.conn)
+		if err != nil {
+			p.t.Fatal(err)
+		}
+		m, err := decodeClusterMsg(data)
+		if err != nil {
+			p.t.Fatal(err)
+		}
+		if m.Type == typ {
+			return m
+		}
+	}
+}
+
+var clusterTestOnce sync.Once
+
+// setClusterTestOptions 集群连接的goroutine在连接关闭后才退出，server.opts只设置一次
+func setClusterTestOptions() {
+	clusterTestOnce.Do(func() {
+		server.opts = &Options{ServeId: 1, ClusterCallTimeout: 200 * time.Millisecond}
+	})
+}
+
+func TestClusterCall(t *testing.T) {
+	setClusterTestOptions()
+
+	// 处理Call的server
+	echo := chanrpc.NewServer(10)
+	echo.Register("echo", func(args ...interface{}) interface{} {
+		return args[0]
+	})
+	go func() {
+		for ci := range echo.Chan() {
+			echo.Exec(ci)
+		}
+	}()
+	defer echo.Close()
+	RegisterClusterServer("cluster.echo", echo)
+
+	// 队列已满且没有执行的server，Go调用会一直阻塞
+	executed := make(chan struct{}, 4)
+	blocked := chanrpc.NewServer(1)
+	blocked.Register("block", func(args ...interface{}) {
+		executed <- struct{}{}
+	})
+	blocked.Go("block")
+	RegisterClusterServer("cluster.blocked", blocked)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := newClusterClient(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Start()
+	defer client.Close()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	peer := &clusterPeer{
+		t:    t,
+		conn: conn,
+		parser: packet.NewParser(
+			packet.WithHeader(4),
+			packet.WithMinLen(1),
+			packet.WithMaxLen(math.MaxUint32),
+			packet.WithLittleEndian(false),
+		),
+	}
+	peer.read(clusterMsgHandshake)
+	peer.write(&clusterMsg{Type: clusterMsgHandshake, NodeID: 2, Modules: []string{"peer"}})
+
+	// 本节点调用对端节点
+	done := make(chan interface{}, 1)
+	go func() {
+		for getClusterNode(2) == nil {
+			time.Sleep(time.Millisecond)
+		}
+		v, err := ClusterCall1(2, "peer", "echo", "ping")
+		if err != nil {
+			v = err
+		}
+		done <- v
+	}()
+	req := peer.read(clusterMsgRequest)
+	if req.Server != "peer" || req.CallType != clusterCall1 {
+		t.Fatalf("unexpected request %+v", req)
+	}
+	peer.write(&clusterMsg{Type: clusterMsgResponse, Seq: req.Seq, Value: req.Args[0]})
+	if v := <-done; v != "ping" {
+		t.Fatalf("got %v, want ping", v)
+	}
+
+	// 对端一直没有响应时调用超时
+	go func() {
+		_, err := ClusterCall1(2, "peer", "echo", "lost")
+		done <- err
+	}()
+	peer.read(clusterMsgRequest)
+	select {
+	case err := <-done:
+		if err != pkg.ErrCallTimeout {
+			t.Fatalf("got %v, want %v", err, pkg.ErrCallTimeout)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("call not timed out")
+	}
+	if n := ClusterPending(2); n != 0 {
+		t.Fatalf("%d pending calls after timeout", n)
+	}
+
+	// 本节点的server阻塞时，连接上的心跳和其他调用不受影响
+	for i := 0; i < 3; i++ {
+		peer.write(&clusterMsg{Type: clusterMsgRequest, Server: "cluster.blocked", CallType: clusterCallGo, ID: "block"})
+	}
+	peer.write(&clusterMsg{Type: clusterMsgPing})
+	peer.read(clusterMsgPong)
+	peer.write(&clusterMsg{Type: clusterMsgRequest, Seq: 1, Server: "cluster.echo", CallType: clusterCall1, ID: "echo", Args: []interface{}{"pong"}})
+	if resp := peer.read(clusterMsgResponse); resp.Seq != 1 || resp.Value != "pong" || resp.Err != "" {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+
+	// 释放阻塞的Go调用后，已经收到的调用全部执行
+	go func() {
+		for ci := range blocked.Chan() {
+			blocked.Exec(ci)
+		}
+	}()
+	defer blocked.Close()
+	for i := 0; i < cap(executed); i++ {
+		select {
+		case <-executed:
+		case <-time.After(time.Second):
+			t.Fatal("blocked call not executed")
+		}
+	}
+}
+
+func TestClusterDuplicateLink(t *testing.T) {
+	setClusterTestOptions()
+
+	// 本节点ID较小，优先使用本节点发起的连接，与先后顺序无关
+	inbound := &clusterAgent{nodeID: 7}
+	outbound := &clusterAgent{nodeID: 7, outbound: true}
+	if !addClusterNode(inbound) {
+		t.Fatal("node 7 not up")
+	}
+	if addClusterNode(outbound) || getClusterNode(7) != outbound {
+		t.Fatal("outbound link not preferred")
+	}
+	third := &clusterAgent{nodeID: 7}
+	if addClusterNode(third); getClusterNode(7) != outbound {
+		t.Fatal("preferred link replaced")
+	}
+
+	// 优先的连接断开后改用其他连接，全部断开后节点才下线
+	if delClusterNode(outbound) || getClusterNode(7) != inbound {
+		t.Fatal("inbound link not used after outbound closed")
+	}
+	if delClusterNode(third) || getClusterNode(7) != inbound {
+		t.Fatal("inbound link not kept")
+	}
+	if !delClusterNode(inbound) || getClusterNode(7) != nil {
+		t.Fatal("node 7 not down")
+	}
+}
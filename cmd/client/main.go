@@ -20,7 +20,8 @@ var (
 )
 
 func init() {
-	processor.Register(route.NewMessage(1, &protocol.Hello{}).SetHandler(handler))
+	protocol.Register(processor)
+	processor.SetHandler(protocol.IDHello, handler)
 }
 
 func handler(args ...interface{}) {
@@ -11,6 +11,9 @@ import (
 	"github.com/pyihe/gogame/pkg"
 )
 
+// Name 模块在集群中导出的名称
+const Name = "game"
+
 var (
 	module *Server
 )
@@ -49,6 +52,8 @@ func (m *Server) Init() {
 	// 注册需要本模块处理的消息
 	m.skeleton.RegisterChanRPC(reflect.TypeOf(&protocol.Hello{}), handleHello)
 
+	// 导出本模块的chanrpc server，供集群中的其他节点通过gogame.NewRemoteServer调用
+	gogame.RegisterClusterServer(Name, m.chanRPC)
 }
 
 func (m *Server) Run() {
@@ -30,6 +30,7 @@ func NewModule() gogame.Module {
 			AgentHandler: module,
 			WSAddr:       "192.168.1.192:6666",
 			HTTPTimeout:  3 * time.Second,
+			DrainTimeout: 3 * time.Second,
 		},
 		status: pkg.StatusInitial,
 	}
@@ -44,7 +45,8 @@ type Server struct {
 
 func (m *Server) Init() {
 	// 注册消息的router
-	m.Processor.Register(route.NewMessage(1, &protocol.Hello{}).SetRouter(game.ChanRPC()))
+	protocol.Register(m.Processor)
+	m.Processor.SetRouter(protocol.IDHello, game.ChanRPC())
 }
 
 func (m *Server) Run() {
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/format"
+	"path/filepath"
+	"strings"
+)
+
+const header = "Code generated by msggen. DO NOT EDIT."
+
+// genGo 生成消息ID常量与向route.Processor注册所有消息的函数
+func genGo(pkgName string, lock *Lock) ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// %s\n\npackage %s\n\n", header, pkgName)
+	buf.WriteString("import \"github.com/pyihe/gogame/route\"\n\n")
+
+	buf.WriteString("// 消息ID\nconst (\n")
+	for _, e := range lock.Messages {
+		fmt.Fprintf(&buf, "\tID%s uint16 = %d\n", e.Name, e.ID)
+	}
+	buf.WriteString(")\n\n")
+
+	buf.WriteString("// Register 向p注册所有消息，之后通过消息ID常量设置router或handler\n")
+	buf.WriteString("func Register(p route.Processor) {\n")
+	for _, e := range lock.Messages {
+		fmt.Fprintf(&buf, "\tp.Register(route.NewMessage(ID%s, &%s{}))\n", e.Name, e.Name)
+	}
+	buf.WriteString("}\n")
+
+	return format.Source(buf.Bytes())
+}
+
+// genClient 根据文件后缀生成客户端使用的消息ID常量
+// .ts: TypeScript enum，.cs: C# enum，.json: 消息名到ID的映射
+func genClient(path string, lock *Lock) ([]byte, error) {
+	var buf bytes.Buffer
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".ts":
+		fmt.Fprintf(&buf, "// %s\n\nexport enum MsgID {\n", header)
+		for _, e := range lock.Messages {
+			fmt.Fprintf(&buf, "    %s = %d,\n", e.Name, e.ID)
+		}
+		buf.WriteString("}\n")
+	case ".cs":
+		fmt.Fprintf(&buf, "// %s\n\npublic enum MsgID : ushort\n{\n", header)
+		for _, e := range lock.Messages {
+			fmt.Fprintf(&buf, "    %s = %d,\n", e.Name, e.ID)
+		}
+		buf.WriteString("}\n")
+	case ".json":
+		ids := make(map[string]uint16, len(lock.Messages))
+		for _, e := range lock.Messages {
+			ids[e.Name] = e.ID
+		}
+		data, err := json.MarshalIndent(ids, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	default:
+		return nil, fmt.Errorf("%s: unsupported client file type", path)
+	}
+	return buf.Bytes(), nil
+}
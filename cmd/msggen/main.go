@@ -0,0 +1,103 @@
+// msggen 根据消息清单为route.Processor分配稳定的消息ID并生成注册代码
+//
+// 清单为JSON文件，与协议结构体放在同一个目录下:
+//
+//	{"messages": [{"name": "Hello", "id": 1}, {"name": "Bye"}]}
+//
+// 未指定ID的消息自动分配，分配结果记录在ID表(lock文件)中，需要与清单一起提交
+// 已分配的ID不会改变，删除的消息的ID也不会被再次分配
+// 修改ID、ID冲突、删除字段或者修改字段类型时报错，-check用于在构建时检查生成的文件是否最新
+//
+// 用法:
+//
+//	//go:generate go run github.com/pyihe/gogame/cmd/msggen -client ../client/msg_id.ts
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+var (
+	manifestPath  = flag.String("manifest", "messages.json", "message manifest")
+	lockPath      = flag.String("lock", "", "message id table, default messages.lock.json beside the manifest")
+	outPath       = flag.String("out", "", "generated go file, default msg_id.gen.go beside the manifest")
+	clientPath    = flag.String("client", "", "generated client constants (.ts, .cs or .json)")
+	maxID         = flag.Uint("maxid", math.MaxUint16, "max message id, use 32767 when compression is enabled")
+	check         = flag.Bool("check", false, "only check that generated files are up to date")
+	allowBreaking = flag.Bool("allow-breaking", false, "accept removed or retyped fields")
+)
+
+func main() {
+	flag.Parse()
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	dir := filepath.Dir(*manifestPath)
+	if *lockPath == "" {
+		*lockPath = filepath.Join(dir, "messages.lock.json")
+	}
+	if *outPath == "" {
+		*outPath = filepath.Join(dir, "msg_id.gen.go")
+	}
+	if *maxID == 0 || *maxID > math.MaxUint16 {
+		return fmt.Errorf("invalid max id %d", *maxID)
+	}
+
+	manifest := &Manifest{}
+	if err := readJSON(*manifestPath, manifest); err != nil {
+		return err
+	}
+	old, err := loadLock(*lockPath)
+	if err != nil {
+		return err
+	}
+	pkgName, structs, err := scan(dir, filepath.Base(*outPath))
+	if err != nil {
+		return err
+	}
+
+	r := &resolver{maxID: uint16(*maxID), allowBreaking: *allowBreaking}
+	lock, err := r.resolve(manifest, old, structs)
+	for _, w := range r.warnings {
+		fmt.Fprintln(os.Stderr, "warning:", w)
+	}
+	if err != nil {
+		return err
+	}
+
+	files := make(map[string][]byte)
+	if files[*lockPath], err = lock.encode(); err != nil {
+		return err
+	}
+	if files[*outPath], err = genGo(pkgName, lock); err != nil {
+		return err
+	}
+	if *clientPath != "" {
+		if files[*clientPath], err = genClient(*clientPath, lock); err != nil {
+			return err
+		}
+	}
+
+	for path, data := range files {
+		if *check {
+			current, err := os.ReadFile(path)
+			if err != nil || !bytes.Equal(current, data) {
+				return fmt.Errorf("%s is out of date, run msggen", path)
+			}
+			continue
+		}
+		if err = os.WriteFile(path, data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Manifest 消息清单，由使用者维护
+type Manifest struct {
+	Messages []ManifestEntry `json:"messages"`
+}
+
+// ManifestEntry 清单中的消息，Name为协议包中的结构体名
+type ManifestEntry struct {
+	Name string `json:"name"`
+	ID   uint16 `json:"id,omitempty"` // 为0时自动分配
+}
+
+// Lock 消息ID表，由msggen维护，需要与清单一起提交
+// 已经分配的ID不会改变，删除的消息记录在Retired中，其ID不会被再次分配
+type Lock struct {
+	Messages []LockEntry `json:"messages"`
+	Retired  []LockEntry `json:"retired,omitempty"`
+}
+
+type LockEntry struct {
+	Name   string   `json:"name"`
+	ID     uint16   `json:"id"`
+	Fields []string `json:"fields,omitempty"` // 导出字段，格式为"字段名 类型"
+}
+
+func readJSON(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func loadLock(path string) (*Lock, error) {
+	lock := &Lock{}
+	err := readJSON(path, lock)
+	if errors.Is(err, os.ErrNotExist) {
+		return lock, nil
+	}
+	return lock, err
+}
+
+func (l *Lock) encode() ([]byte, error) {
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// resolver 根据清单、旧的ID表与协议包中的结构体生成新的ID表
+type resolver struct {
+	maxID         uint16
+	allowBreaking bool // 是否允许不兼容的字段变更
+
+	errs     []string
+	warnings []string
+}
+
+func (r *resolver) errorf(format string, args ...interface{}) {
+	r.errs = append(r.errs, fmt.Sprintf(format, args...))
+}
+
+func (r *resolver) warnf(format string, args ...interface{}) {
+	r.warnings = append(r.warnings, fmt.Sprintf(format, args...))
+}
+
+func (r *resolver) err() error {
+	if len(r.errs) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(r.errs, "\n"))
+}
+
+func (r *resolver) resolve(m *Manifest, old *Lock, structs map[string][]string) (*Lock, error) {
+	locked := make(map[string]LockEntry, len(old.Messages))
+	used := make(map[uint16]string) // 已经被占用的ID -> 消息名
+	for _, e := range old.Messages {
+		locked[e.Name] = e
+		used[e.ID] = e.Name
+	}
+	retired := make(map[uint16]string, len(old.Retired))
+	for _, e := range old.Retired {
+		retired[e.ID] = e.Name
+	}
+
+	// 1. 校验清单，确定已有消息与显式指定的ID
+	names := make(map[string]bool, len(m.Messages))
+	explicit := make(map[uint16]string)
+	for _, e := range m.Messages {
+		if names[e.Name] {
+			r.errorf("message %s: declared more than once", e.Name)
+			continue
+		}
+		names[e.Name] = true
+		if _, ok := structs[e.Name]; !ok {
+			r.errorf("message %s: struct not found", e.Name)
+		}
+		if e.ID > r.maxID {
+			r.errorf("message %s: id %d exceeds max id %d", e.Name, e.ID, r.maxID)
+		}
+
+		if le, ok := locked[e.Name]; ok {
+			if e.ID != 0 && e.ID != le.ID {
+				r.errorf("message %s: id changed from %d to %d", e.Name, le.ID, e.ID)
+			}
+			continue
+		}
+		if e.ID == 0 {
+			continue
+		}
+		if name, ok := used[e.ID]; ok {
+			r.errorf("message %s: id %d collides with %s", e.Name, e.ID, name)
+		} else if name, ok = retired[e.ID]; ok {
+			r.errorf("message %s: id %d was used by removed message %s", e.Name, e.ID, name)
+		} else if name, ok = explicit[e.ID]; ok {
+			r.errorf("message %s: id %d collides with %s", e.Name, e.ID, name)
+		}
+		explicit[e.ID] = e.Name
+	}
+
+	// 2. 分配ID
+	var next uint16
+	for _, ids := range []map[uint16]string{used, retired, explicit} {
+		for id := range ids {
+			if id > next {
+				next = id
+			}
+		}
+	}
+
+	lock := &Lock{Retired: append([]LockEntry(nil), old.Retired...)}
+	for _, e := range m.Messages {
+		fields := structs[e.Name]
+		le, ok := locked[e.Name]
+		switch {
+		case ok:
+			r.checkFields(e.Name, le.Fields, fields)
+		case e.ID != 0:
+			le.ID = e.ID
+		default:
+			if next >= r.maxID {
+				r.errorf("message %s: no id available", e.Name)
+				continue
+			}
+			next++
+			le.ID = next
+		}
+		le.Name, le.Fields = e.Name, fields
+		lock.Messages = append(lock.Messages, le)
+	}
+
+	// 3. 清单中删除的消息
+	for _, e := range old.Messages {
+		if !names[e.Name] {
+			r.warnf("message %s: removed, id %d retired", e.Name, e.ID)
+			lock.Retired = append(lock.Retired, e)
+		}
+	}
+
+	sort.Slice(lock.Messages, func(i, j int) bool {
+		return lock.Messages[i].ID < lock.Messages[j].ID
+	})
+	sort.Slice(lock.Retired, func(i, j int) bool {
+		return lock.Retired[i].ID < lock.Retired[j].ID
+	})
+	return lock, r.err()
+}
+
+// checkFields 删除字段或者修改字段类型会导致新旧版本无法互通
+func (r *resolver) checkFields(name string, before, after []string) {
+	current := make(map[string]string, len(after))
+	for _, f := range after {
+		fName, fType := splitField(f)
+		current[fName] = fType
+	}
+	for _, f := range before {
+		fName, fType := splitField(f)
+		nType, ok := current[fName]
+		switch {
+		case !ok:
+			r.breaking("message %s: field %s removed", name, fName)
+		case nType != fType:
+			r.breaking("message %s: field %s changed from %s to %s", name, fName, fType, nType)
+		}
+	}
+}
+
+func (r *resolver) breaking(format string, args ...interface{}) {
+	if r.allowBreaking {
+		r.warnf(format, args...)
+		return
+	}
+	r.errorf(format+" (use -allow-breaking to accept)", args...)
+}
+
+func splitField(f string) (string, string) {
+	i := strings.IndexByte(f, ' ')
+	if i < 0 {
+		return f, ""
+	}
+	return f[:i], f[i+1:]
+}
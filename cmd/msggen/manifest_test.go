@@ -0,0 +1,49 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	structs := map[string][]string{
+		"Hello": {"Name string"},
+		"Bye":   nil,
+		"Ping":  nil,
+	}
+	r := &resolver{maxID: math.MaxUint16}
+	lock, err := r.resolve(&Manifest{Messages: []ManifestEntry{
+		{Name: "Hello", ID: 10},
+		{Name: "Bye"},
+	}}, &Lock{}, structs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lock.Messages[0].ID != 10 || lock.Messages[1].ID != 11 {
+		t.Fatalf("unexpected ids: %+v", lock.Messages)
+	}
+
+	// 删除Bye后新增的Ping不会复用Bye的ID
+	lock, err = r.resolve(&Manifest{Messages: []ManifestEntry{
+		{Name: "Hello"},
+		{Name: "Ping"},
+	}}, lock, structs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lock.Messages[1].Name != "Ping" || lock.Messages[1].ID != 12 || lock.Retired[0].ID != 11 {
+		t.Fatalf("unexpected lock: %+v", lock)
+	}
+
+	// 修改ID、ID冲突、修改字段类型
+	structs["Hello"] = []string{"Name int"}
+	_, err = (&resolver{maxID: math.MaxUint16}).resolve(&Manifest{Messages: []ManifestEntry{
+		{Name: "Hello", ID: 1},
+		{Name: "Ping"},
+		{Name: "Bye", ID: 12},
+	}}, lock, structs)
+	if err == nil {
+		t.Fatal("expect error")
+	}
+	t.Log(err)
+}
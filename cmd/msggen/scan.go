@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"os"
+	"strings"
+)
+
+// scan 解析dir下的Go源文件，返回包名与所有结构体的导出字段
+// 由.proto生成的Go代码同样适用，未导出的内部字段会被忽略
+func scan(dir string, skip string) (string, map[string][]string, error) {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, dir, func(fi os.FileInfo) bool {
+		name := fi.Name()
+		return !strings.HasSuffix(name, "_test.go") && name != skip
+	}, 0)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(pkgs) != 1 {
+		return "", nil, fmt.Errorf("%s: expect exactly one package, found %d", dir, len(pkgs))
+	}
+
+	var pkgName string
+	structs := make(map[string][]string)
+	for name, pkg := range pkgs {
+		pkgName = name
+		for _, file := range pkg.Files {
+			for _, decl := range file.Decls {
+				gen, ok := decl.(*ast.GenDecl)
+				if !ok || gen.Tok != token.TYPE {
+					continue
+				}
+				for _, spec := range gen.Specs {
+					ts := spec.(*ast.TypeSpec)
+					st, ok := ts.Type.(*ast.StructType)
+					if !ok {
+						continue
+					}
+					structs[ts.Name.Name] = structFields(st)
+				}
+			}
+		}
+	}
+	return pkgName, structs, nil
+}
+
+func structFields(st *ast.StructType) []string {
+	fields := make([]string, 0, len(st.Fields.List))
+	for _, f := range st.Fields.List {
+		fType := types.ExprString(f.Type)
+		// 匿名字段
+		if len(f.Names) == 0 {
+			name := strings.TrimPrefix(fType, "*")
+			if i := strings.LastIndexByte(name, '.'); i >= 0 {
+				name = name[i+1:]
+			}
+			if ast.IsExported(name) {
+				fields = append(fields, name+" "+fType)
+			}
+			continue
+		}
+		for _, n := range f.Names {
+			if n.IsExported() {
+				fields = append(fields, n.Name+" "+fType)
+			}
+		}
+	}
+	return fields
+}
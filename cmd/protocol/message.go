@@ -1,5 +1,7 @@
 package protocol
 
+//go:generate go run github.com/pyihe/gogame/cmd/msggen
+
 type Hello struct {
 	Name string
 }
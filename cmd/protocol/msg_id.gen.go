@@ -0,0 +1,15 @@
+// Code generated by msggen. DO NOT EDIT.
+
+package protocol
+
+import "github.com/pyihe/gogame/route"
+
+// 消息ID
+const (
+	IDHello uint16 = 1
+)
+
+// Register 向p注册所有消息，之后通过消息ID常量设置router或handler
+func Register(p route.Processor) {
+	p.Register(route.NewMessage(IDHello, &Hello{}))
+}
@@ -0,0 +1,144 @@
+package gogame
+
+import (
+	"sync"
+
+	"github.com/pyihe/gogame/network"
+	"github.com/pyihe/gogame/pkg/log"
+	"github.com/pyihe/gogame/registry"
+)
+
+// 通过注册中心发现的节点
+type discoveredNode struct {
+	addr   string
+	client *network.TCPClient
+}
+
+var discovery struct {
+	mu    sync.Mutex
+	node  *registry.Node
+	nodes map[uint16]*discoveredNode
+}
+
+func localNode() *registry.Node {
+	return &registry.Node{
+		ID:      server.opts.ServeId,
+		Addr:    server.opts.ClusterAddr,
+		Modules: clusterServerNames(),
+	}
+}
+
+func startDiscovery() {
+	reg := server.opts.Registry
+	if reg == nil {
+		return
+	}
+
+	discovery.mu.Lock()
+	discovery.node = localNode()
+	discovery.nodes = make(map[uint16]*discoveredNode)
+	discovery.mu.Unlock()
+
+	if err := reg.Watch(onNodeEvent); err != nil {
+		log.Printf("registry watch error: %v", err)
+	}
+	if err := reg.Register(discovery.node, server.opts.RegistryTTL); err != nil {
+		log.Printf("registry register error: %v", err)
+	}
+
+	nodes, err := reg.Nodes()
+	if err != nil {
+		log.Printf("registry get nodes error: %v", err)
+		return
+	}
+	for _, n := range nodes {
+		onNodeEvent(&registry.Event{Type: registry.EventPut, Node: n})
+	}
+}
+
+func stopDiscovery() {
+	reg := server.opts.Registry
+	if reg == nil {
+		return
+	}
+
+	if err := reg.Deregister(discovery.node); err != nil {
+		log.Printf("registry deregister error: %v", err)
+	}
+	reg.Close()
+
+	discovery.mu.Lock()
+	nodes := discovery.nodes
+	discovery.nodes = nil
+	discovery.mu.Unlock()
+
+	for _, n := range nodes {
+		n.client.Close()
+	}
+}
+
+func onNodeEvent(evt *registry.Event) {
+	if evt == nil || evt.Node == nil || evt.Node.ID == server.opts.ServeId {
+		return
+	}
+	switch evt.Type {
+	case registry.EventPut:
+		connectNode(evt.Node)
+	case registry.EventDelete:
+		disconnectNode(evt.Node.ID)
+	}
+}
+
+// 两个节点之间只需要一条连接：由节点ID较小的一方主动连接
+// 本节点没有监听地址时，其他节点无法连接过来，只能由本节点主动连接
+func shouldConnect(n *registry.Node) bool {
+	if n.Addr == "" {
+		return false
+	}
+	return server.opts.ClusterAddr == "" || server.opts.ServeId < n.ID
+}
+
+func connectNode(n *registry.Node) {
+	if !shouldConnect(n) {
+		return
+	}
+
+	discovery.mu.Lock()
+	if discovery.nodes == nil {
+		discovery.mu.Unlock()
+		return
+	}
+	old, ok := discovery.nodes[n.ID]
+	if ok && old.addr == n.Addr {
+		discovery.mu.Unlock()
+		return
+	}
+	client, err := newClusterClient(n.Addr)
+	if err != nil {
+		discovery.mu.Unlock()
+		log.Printf("connect node %d(%s) error: %v", n.ID, n.Addr, err)
+		return
+	}
+	discovery.nodes[n.ID] = &discoveredNode{
+		addr:   n.Addr,
+		client: client,
+	}
+	discovery.mu.Unlock()
+
+	// 节点地址发生了变化
+	if ok {
+		old.client.Close()
+	}
+	client.Start()
+}
+
+func disconnectNode(nodeID uint16) {
+	discovery.mu.Lock()
+	n, ok := discovery.nodes[nodeID]
+	delete(discovery.nodes, nodeID)
+	discovery.mu.Unlock()
+
+	if ok {
+		n.client.Close()
+	}
+}
@@ -0,0 +1,120 @@
+package gogame
+
+import (
+	"sync"
+
+	"github.com/pyihe/gogame/chanrpc"
+	"github.com/pyihe/gogame/pkg"
+	"github.com/pyihe/gogame/pkg/log"
+)
+
+// 事件在订阅者chanrpc server中注册的ID，避免与业务注册的ID冲突
+type topicID string
+
+var bus struct {
+	mu          sync.RWMutex
+	subscribers map[string][]*chanrpc.Server
+}
+
+func subscribe(topic string, s *chanrpc.Server, handler func(args ...interface{})) error {
+	if err := s.Register(topicID(topic), handler); err != nil {
+		return err
+	}
+
+	bus.mu.Lock()
+	if bus.subscribers == nil {
+		bus.subscribers = make(map[string][]*chanrpc.Server)
+	}
+	bus.subscribers[topic] = append(bus.subscribers[topic], s)
+	bus.mu.Unlock()
+	return nil
+}
+
+// unsubscribe 取消s对topic的订阅，之后可以重新订阅
+func unsubscribe(topic string, s *chanrpc.Server) {
+	bus.mu.Lock()
+	subscribers := bus.subscribers[topic]
+	for i, sub := range subscribers {
+		if sub == s {
+			// 复制一份，不影响正在发布的事件持有的列表
+			rest := make([]*chanrpc.Server, 0, len(subscribers)-1)
+			rest = append(rest, subscribers[:i]...)
+			bus.subscribers[topic] = append(rest, subscribers[i+1:]...)
+			if len(bus.subscribers[topic]) == 0 {
+				delete(bus.subscribers, topic)
+			}
+			break
+		}
+	}
+	bus.mu.Unlock()
+
+	s.Unregister(topicID(topic))
+}
+
+// unsubscribeAll 取消s的全部订阅，订阅者关闭时调用
+func unsubscribeAll(s *chanrpc.Server) {
+	var topics []string
+	bus.mu.RLock()
+	for topic, subscribers := range bus.subscribers {
+		for _, sub := range subscribers {
+			if sub == s {
+				topics = append(topics, topic)
+				break
+			}
+		}
+	}
+	bus.mu.RUnlock()
+
+	for _, topic := range topics {
+		unsubscribe(topic, s)
+	}
+}
+
+func publishLocal(topic string, args []interface{}) {
+	bus.mu.RLock()
+	subscribers := bus.subscribers[topic]
+	bus.mu.RUnlock()
+
+	// 同一个发布者依次投递，每个订阅者按发布顺序执行
+	// 投递不阻塞，订阅者在自己的goroutine中发布它也订阅的事件时不会死锁
+	for _, s := range subscribers {
+		switch err := s.TryPost(topicID(topic), args...); err {
+		case nil, pkg.ErrServerClosed, pkg.ErrNotRegistered:
+			// 订阅者已经关闭或者正在取消订阅
+		default:
+			log.Printf("publish event %s error: %v", topic, err)
+		}
+	}
+}
+
+// Publish 向本节点所有订阅了topic的模块发布事件
+// 订阅者的调用队列已满时丢弃该订阅者的事件(溢出策略为OverflowBlock时按照OverflowError处理)
+// goroutine safe
+func Publish(topic string, args ...interface{}) {
+	publishLocal(topic, args)
+}
+
+// PublishCluster 向本节点以及所有已连接节点中订阅了topic的模块发布事件
+// 参数中的自定义类型需要通过gob.Register注册
+// goroutine safe
+func PublishCluster(topic string, args ...interface{}) {
+	publishLocal(topic, args)
+
+	cluster.mu.RLock()
+	nodes := make([]*clusterAgent, 0, len(cluster.nodes))
+	for _, a := range cluster.nodes {
+		nodes = append(nodes, a)
+	}
+	cluster.mu.RUnlock()
+
+	for _, a := range nodes {
+		err := a.write(&clusterMsg{
+			Type:  clusterMsgEvent,
+			Topic: topic,
+			Args:  args,
+		})
+		if err != nil {
+			log.Printf("publish event %s to node %d error: %v", topic, a.nodeID, err)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package gogame
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pyihe/gogame/chanrpc"
+)
+
+func TestPublish(t *testing.T) {
+	const n = 100
+	results := make([]chan int, 2)
+	for i := range results {
+		ch := make(chan int, n)
+		s := NewSkeleton()
+		s.Subscribe("test.publish", func(args ...interface{}) {
+			ch <- args[0].(int)
+		})
+		s.Run()
+		defer s.Close()
+		results[i] = ch
+	}
+
+	for i := 0; i < n; i++ {
+		Publish("test.publish", i)
+	}
+	Publish("test.nobody", 0)
+
+	// 每个订阅者都按发布顺序收到全部事件
+	for _, ch := range results {
+		for i := 0; i < n; i++ {
+			select {
+			case v := <-ch:
+				if v != i {
+					t.Fatalf("got %d, want %d", v, i)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("event %d not delivered", i)
+			}
+		}
+	}
+}
+
+func TestUnsubscribe(t *testing.T) {
+	const topic = "test.unsubscribe"
+	closed := NewSkeleton()
+	closed.Subscribe(topic, func(args ...interface{}) {
+		t.Error("event delivered to closed subscriber")
+	})
+	closed.Run()
+
+	ch := make(chan int, 2)
+	s := NewSkeleton()
+	s.Subscribe(topic, func(args ...interface{}) {
+		ch <- args[0].(int)
+	})
+	s.Run()
+	defer s.Close()
+
+	// 订阅者关闭后不再是topic的订阅者，发布不受影响
+	closed.Close()
+	<-closed.done
+	Publish(topic, 1)
+	if got := <-ch; got != 1 {
+		t.Fatalf("got %d, want 1", got)
+	}
+	bus.mu.RLock()
+	n := len(bus.subscribers[topic])
+	bus.mu.RUnlock()
+	if n != 1 {
+		t.Fatalf("got %d subscribers, want 1", n)
+	}
+
+	// 取消订阅后可以重新订阅
+	s.Unsubscribe(topic)
+	Publish(topic, 2)
+	s.Subscribe(topic, func(args ...interface{}) {
+		ch <- args[0].(int) * 10
+	})
+	Publish(topic, 3)
+	select {
+	case got := <-ch:
+		if got != 30 {
+			t.Fatalf("got %d, want 30", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("event not delivered after subscribe again")
+	}
+}
+
+func TestPublishFull(t *testing.T) {
+	const topic = "test.full"
+	s := chanrpc.NewServer(1)
+	if err := subscribe(topic, s, func(args ...interface{}) {}); err != nil {
+		t.Fatal(err)
+	}
+	defer unsubscribe(topic, s)
+
+	// 订阅者的队列已满时发布不阻塞，比如订阅者在自己的goroutine中发布
+	done := make(chan struct{})
+	go func() {
+		Publish(topic, 1)
+		Publish(topic, 2)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("publish blocked by full subscriber")
+	}
+	if ci := <-s.Chan(); ci == nil {
+		t.Fatal("event not delivered")
+	}
+
+	// 已经关闭的订阅者被跳过
+	s.Close()
+	Publish(topic, 3)
+}
@@ -5,6 +5,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/pyihe/gogame/internal/gopool"
 	"github.com/pyihe/gogame/internal/gopprof"
 	"github.com/pyihe/gogame/internal/uuid"
 	"github.com/pyihe/gogame/network"
@@ -45,39 +46,47 @@ func initModule(modules ...Module) {
 }
 
 func initCluster() {
-	if server.opts.ClusterAddr == "" && len(server.opts.ClusterConnAddrs) == 0 {
+	if server.opts.ClusterAddr == "" && len(server.opts.ClusterConnAddrs) == 0 && server.opts.Registry == nil {
 		return
 	}
-	msgOption := &network.TCPMsgOption{
-		MsgHeaderLen: 4,
-		MsgMinLen:    1,
-		MsgMaxLen:    math.MaxUint32,
-		LittleEndian: false,
-	}
 	if server.opts.ClusterAddr != "" {
 		opts := network.TCPServerOptions{
 			Addr:        server.opts.ClusterAddr,
 			MaxConnNum:  math.MaxInt,
 			WriteBuffer: 100,
-			MsgOption:   msgOption,
+			MsgOption:   clusterMsgOption(),
 		}
 		server.clusterServer, _ = network.NewTCPServer(opts, newClusterAgent)
 	}
 
 	server.clusterClients = make([]*network.TCPClient, 0, len(server.opts.ClusterConnAddrs))
 	for _, addr := range server.opts.ClusterConnAddrs {
-		opts := network.TCPClientOption{
-			Addr:            addr,
-			ConnNum:         1,
-			WriteBuffer:     100,
-			ConnectInterval: 3 * time.Second,
-			MsgOption:       msgOption,
-		}
-		client, _ := network.NewTCPClient(opts, newClusterAgent)
+		client, _ := newClusterClient(addr)
 		server.clusterClients = append(server.clusterClients, client)
 	}
 }
 
+func clusterMsgOption() *network.TCPMsgOption {
+	return &network.TCPMsgOption{
+		MsgHeaderLen: 4,
+		MsgMinLen:    1,
+		MsgMaxLen:    math.MaxUint32,
+		LittleEndian: false,
+	}
+}
+
+func newClusterClient(addr string) (*network.TCPClient, error) {
+	opts := network.TCPClientOption{
+		Addr:            addr,
+		ConnNum:         1,
+		AutoReconnect:   true,
+		WriteBuffer:     100,
+		ConnectInterval: 3 * time.Second,
+		MsgOption:       clusterMsgOption(),
+	}
+	return network.NewTCPClient(opts, newOutboundClusterAgent)
+}
+
 func start() {
 	// 运行每个模块
 	for _, m := range server.mods {
@@ -91,9 +100,18 @@ func start() {
 	for _, client := range server.clusterClients {
 		client.Start()
 	}
+
+	// 注册节点并发现其他节点
+	startDiscovery()
 }
 
 func stop() {
+	// 注销节点
+	stopDiscovery()
+
+	// 排空连接
+	drainModules()
+
 	// 关闭cluster
 	if server.clusterServer != nil {
 		server.clusterServer.Close()
@@ -108,6 +126,22 @@ func stop() {
 	}
 }
 
+func drainModules() {
+	var wg sync.WaitGroup
+	for _, m := range server.mods {
+		d, ok := m.mi.(Drainer)
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		gopool.AddTask(func() {
+			defer wg.Done()
+			d.Drain()
+		})
+	}
+	wg.Wait()
+}
+
 // Run 模块注册入口，必须提供Options与Module
 func Run(opts *Options, modules ...Module) {
 	if len(modules) == 0 {
@@ -1,8 +1,11 @@
 package gogame
 
 import (
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/pyihe/gogame/internal/gopool"
 	"github.com/pyihe/gogame/network"
 	"github.com/pyihe/gogame/pkg/log"
 	"github.com/pyihe/gogame/route"
@@ -13,9 +16,24 @@ type Gate struct {
 	MsgMaxLen    uint32          // 最大消息长度
 	MsgMinLen    uint32          // 最小消息长度
 	MaxConnNum   int             // 最大连接数
-	WriteBuffer  int             // 发送消息时的写缓冲区大小
+	WriteBuffer  int             // 发送消息时的写缓冲区大小(消息数量)，KCP按照MsgMaxLen与MTU换算为分片数量
 	Processor    route.Processor // 消息处理
 	AgentHandler AgentHook       // agent handler
+	MaxPending   int             // 信封模式下每个连接等待响应的请求数量上限，默认1024，超过时丢弃最早的请求
+
+	// 写缓冲区已满(客户端接收太慢)时的处理策略，为nil时断开连接，原因为pkg.ErrSlowConsumer
+	SlowConsumer *network.SlowConsumerOption
+
+	ProtocolVersion    uint16        // 服务器当前的协议版本，大于0时连接建立后先进行版本握手
+	MinProtocolVersion uint16        // 支持的最低协议版本，更低版本的客户端会收到需要更新的回复
+	HandshakeTimeout   time.Duration // 握手(协议版本与会话加密)的超时时间
+	ReadIdleTimeout    time.Duration // 读空闲超时，超过该时间没有收到任何消息则断开连接，原因为pkg.ErrIdleTimeout
+	WriteIdleTimeout   time.Duration // 写空闲超时，单次写入阻塞(KCP为已发送的数据没有被确认)超过该时间则断开连接
+	Heartbeat          bool          // 是否开启内置心跳，见HeartbeatPing
+	ResumeTimeout      time.Duration // 会话保留时间，大于0时开启会话恢复，见ResumeOK
+	ResumeBuffer       int           // 会话缓存的未确认消息数量上限，默认256，断开期间超出上限的会话无法恢复，需要小于WriteBuffer
+	DrainTimeout       time.Duration // 关闭时等待已经写入的消息发送完毕的最长时间，为0时立即关闭所有连接
+	MaintenanceMsg     interface{}   // 排空连接时通过Processor向每个连接发送的消息，比如服务器维护通知，为nil时不发送
 
 	// websocket
 	WSAddr      string
@@ -23,23 +41,52 @@ type Gate struct {
 	KeyFile     string
 	RootCAFile  string
 	HTTPTimeout time.Duration
+	WSTextMode  bool // 文本模式：使用文本帧收发JSON格式的消息，以消息名代替消息ID，便于浏览器与H5客户端调试
 
 	// tcp
 	TCPAddr      string
 	MsgHeaderLen int
 	LittleEndian bool
+	Encrypt      bool // 是否开启会话加密(ECDH + AES-GCM)，用于不方便使用TLS的客户端
+
+	// kcp
+	KCPAddr string
+	KCP     *network.KCPOption // KCP协议参数，为nil时使用默认值，需要与客户端一致
 
 	wsServer  *network.WSServer
 	tcpServer *network.TCPServer
+	kcpServer *network.KCPServer
+
+	sessionsMu     sync.Mutex
+	sessions       map[string]*gateAgent // token -> 可恢复的会话
+	sessionsClosed bool
+
+	agentsMu  sync.Mutex
+	agents    map[*gateAgent]struct{} // 已经通知AgentHook的agent
+	draining  int32
+	drainOnce sync.Once
+}
+
+const defaultMaxPending = 1024
+
+func (gate *Gate) maxPending() int {
+	if gate.MaxPending > 0 {
+		return gate.MaxPending
+	}
+	return defaultMaxPending
 }
 
 func (gate *Gate) Start() {
-	if gate.WSAddr == "" && gate.TCPAddr == "" {
+	if gate.WSAddr == "" && gate.TCPAddr == "" && gate.KCPAddr == "" {
 		log.Fatalf("no addr to listen")
 	}
 	if gate.Processor == nil {
 		log.Fatalf("no route")
 	}
+	// 恢复会话时一次写入握手回复与全部缓存的消息，写缓冲区放不下时会被当作慢速客户端断开
+	if gate.ResumeTimeout > 0 && gate.WriteBuffer > 0 && gate.WriteBuffer <= gate.resumeBuffer() {
+		log.Fatalf("WriteBuffer (%d) must be greater than ResumeBuffer (%d)", gate.WriteBuffer, gate.resumeBuffer())
+	}
 
 	err := gate.newWSServer()
 	if err != nil {
@@ -49,15 +96,102 @@ func (gate *Gate) Start() {
 	if err != nil {
 		log.Fatalf("new tcp server err: %v", err)
 	}
+	err = gate.newKCPServer()
+	if err != nil {
+		log.Fatalf("new kcp server err: %v", err)
+	}
+}
+
+// writeBuffer 开启会话恢复且没有设置WriteBuffer时，使用能够容纳一次完整重发的大小
+func (gate *Gate) writeBuffer() int {
+	if gate.WriteBuffer <= 0 && gate.ResumeTimeout > 0 {
+		return gate.resumeBuffer() + 1
+	}
+	return gate.WriteBuffer
 }
 
+// Close 关闭gate，DrainTimeout大于0时先排空连接，见Drain
 func (gate *Gate) Close() {
+	gate.Drain()
+}
+
+// Drain 排空连接：停止接受新连接，向每个连接发送MaintenanceMsg，等待已经写入的消息发送完毕后关闭，最多等待DrainTimeout
+// 只执行一次，之后再调用Close不会有任何作用
+func (gate *Gate) Drain() {
+	gate.drainOnce.Do(gate.drain)
+}
+
+func (gate *Gate) drain() {
+	atomic.StoreInt32(&gate.draining, 1)
+	if gate.DrainTimeout <= 0 {
+		if gate.wsServer != nil {
+			gate.wsServer.Close()
+		}
+		if gate.tcpServer != nil {
+			gate.tcpServer.Close()
+		}
+		if gate.kcpServer != nil {
+			gate.kcpServer.Close()
+		}
+		gate.closeSessions()
+		return
+	}
+
+	if gate.MaintenanceMsg != nil {
+		for _, a := range gate.onlineAgents() {
+			a.WriteMsg(gate.MaintenanceMsg)
+		}
+	}
+	// 排空期间断开的连接不再保留会话
+	gate.closeSessions()
+
+	var wg sync.WaitGroup
+	shutdown := func(f func(time.Duration)) {
+		wg.Add(1)
+		gopool.AddTask(func() {
+			defer wg.Done()
+			f(gate.DrainTimeout)
+		})
+	}
 	if gate.wsServer != nil {
-		gate.wsServer.Close()
+		shutdown(gate.wsServer.Shutdown)
 	}
 	if gate.tcpServer != nil {
-		gate.tcpServer.Close()
+		shutdown(gate.tcpServer.Shutdown)
+	}
+	if gate.kcpServer != nil {
+		shutdown(gate.kcpServer.Shutdown)
 	}
+	wg.Wait()
+}
+
+func (gate *Gate) isDraining() bool {
+	return atomic.LoadInt32(&gate.draining) == 1
+}
+
+func (gate *Gate) addAgent(a *gateAgent) {
+	gate.agentsMu.Lock()
+	if gate.agents == nil {
+		gate.agents = make(map[*gateAgent]struct{})
+	}
+	gate.agents[a] = struct{}{}
+	gate.agentsMu.Unlock()
+}
+
+func (gate *Gate) removeAgent(a *gateAgent) {
+	gate.agentsMu.Lock()
+	delete(gate.agents, a)
+	gate.agentsMu.Unlock()
+}
+
+func (gate *Gate) onlineAgents() []*gateAgent {
+	gate.agentsMu.Lock()
+	defer gate.agentsMu.Unlock()
+	agents := make([]*gateAgent, 0, len(gate.agents))
+	for a := range gate.agents {
+		agents = append(agents, a)
+	}
+	return agents
 }
 
 func (gate *Gate) newWSServer() (err error) {
@@ -68,6 +202,7 @@ func (gate *Gate) newWSServer() (err error) {
 		agt := &gateAgent{
 			conn: conn,
 			gate: gate,
+			text: conn.TextMode(),
 		}
 		return agt
 	}
@@ -75,9 +210,14 @@ func (gate *Gate) newWSServer() (err error) {
 	opts := network.WSServerOption{
 		Addr:        gate.WSAddr,
 		MaxConnNum:  gate.MaxConnNum,
-		WriteBuff:   gate.WriteBuffer,
+		WriteBuff:   gate.writeBuffer(),
 		MsgMaxLen:   gate.MsgMaxLen,
 		HTTPTimeout: gate.HTTPTimeout,
+		TextMode:    gate.WSTextMode,
+
+		ReadIdleTimeout:  gate.ReadIdleTimeout,
+		WriteIdleTimeout: gate.WriteIdleTimeout,
+		SlowConsumer:     gate.SlowConsumer,
 		TLSOption: &network.TLSOption{
 			TLSCert:       gate.CertFile,
 			TLSKey:        gate.KeyFile,
@@ -107,7 +247,11 @@ func (gate *Gate) newTCPServer() (err error) {
 	opts := network.TCPServerOptions{
 		Addr:        gate.TCPAddr,
 		MaxConnNum:  gate.MaxConnNum,
-		WriteBuffer: gate.WriteBuffer,
+		WriteBuffer: gate.writeBuffer(),
+
+		ReadIdleTimeout:  gate.ReadIdleTimeout,
+		WriteIdleTimeout: gate.WriteIdleTimeout,
+		SlowConsumer:     gate.SlowConsumer,
 		MsgOption: &network.TCPMsgOption{
 			MsgHeaderLen: gate.MsgHeaderLen,
 			MsgMinLen:    gate.MsgMinLen,
@@ -115,6 +259,11 @@ func (gate *Gate) newTCPServer() (err error) {
 			LittleEndian: gate.LittleEndian,
 		},
 	}
+	if gate.Encrypt {
+		opts.CryptoOption = &network.CryptoOption{
+			HandshakeTimeout: gate.HandshakeTimeout,
+		}
+	}
 	gate.tcpServer, err = network.NewTCPServer(opts, newAgentFunc)
 	if err != nil {
 		return
@@ -123,3 +272,33 @@ func (gate *Gate) newTCPServer() (err error) {
 	gate.tcpServer.Start()
 	return
 }
+
+func (gate *Gate) newKCPServer() (err error) {
+	if gate.KCPAddr == "" {
+		return
+	}
+	newAgentFunc := func(conn *network.KCPConn) network.Agent {
+		agt := &gateAgent{
+			conn: conn,
+			gate: gate,
+		}
+		return agt
+	}
+	opts := network.KCPServerOption{
+		Addr:             gate.KCPAddr,
+		MaxConnNum:       gate.MaxConnNum,
+		WriteBuffer:      network.KCPWriteBuffer(gate.writeBuffer(), gate.MsgMaxLen, gate.KCP),
+		MsgMaxLen:        gate.MsgMaxLen,
+		ReadIdleTimeout:  gate.ReadIdleTimeout,
+		WriteIdleTimeout: gate.WriteIdleTimeout,
+		SlowConsumer:     gate.SlowConsumer,
+		KCP:              gate.KCP,
+	}
+	gate.kcpServer, err = network.NewKCPServer(opts, newAgentFunc)
+	if err != nil {
+		return
+	}
+	// 启动服务
+	gate.kcpServer.Start()
+	return
+}
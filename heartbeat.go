@@ -0,0 +1,23 @@
+package gogame
+
+import "github.com/pyihe/gogame/network"
+
+// 内置心跳
+// Gate.Heartbeat开启后，长度为1字节的消息作为心跳，由gate直接处理，不经过Processor
+// 客户端发送HeartbeatPing，gate回复HeartbeatPong；配合Gate.ReadIdleTimeout，超时未收到任何消息的连接会被断开
+// 两个值分别是ASCII的TAB与LF，都是合法的UTF-8，文本模式的WebSocket连接同样适用
+const (
+	HeartbeatPing byte = 0x09
+	HeartbeatPong byte = 0x0a
+)
+
+// onHeartbeat 处理心跳消息，data不是心跳时返回false
+func (a *gateAgent) onHeartbeat(conn network.Conn, data []byte) bool {
+	if !a.gate.Heartbeat || len(data) != 1 {
+		return false
+	}
+	if data[0] == HeartbeatPing {
+		conn.WriteMsg([]byte{HeartbeatPong})
+	}
+	return true
+}
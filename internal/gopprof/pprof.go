@@ -2,6 +2,7 @@ package gopprof
 
 import (
 	"context"
+	"encoding/json"
 	golog "log"
 	"net"
 	"net/http"
@@ -12,6 +13,7 @@ import (
 	"time"
 
 	"github.com/julienschmidt/httprouter"
+	"github.com/pyihe/gogame/chanrpc"
 	"github.com/pyihe/gogame/pkg/log"
 )
 
@@ -80,6 +82,9 @@ func New(addr string) *ProfileServer {
 	// /debug/pprof/mutex
 	router.Handler("GET", "/debug/pprof/mutex", pprof.Handler("mutex"))
 
+	// /debug/chanrpc 开启了统计的chanrpc server的统计快照
+	router.HandlerFunc("GET", "/debug/chanrpc", chanRPCStatsHandler())
+
 	return s
 }
 
@@ -113,7 +118,8 @@ func (p *ProfileServer) Running() bool {
 }
 
 func (p *ProfileServer) Destroy() {
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 	p.httpServer.Shutdown(ctx)
 }
 
@@ -128,6 +134,15 @@ func setBlockRateHandler() http.HandlerFunc {
 	}
 }
 
+func chanRPCStatsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, request *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(chanrpc.AllStats()); err != nil {
+			log.Printf("fail to encode chanrpc stats: %v", err)
+		}
+	}
+}
+
 func notFoundHandler() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, request *http.Request) {
 		w.WriteHeader(http.StatusNotFound)
@@ -2,6 +2,7 @@ package goroutine
 
 import (
 	"runtime"
+	"sync"
 
 	"github.com/pyihe/gogame/internal/gopool"
 	"github.com/pyihe/gogame/pkg"
@@ -13,6 +14,9 @@ import (
 type Go struct {
 	ChanCb    chan func()
 	pendingGo *pkg.AtomicInt32
+
+	mu     sync.Mutex
+	closed bool // Close之后Post不再投递
 }
 
 type LinearGo struct {
@@ -22,7 +26,8 @@ type LinearGo struct {
 
 func New(size int) *Go {
 	return &Go{
-		ChanCb: make(chan func(), size),
+		ChanCb:    make(chan func(), size),
+		pendingGo: new(pkg.AtomicInt32),
 	}
 }
 
@@ -37,6 +42,38 @@ func (g *Go) Go(f func(), cb func()) {
 	})
 }
 
+// Post 将cb投递到ChanCb中执行，ChanCb已满时等待，Close不会等待尚未调用的Post
+// Close之后调用时不再投递，返回pkg.ErrServerClosed
+func (g *Go) Post(cb func()) error {
+	g.mu.Lock()
+	if g.closed {
+		g.mu.Unlock()
+		return pkg.ErrServerClosed
+	}
+	g.pendingGo.Incr(1)
+	g.mu.Unlock()
+
+	g.ChanCb <- cb
+	return nil
+}
+
+// TryPost 与Post相同，但是ChanCb已满时不等待，返回pkg.ErrFullChannel
+// 可以在执行ChanCb的goroutine中调用
+func (g *Go) TryPost(cb func()) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		return pkg.ErrServerClosed
+	}
+	select {
+	case g.ChanCb <- cb:
+		g.pendingGo.Incr(1)
+		return nil
+	default:
+		return pkg.ErrFullChannel
+	}
+}
+
 func (g *Go) Cb(cb func()) {
 	if cb == nil {
 		g.pendingGo.Incr(-1)
@@ -55,6 +92,10 @@ func (g *Go) Cb(cb func()) {
 }
 
 func (g *Go) Close() {
+	g.mu.Lock()
+	g.closed = true
+	g.mu.Unlock()
+
 	for g.pendingGo.Value() > 0 {
 		g.Cb(<-g.ChanCb)
 	}
@@ -29,6 +29,12 @@ type Module interface {
 	Destroy()
 }
 
+// Drainer 销毁前需要排空连接的模块实现，比如组合了Gate的模块
+// 关闭时先并行地排空所有Drainer，此时其他模块仍在运行，然后再按顺序销毁模块
+type Drainer interface {
+	Drain()
+}
+
 type module struct {
 	mi Module
 	wg sync.WaitGroup
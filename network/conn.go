@@ -2,7 +2,10 @@ package network
 
 import (
 	"net"
+	"sync"
 	"time"
+
+	"github.com/pyihe/gogame/internal/gopool"
 )
 
 type Agent interface {
@@ -19,6 +22,8 @@ type Agent interface {
 type Conn interface {
 	// Close 关闭底层连接
 	Close()
+	// CloseGracefully 等待已经写入的消息发送完毕后关闭底层连接，最多等待timeout
+	CloseGracefully(timeout time.Duration)
 	// LocalAddr 获取本地主机网络地址
 	LocalAddr() net.Addr
 	// RemoteAddr 获取远端主机网络地址
@@ -35,4 +40,36 @@ type Conn interface {
 	SetReadDeadline(t time.Time) error
 	// SetWriteDeadline 设置写超时时间点
 	SetWriteDeadline(t time.Time) error
+	// Stats 发送统计
+	Stats() ConnStats
+}
+
+// flush 向写队列投递结束标志，等待写goroutine将此前的消息发送完毕，最多等待timeout
+func flush(writeChan chan []byte, writeDone chan struct{}, timeout time.Duration) {
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	select {
+	case writeChan <- nil:
+	case <-t.C:
+		return
+	}
+	select {
+	case <-writeDone:
+	case <-t.C:
+	}
+}
+
+// closeGracefully 并行地优雅关闭conns，所有连接最多等待timeout
+func closeGracefully(conns []Conn, timeout time.Duration) {
+	var wg sync.WaitGroup
+	for _, conn := range conns {
+		conn := conn
+		wg.Add(1)
+		gopool.AddTask(func() {
+			defer wg.Done()
+			conn.CloseGracefully(timeout)
+		})
+	}
+	wg.Wait()
 }
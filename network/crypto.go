@@ -0,0 +1,139 @@
+package network
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pyihe/gogame/network/packet"
+	"github.com/pyihe/gogame/pkg"
+)
+
+// 会话加密
+// 1. 连接建立后客户端先发送自己的临时P-256公钥，服务端回复自己的临时公钥，两个公钥都按普通消息封包
+// 2. 双方通过ECDH得到共享密钥，再以HMAC-SHA256派生出两个方向各自的AES-256-GCM密钥
+// 3. 之后每个消息体单独加密，nonce为该方向上的消息序号，不在报文中传输
+//    TCP保证有序，重放、丢弃或者调换顺序的报文都会因为序号不匹配而解密失败
+// 注意：公钥没有经过认证，只能防止窃听与篡改，不能防止主动的中间人攻击
+
+const (
+	labelClientToServer = "gogame c2s"
+	labelServerToClient = "gogame s2c"
+)
+
+var curve = elliptic.P256()
+
+type sessionCipher struct {
+	mu      sync.Mutex // 保证加密顺序与写入顺序一致
+	seal    cipher.AEAD
+	sealSeq uint64
+	open    cipher.AEAD
+	openSeq uint64
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func deriveKey(shared []byte, label string, clientPub, serverPub []byte) []byte {
+	mac := hmac.New(sha256.New, shared)
+	mac.Write([]byte(label))
+	mac.Write(clientPub)
+	mac.Write(serverPub)
+	return mac.Sum(nil)
+}
+
+func nonce(aead cipher.AEAD, seq uint64) []byte {
+	n := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(n[len(n)-8:], seq)
+	return n
+}
+
+// encrypt 调用方需要持有mu
+func (c *sessionCipher) encrypt(b []byte) []byte {
+	data := c.seal.Seal(nil, nonce(c.seal, c.sealSeq), b, nil)
+	c.sealSeq++
+	return data
+}
+
+// decrypt 只在读goroutine中调用
+func (c *sessionCipher) decrypt(b []byte) ([]byte, error) {
+	data, err := c.open.Open(nil, nonce(c.open, c.openSeq), b, nil)
+	if err != nil {
+		return nil, pkg.ErrDecryptFailed
+	}
+	c.openSeq++
+	return data, nil
+}
+
+// handshake 在conn上完成密钥交换，isClient为true时以客户端身份握手
+func handshake(conn net.Conn, parser packet.Parser, isClient bool, timeout time.Duration) (*sessionCipher, error) {
+	priv, x, y, err := elliptic.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	localPub := elliptic.Marshal(curve, x, y)
+
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	send := func() error {
+		data, err := parser.Packet(localPub)
+		if err != nil {
+			return err
+		}
+		_, err = conn.Write(data)
+		return err
+	}
+
+	if isClient {
+		if err = send(); err != nil {
+			return nil, err
+		}
+	}
+	remotePub, err := parser.UnPacket(conn)
+	if err != nil {
+		return nil, err
+	}
+	rx, ry := elliptic.Unmarshal(curve, remotePub)
+	if rx == nil {
+		return nil, pkg.ErrInvalidPublicKey
+	}
+	if !isClient {
+		if err = send(); err != nil {
+			return nil, err
+		}
+	}
+
+	sx, _ := curve.ScalarMult(rx, ry, priv)
+	shared := sx.FillBytes(make([]byte, (curve.Params().BitSize+7)/8))
+
+	clientPub, serverPub := localPub, remotePub
+	sealLabel, openLabel := labelClientToServer, labelServerToClient
+	if !isClient {
+		clientPub, serverPub = remotePub, localPub
+		sealLabel, openLabel = openLabel, sealLabel
+	}
+
+	c := &sessionCipher{}
+	if c.seal, err = newAEAD(deriveKey(shared, sealLabel, clientPub, serverPub)); err != nil {
+		return nil, err
+	}
+	if c.open, err = newAEAD(deriveKey(shared, openLabel, clientPub, serverPub)); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
@@ -0,0 +1,165 @@
+package network
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/pyihe/gogame/pkg"
+)
+
+type echoAgent struct {
+	conn Conn
+}
+
+func (a *echoAgent) OnConnect() {}
+func (a *echoAgent) OnClose()   {}
+func (a *echoAgent) Run() {
+	for {
+		data, err := a.conn.ReadMsg()
+		if err != nil {
+			return
+		}
+		a.conn.WriteMsg(data)
+	}
+}
+
+type recvAgent struct {
+	conn Conn
+	recv chan []byte
+}
+
+func (a *recvAgent) OnConnect() {}
+func (a *recvAgent) OnClose()   {}
+func (a *recvAgent) Run() {
+	for {
+		data, err := a.conn.ReadMsg()
+		if err != nil {
+			return
+		}
+		a.recv <- data
+	}
+}
+
+func TestEncryptedConn(t *testing.T) {
+	server, err := NewTCPServer(TCPServerOptions{
+		Addr:         "127.0.0.1:0",
+		CryptoOption: &CryptoOption{},
+	}, func(conn *TCPConn) Agent {
+		return &echoAgent{conn: conn}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Start()
+	defer server.Close()
+
+	agent := &recvAgent{recv: make(chan []byte, 10)}
+	connected := make(chan *TCPConn, 1)
+	client, err := NewTCPClient(TCPClientOption{
+		Addr:         server.listener.Addr().String(),
+		CryptoOption: &CryptoOption{},
+	}, func(conn *TCPConn) Agent {
+		agent.conn = conn
+		connected <- conn
+		return agent
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Start()
+	defer client.Close()
+
+	conn := <-connected
+	for i := 0; i < 3; i++ {
+		msg := []byte("hello")
+		if err = conn.WriteMsg(msg[:1], msg[1:]); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case data := <-agent.recv:
+			if !bytes.Equal(data, msg) {
+				t.Fatalf("got %q, want %q", data, msg)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout")
+		}
+	}
+
+	// 重放已经发送过的密文会导致解密失败
+	c := &sessionCipher{seal: conn.cipher.seal}
+	replay, _ := conn.msgParser.Packet(c.encrypt([]byte("hello")))
+	conn.WriteBytes(replay)
+	select {
+	case data := <-agent.recv:
+		t.Fatalf("replayed frame accepted: %q", data)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// blockAgent 不读取数据，直到stop被关闭
+type blockAgent struct {
+	stop chan struct{}
+}
+
+func (a *blockAgent) OnConnect() {}
+func (a *blockAgent) OnClose()   {}
+func (a *blockAgent) Run()       { <-a.stop }
+
+func TestEncryptedSlowDrop(t *testing.T) {
+	agent := &idleAgent{err: make(chan error, 1)}
+	connected := make(chan *TCPConn, 1)
+	server, err := NewTCPServer(TCPServerOptions{
+		Addr:         "127.0.0.1:0",
+		WriteBuffer:  1,
+		CryptoOption: &CryptoOption{},
+		SlowConsumer: &SlowConsumerOption{Policy: SlowDrop},
+	}, func(conn *TCPConn) Agent {
+		agent.conn = conn
+		connected <- conn
+		return agent
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Start()
+	defer server.Close()
+
+	// 客户端完成密钥交换后不再读取数据
+	stop := make(chan struct{})
+	defer close(stop)
+	client, err := NewTCPClient(TCPClientOption{
+		Addr:         server.listener.Addr().String(),
+		CryptoOption: &CryptoOption{},
+	}, func(conn *TCPConn) Agent {
+		return &blockAgent{stop: stop}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Start()
+	defer client.Close()
+
+	// 加密的消息不能丢弃，写缓冲区已满时断开连接
+	conn := <-connected
+	payload := make([]byte, 4000)
+	for i := 0; i < 10000; i++ {
+		if err = conn.WriteMsg(payload); err != nil {
+			break
+		}
+	}
+	if err != pkg.ErrSlowConsumer {
+		t.Fatalf("got %v, want %v", err, pkg.ErrSlowConsumer)
+	}
+	if s := conn.Stats(); s.Dropped != 1 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+	select {
+	case err = <-agent.err:
+		if err != pkg.ErrSlowConsumer {
+			t.Fatalf("got %v, want %v", err, pkg.ErrSlowConsumer)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("connection not closed")
+	}
+}
@@ -0,0 +1,733 @@
+package kcp
+
+import (
+	"encoding/binary"
+
+	"github.com/pyihe/gogame/pkg"
+)
+
+// KCP协议的纯Go实现，协议格式与skywind3000/kcp(ikcp.c)一致，只支持消息模式
+// KCP本身不是goroutine安全的，调用方需要自己加锁
+
+const (
+	rtoNoDelay = 30    // nodelay模式下的最小rto
+	rtoMin     = 100   // 普通模式下的最小rto
+	rtoDef     = 200   // 默认rto
+	rtoMax     = 60000 // 最大rto
+
+	cmdPush = 81 // 数据
+	cmdAck  = 82 // 确认
+	cmdWask = 83 // 询问对端窗口大小
+	cmdWins = 84 // 告知本端窗口大小
+	cmdFin  = 85 // 会话已经关闭，不属于ikcp协议，由上层在Input之前处理
+
+	askSend = 1 // 需要发送cmdWask
+	askTell = 2 // 需要发送cmdWins
+
+	wndSnd = 32  // 默认发送窗口
+	wndRcv = 128 // 默认接收窗口，同时也是单个消息的最大分片数
+
+	mtuDef      = 1400
+	interval    = 100
+	deadLink    = 20 // 单个分片的最大重传次数，超过后连接视为断开
+	threshInit  = 2
+	threshMin   = 2
+	probeInit   = 7000   // 窗口探测的初始间隔
+	probeLimit  = 120000 // 窗口探测的最大间隔
+	fastackLim  = 5      // 快速重传的最大次数
+	maxInterval = 5000
+	minInterval = 10
+)
+
+// Overhead 每个分片的头部长度
+const Overhead = 24
+
+type segment struct {
+	conv     uint32
+	cmd      uint8
+	frg      uint8
+	wnd      uint16
+	ts       uint32
+	sn       uint32
+	una      uint32
+	rto      uint32
+	xmit     uint32
+	resendts uint32
+	fastack  uint32
+	data     []byte
+}
+
+func (seg *segment) encode(ptr []byte) []byte {
+	var h [Overhead]byte
+	binary.LittleEndian.PutUint32(h[0:], seg.conv)
+	h[4] = seg.cmd
+	h[5] = seg.frg
+	binary.LittleEndian.PutUint16(h[6:], seg.wnd)
+	binary.LittleEndian.PutUint32(h[8:], seg.ts)
+	binary.LittleEndian.PutUint32(h[12:], seg.sn)
+	binary.LittleEndian.PutUint32(h[16:], seg.una)
+	binary.LittleEndian.PutUint32(h[20:], uint32(len(seg.data)))
+	return append(ptr, h[:]...)
+}
+
+type ackItem struct {
+	sn uint32
+	ts uint32
+}
+
+// KCP 一个KCP会话
+type KCP struct {
+	conv, mtu, mss, state               uint32
+	sndUna, sndNxt, rcvNxt              uint32
+	ssthresh                            uint32
+	rxRttval, rxSrtt                    int32
+	rxRto, rxMinrto                     uint32
+	sndWnd, rcvWnd, rmtWnd, cwnd, probe uint32
+	current, interval, tsFlush, xmit    uint32
+	nodelay                             uint32
+	updated                             bool
+	tsProbe, probeWait                  uint32
+	incr                                uint32
+
+	sndQueue []*segment
+	rcvQueue []*segment
+	sndBuf   []*segment
+	rcvBuf   []*segment
+	acklist  []ackItem
+
+	fastresend int32
+	fastlimit  int32
+	nocwnd     bool
+
+	buffer []byte
+	output func(data []byte)
+}
+
+// New 创建会话号为conv的KCP，output用于发送底层数据包，调用返回后data不能再被使用
+func New(conv uint32, output func(data []byte)) *KCP {
+	k := &KCP{
+		conv:      conv,
+		sndWnd:    wndSnd,
+		rcvWnd:    wndRcv,
+		rmtWnd:    wndRcv,
+		mtu:       mtuDef,
+		mss:       mtuDef - Overhead,
+		rxRto:     rtoDef,
+		rxMinrto:  rtoMin,
+		interval:  interval,
+		tsFlush:   interval,
+		ssthresh:  threshInit,
+		fastlimit: fastackLim,
+		output:    output,
+	}
+	k.buffer = make([]byte, 0, (k.mtu+Overhead)*3)
+	return k
+}
+
+// Conv 获取数据包中的会话号
+func Conv(data []byte) (uint32, bool) {
+	if len(data) < Overhead {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint32(data), true
+}
+
+// IsPush 数据包的第一个分片是否为数据分片，用于判断是否需要为新的对端创建会话
+func IsPush(data []byte) bool {
+	return len(data) >= Overhead && data[4] == cmdPush
+}
+
+// FinPacket 通知对端会话已经关闭的数据包，只有分片头部
+func FinPacket(conv uint32) []byte {
+	seg := segment{conv: conv, cmd: cmdFin}
+	return seg.encode(nil)
+}
+
+// IsFin 数据包是否为FinPacket
+func IsFin(data []byte) bool {
+	return len(data) >= Overhead && data[4] == cmdFin
+}
+
+func timediff(later, earlier uint32) int32 {
+	return int32(later - earlier)
+}
+
+// PeekSize 下一个完整消息的长度，没有完整消息时返回-1
+func (k *KCP) PeekSize() int {
+	if len(k.rcvQueue) == 0 {
+		return -1
+	}
+	seg := k.rcvQueue[0]
+	if seg.frg == 0 {
+		return len(seg.data)
+	}
+	if len(k.rcvQueue) < int(seg.frg)+1 {
+		return -1
+	}
+	length := 0
+	for _, seg := range k.rcvQueue {
+		length += len(seg.data)
+		if seg.frg == 0 {
+			break
+		}
+	}
+	return length
+}
+
+// Recv 获取一个完整的消息，没有时返回nil
+func (k *KCP) Recv() []byte {
+	size := k.PeekSize()
+	if size < 0 {
+		return nil
+	}
+	full := len(k.rcvQueue) >= int(k.rcvWnd)
+
+	buf := make([]byte, 0, size)
+	n := 0
+	for _, seg := range k.rcvQueue {
+		buf = append(buf, seg.data...)
+		n++
+		if seg.frg == 0 {
+			break
+		}
+	}
+	k.rcvQueue = removeFront(k.rcvQueue, n)
+	k.moveRcvBuf()
+
+	// 接收队列从满变为不满，告知对端窗口大小
+	if full && len(k.rcvQueue) < int(k.rcvWnd) {
+		k.probe |= askTell
+	}
+	return buf
+}
+
+// Send 发送一个消息，消息会按照mss分片
+func (k *KCP) Send(data []byte) error {
+	count := 1
+	if len(data) > int(k.mss) {
+		count = (len(data) + int(k.mss) - 1) / int(k.mss)
+	}
+	if count >= wndRcv {
+		return pkg.ErrMessageTooLong
+	}
+	for i := 0; i < count; i++ {
+		size := len(data)
+		if size > int(k.mss) {
+			size = int(k.mss)
+		}
+		seg := &segment{
+			frg:  uint8(count - i - 1),
+			data: append([]byte(nil), data[:size]...),
+		}
+		k.sndQueue = append(k.sndQueue, seg)
+		data = data[size:]
+	}
+	return nil
+}
+
+func (k *KCP) updateAck(rtt int32) {
+	if k.rxSrtt == 0 {
+		k.rxSrtt = rtt
+		k.rxRttval = rtt / 2
+	} else {
+		delta := rtt - k.rxSrtt
+		if delta < 0 {
+			delta = -delta
+		}
+		k.rxRttval = (3*k.rxRttval + delta) / 4
+		k.rxSrtt = (7*k.rxSrtt + rtt) / 8
+		if k.rxSrtt < 1 {
+			k.rxSrtt = 1
+		}
+	}
+	rto := uint32(k.rxSrtt) + max32(k.interval, uint32(4*k.rxRttval))
+	k.rxRto = bound(k.rxMinrto, rto, rtoMax)
+}
+
+func (k *KCP) shrinkBuf() {
+	if len(k.sndBuf) > 0 {
+		k.sndUna = k.sndBuf[0].sn
+	} else {
+		k.sndUna = k.sndNxt
+	}
+}
+
+func (k *KCP) parseAck(sn uint32) {
+	if timediff(sn, k.sndUna) < 0 || timediff(sn, k.sndNxt) >= 0 {
+		return
+	}
+	for i, seg := range k.sndBuf {
+		if sn == seg.sn {
+			k.sndBuf = append(k.sndBuf[:i], k.sndBuf[i+1:]...)
+			break
+		}
+		if timediff(sn, seg.sn) < 0 {
+			break
+		}
+	}
+}
+
+func (k *KCP) parseUna(una uint32) {
+	count := 0
+	for _, seg := range k.sndBuf {
+		if timediff(una, seg.sn) <= 0 {
+			break
+		}
+		count++
+	}
+	k.sndBuf = removeFront(k.sndBuf, count)
+}
+
+func (k *KCP) parseFastack(sn uint32) {
+	if timediff(sn, k.sndUna) < 0 || timediff(sn, k.sndNxt) >= 0 {
+		return
+	}
+	for _, seg := range k.sndBuf {
+		if timediff(sn, seg.sn) < 0 {
+			break
+		}
+		if sn != seg.sn {
+			seg.fastack++
+		}
+	}
+}
+
+func (k *KCP) parseData(newseg *segment) {
+	sn := newseg.sn
+	if timediff(sn, k.rcvNxt+k.rcvWnd) >= 0 || timediff(sn, k.rcvNxt) < 0 {
+		return
+	}
+
+	i := len(k.rcvBuf) - 1
+	for ; i >= 0; i-- {
+		seg := k.rcvBuf[i]
+		if seg.sn == sn {
+			return
+		}
+		if timediff(sn, seg.sn) > 0 {
+			break
+		}
+	}
+	k.rcvBuf = append(k.rcvBuf, nil)
+	copy(k.rcvBuf[i+2:], k.rcvBuf[i+1:])
+	k.rcvBuf[i+1] = newseg
+
+	k.moveRcvBuf()
+}
+
+// moveRcvBuf 将rcvBuf中连续的分片移动到rcvQueue
+func (k *KCP) moveRcvBuf() {
+	count := 0
+	for _, seg := range k.rcvBuf {
+		if seg.sn != k.rcvNxt || len(k.rcvQueue) >= int(k.rcvWnd) {
+			break
+		}
+		k.rcvQueue = append(k.rcvQueue, seg)
+		k.rcvNxt++
+		count++
+	}
+	k.rcvBuf = removeFront(k.rcvBuf, count)
+}
+
+// Input 处理收到的底层数据包
+func (k *KCP) Input(data []byte) error {
+	prevUna := k.sndUna
+	var maxack uint32
+	var flag bool
+
+	if len(data) < Overhead {
+		return pkg.ErrMessageTooShort
+	}
+	for len(data) >= Overhead {
+		conv := binary.LittleEndian.Uint32(data)
+		if conv != k.conv {
+			return pkg.ErrInvalidConv
+		}
+		cmd := data[4]
+		frg := data[5]
+		wnd := binary.LittleEndian.Uint16(data[6:])
+		ts := binary.LittleEndian.Uint32(data[8:])
+		sn := binary.LittleEndian.Uint32(data[12:])
+		una := binary.LittleEndian.Uint32(data[16:])
+		length := binary.LittleEndian.Uint32(data[20:])
+		data = data[Overhead:]
+		if uint32(len(data)) < length {
+			return pkg.ErrMessageTooShort
+		}
+		if cmd != cmdPush && cmd != cmdAck && cmd != cmdWask && cmd != cmdWins {
+			return pkg.ErrInvalidCommand
+		}
+
+		k.rmtWnd = uint32(wnd)
+		k.parseUna(una)
+		k.shrinkBuf()
+
+		switch cmd {
+		case cmdAck:
+			if rtt := timediff(k.current, ts); rtt >= 0 {
+				k.updateAck(rtt)
+			}
+			k.parseAck(sn)
+			k.shrinkBuf()
+			if !flag || timediff(sn, maxack) > 0 {
+				flag = true
+				maxack = sn
+			}
+		case cmdPush:
+			if timediff(sn, k.rcvNxt+k.rcvWnd) < 0 {
+				k.acklist = append(k.acklist, ackItem{sn: sn, ts: ts})
+				if timediff(sn, k.rcvNxt) >= 0 {
+					k.parseData(&segment{
+						conv: conv,
+						cmd:  cmd,
+						frg:  frg,
+						wnd:  wnd,
+						ts:   ts,
+						sn:   sn,
+						una:  una,
+						data: append([]byte(nil), data[:length]...),
+					})
+				}
+			}
+		case cmdWask:
+			k.probe |= askTell
+		}
+		data = data[length:]
+	}
+
+	if flag {
+		k.parseFastack(maxack)
+	}
+
+	// 拥塞窗口增长
+	if timediff(k.sndUna, prevUna) > 0 && k.cwnd < k.rmtWnd {
+		mss := k.mss
+		if k.cwnd < k.ssthresh {
+			k.cwnd++
+			k.incr += mss
+		} else {
+			if k.incr < mss {
+				k.incr = mss
+			}
+			k.incr += (mss*mss)/k.incr + mss/16
+			if (k.cwnd+1)*mss <= k.incr {
+				k.cwnd = (k.incr + mss - 1) / mss
+			}
+		}
+		if k.cwnd > k.rmtWnd {
+			k.cwnd = k.rmtWnd
+			k.incr = k.rmtWnd * mss
+		}
+	}
+	return nil
+}
+
+func (k *KCP) wndUnused() uint16 {
+	if len(k.rcvQueue) < int(k.rcvWnd) {
+		return uint16(int(k.rcvWnd) - len(k.rcvQueue))
+	}
+	return 0
+}
+
+func (k *KCP) flush() {
+	if !k.updated {
+		return
+	}
+	current := k.current
+
+	seg := segment{
+		conv: k.conv,
+		cmd:  cmdAck,
+		wnd:  k.wndUnused(),
+		una:  k.rcvNxt,
+	}
+
+	ptr := k.buffer[:0]
+	makeSpace := func(space int) {
+		if len(ptr)+space > int(k.mtu) {
+			k.output(ptr)
+			ptr = k.buffer[:0]
+		}
+	}
+
+	// 确认
+	for _, ack := range k.acklist {
+		makeSpace(Overhead)
+		seg.sn, seg.ts = ack.sn, ack.ts
+		ptr = seg.encode(ptr)
+	}
+	k.acklist = k.acklist[:0]
+
+	// 对端窗口为0时定时探测
+	if k.rmtWnd == 0 {
+		if k.probeWait == 0 {
+			k.probeWait = probeInit
+			k.tsProbe = current + k.probeWait
+		} else if timediff(current, k.tsProbe) >= 0 {
+			if k.probeWait < probeInit {
+				k.probeWait = probeInit
+			}
+			k.probeWait += k.probeWait / 2
+			if k.probeWait > probeLimit {
+				k.probeWait = probeLimit
+			}
+			k.tsProbe = current + k.probeWait
+			k.probe |= askSend
+		}
+	} else {
+		k.tsProbe = 0
+		k.probeWait = 0
+	}
+
+	seg.sn, seg.ts = 0, 0
+	if k.probe&askSend != 0 {
+		seg.cmd = cmdWask
+		makeSpace(Overhead)
+		ptr = seg.encode(ptr)
+	}
+	if k.probe&askTell != 0 {
+		seg.cmd = cmdWins
+		makeSpace(Overhead)
+		ptr = seg.encode(ptr)
+	}
+	k.probe = 0
+
+	// 发送窗口
+	cwnd := min32(k.sndWnd, k.rmtWnd)
+	if !k.nocwnd {
+		cwnd = min32(k.cwnd, cwnd)
+	}
+
+	count := 0
+	for _, newseg := range k.sndQueue {
+		if timediff(k.sndNxt, k.sndUna+cwnd) >= 0 {
+			break
+		}
+		newseg.conv = k.conv
+		newseg.cmd = cmdPush
+		newseg.ts = current
+		newseg.sn = k.sndNxt
+		newseg.resendts = current
+		newseg.rto = k.rxRto
+		k.sndNxt++
+		k.sndBuf = append(k.sndBuf, newseg)
+		count++
+	}
+	k.sndQueue = removeFront(k.sndQueue, count)
+
+	resent := uint32(0xffffffff)
+	if k.fastresend > 0 {
+		resent = uint32(k.fastresend)
+	}
+	var rtomin uint32
+	if k.nodelay == 0 {
+		rtomin = k.rxRto >> 3
+	}
+
+	var change, lost bool
+	for _, sg := range k.sndBuf {
+		needsend := false
+		switch {
+		case sg.xmit == 0:
+			needsend = true
+			sg.rto = k.rxRto
+			sg.resendts = current + sg.rto + rtomin
+		case timediff(current, sg.resendts) >= 0:
+			needsend = true
+			k.xmit++
+			switch {
+			case k.nodelay == 0:
+				sg.rto += max32(sg.rto, k.rxRto)
+			case k.nodelay < 2:
+				sg.rto += sg.rto / 2
+			default:
+				sg.rto += k.rxRto / 2
+			}
+			sg.resendts = current + sg.rto
+			lost = true
+		case sg.fastack >= resent:
+			if k.fastlimit <= 0 || sg.xmit <= uint32(k.fastlimit) {
+				needsend = true
+				sg.fastack = 0
+				sg.resendts = current + sg.rto
+				change = true
+			}
+		}
+		if !needsend {
+			continue
+		}
+
+		sg.xmit++
+		sg.ts = current
+		sg.wnd = seg.wnd
+		sg.una = k.rcvNxt
+
+		makeSpace(Overhead + len(sg.data))
+		ptr = sg.encode(ptr)
+		ptr = append(ptr, sg.data...)
+
+		if sg.xmit >= deadLink {
+			k.state = 0xffffffff
+		}
+	}
+	if len(ptr) > 0 {
+		k.output(ptr)
+	}
+
+	// 快速重传后调整拥塞窗口
+	if change {
+		inflight := k.sndNxt - k.sndUna
+		k.ssthresh = inflight / 2
+		if k.ssthresh < threshMin {
+			k.ssthresh = threshMin
+		}
+		k.cwnd = k.ssthresh + resent
+		k.incr = k.cwnd * k.mss
+	}
+	// 超时重传后进入慢启动
+	if lost {
+		k.ssthresh = cwnd / 2
+		if k.ssthresh < threshMin {
+			k.ssthresh = threshMin
+		}
+		k.cwnd = 1
+		k.incr = k.mss
+	}
+	if k.cwnd < 1 {
+		k.cwnd = 1
+		k.incr = k.mss
+	}
+}
+
+// Update 驱动KCP，需要每隔interval毫秒调用一次，current为毫秒时间戳
+func (k *KCP) Update(current uint32) {
+	k.current = current
+	if !k.updated {
+		k.updated = true
+		k.tsFlush = current
+	}
+
+	slap := timediff(current, k.tsFlush)
+	if slap >= 10000 || slap < -10000 {
+		k.tsFlush = current
+		slap = 0
+	}
+	if slap >= 0 {
+		k.tsFlush += k.interval
+		if timediff(current, k.tsFlush) >= 0 {
+			k.tsFlush = current + k.interval
+		}
+		k.flush()
+	}
+}
+
+// Flush 立即发送等待中的数据，用于降低发送延迟
+func (k *KCP) Flush(current uint32) {
+	k.current = current
+	k.flush()
+}
+
+// SetMtu 设置MTU
+func (k *KCP) SetMtu(mtu int) error {
+	if mtu < 50 || mtu < Overhead {
+		return pkg.ErrInvalidMtu
+	}
+	k.mtu = uint32(mtu)
+	k.mss = k.mtu - Overhead
+	k.buffer = make([]byte, 0, (mtu+Overhead)*3)
+	return nil
+}
+
+// SetWndSize 设置发送窗口与接收窗口大小，单位为分片，小于等于0时不修改
+// 接收窗口不能小于单个消息的最大分片数
+func (k *KCP) SetWndSize(sndWnd, rcvWnd int) {
+	if sndWnd > 0 {
+		k.sndWnd = uint32(sndWnd)
+	}
+	if rcvWnd > 0 {
+		k.rcvWnd = max32(uint32(rcvWnd), wndRcv)
+	}
+}
+
+// NoDelay 设置工作模式
+// nodelay: 0不启用，1启用nodelay模式(最小rto更小，超时后rto增长更慢)
+// interval: 内部工作间隔，单位毫秒
+// resend: 快速重传，为2时表示被跳过2次确认就立即重传，0表示关闭
+// nc: 是否关闭拥塞控制
+func (k *KCP) NoDelay(nodelay, interval, resend int, nc bool) {
+	if nodelay >= 0 {
+		k.nodelay = uint32(nodelay)
+		if nodelay != 0 {
+			k.rxMinrto = rtoNoDelay
+		} else {
+			k.rxMinrto = rtoMin
+		}
+	}
+	if interval >= 0 {
+		k.interval = bound(minInterval, uint32(interval), maxInterval)
+	}
+	if resend >= 0 {
+		k.fastresend = int32(resend)
+	}
+	k.nocwnd = nc
+}
+
+// WaitSnd 等待发送的分片数量
+func (k *KCP) WaitSnd() int {
+	return len(k.sndBuf) + len(k.sndQueue)
+}
+
+// SndUna 最早的未被确认的分片序号，对端确认数据后增加
+func (k *KCP) SndUna() uint32 {
+	return k.sndUna
+}
+
+// WaitSndBytes 等待发送以及等待确认的数据字节数
+func (k *KCP) WaitSndBytes() int {
+	n := 0
+	for _, sg := range k.sndBuf {
+		n += len(sg.data)
+	}
+	for _, sg := range k.sndQueue {
+		n += len(sg.data)
+	}
+	return n
+}
+
+// Dead 是否有分片的重传次数超过上限，此时连接视为断开
+func (k *KCP) Dead() bool {
+	return k.state == 0xffffffff
+}
+
+// Interval 内部工作间隔，单位毫秒
+func (k *KCP) Interval() uint32 {
+	return k.interval
+}
+
+func removeFront(q []*segment, n int) []*segment {
+	if n == 0 {
+		return q
+	}
+	for i := 0; i < n; i++ {
+		q[i] = nil
+	}
+	return q[n:]
+}
+
+func min32(a, b uint32) uint32 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max32(a, b uint32) uint32 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func bound(lower, middle, upper uint32) uint32 {
+	return min32(max32(lower, middle), upper)
+}
@@ -0,0 +1,66 @@
+package kcp
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// 在内存中连接两个KCP，丢弃部分数据包，检查消息是否按序完整到达
+func TestLossyLink(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	var toB, toA [][]byte
+	lossy := func(q *[][]byte) func([]byte) {
+		return func(data []byte) {
+			if rnd.Intn(100) < 20 {
+				return
+			}
+			*q = append(*q, append([]byte(nil), data...))
+		}
+	}
+	a := New(1, lossy(&toB))
+	b := New(1, lossy(&toA))
+	a.NoDelay(1, 10, 2, true)
+	b.NoDelay(1, 10, 2, true)
+
+	var sent [][]byte
+	for i := 0; i < 100; i++ {
+		msg := bytes.Repeat([]byte{byte(i)}, 1+rnd.Intn(5000))
+		if err := a.Send(msg); err != nil {
+			t.Fatal(err)
+		}
+		sent = append(sent, msg)
+	}
+
+	var recv [][]byte
+	for current := uint32(0); current < 60000 && (len(recv) < len(sent) || a.WaitSnd() > 0); current += 10 {
+		a.Update(current)
+		b.Update(current)
+		for _, data := range toB {
+			if err := b.Input(data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, data := range toA {
+			if err := a.Input(data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		toA, toB = toA[:0], toB[:0]
+		for msg := b.Recv(); msg != nil; msg = b.Recv() {
+			recv = append(recv, msg)
+		}
+	}
+
+	if len(recv) != len(sent) {
+		t.Fatalf("received %d messages, want %d", len(recv), len(sent))
+	}
+	for i := range sent {
+		if !bytes.Equal(sent[i], recv[i]) {
+			t.Fatalf("message %d mismatch", i)
+		}
+	}
+	if a.Dead() || a.WaitSnd() != 0 {
+		t.Fatalf("dead %v, wait send %d", a.Dead(), a.WaitSnd())
+	}
+}
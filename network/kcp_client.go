@@ -0,0 +1,171 @@
+package network
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pyihe/gogame/internal/gopool"
+	"github.com/pyihe/gogame/pkg"
+	"github.com/pyihe/gogame/pkg/log"
+)
+
+// KCPClient 基于KCP的可靠UDP客户端，每个连接使用独立的UDP socket和随机的会话ID
+// 会话ID使用crypto/rand生成，重新连接时不会与旧会话重复
+type KCPClient struct {
+	opts     atomic.Value
+	newAgent func(*KCPConn) Agent
+
+	mu    sync.RWMutex
+	conns map[*KCPConn]struct{}
+
+	wg        sync.WaitGroup
+	closed    int32
+	closeChan chan struct{}
+}
+
+func NewKCPClient(opts KCPClientOption, newAgent func(*KCPConn) Agent) (*KCPClient, error) {
+	if newAgent == nil {
+		return nil, pkg.ErrNilNewAgent
+	}
+	opts.setDefault()
+
+	c := &KCPClient{
+		newAgent:  newAgent,
+		conns:     make(map[*KCPConn]struct{}),
+		closeChan: make(chan struct{}),
+	}
+	c.swapOpts(&opts)
+	return c, nil
+}
+
+func (client *KCPClient) getOpts() *KCPClientOption {
+	return client.opts.Load().(*KCPClientOption)
+}
+
+func (client *KCPClient) swapOpts(opts *KCPClientOption) {
+	client.opts.Store(opts)
+}
+
+func (client *KCPClient) isClosed() bool {
+	return atomic.LoadInt32(&client.closed) == pkg.StatusClosed
+}
+
+func (client *KCPClient) Start() {
+	if !atomic.CompareAndSwapInt32(&client.closed, pkg.StatusInitial, pkg.StatusRunning) {
+		return
+	}
+
+	for i := 0; i < client.getOpts().ConnNum; i++ {
+		client.wg.Add(1)
+		gopool.AddTask(client.connect)
+	}
+}
+
+// sleep 等待d，客户端关闭时立即返回false
+func (client *KCPClient) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-client.closeChan:
+		return false
+	}
+}
+
+// dial UDP没有连接过程，只创建socket，服务端在收到第一个数据分片时建立会话
+func (client *KCPClient) dial() *KCPConn {
+	opts := client.getOpts()
+	raddr, err := net.ResolveUDPAddr("udp", opts.Addr)
+	if err != nil {
+		log.Printf("failed to resolve udp address(%s) error: %v", opts.Addr, err)
+		return nil
+	}
+	var conv [4]byte
+	if _, err = rand.Read(conv[:]); err != nil {
+		log.Printf("failed to generate conv error: %v", err)
+		return nil
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		log.Printf("failed to listen udp error: %v", err)
+		return nil
+	}
+
+	kcpConn := newKCPConn(binary.LittleEndian.Uint32(conv[:]), conn, raddr, opts.KCP, opts.WriteBuffer, opts.MsgMaxLen, opts.ReadIdleTimeout, opts.WriteIdleTimeout, opts.SlowConsumer, func(*KCPConn) {
+		conn.Close()
+	})
+
+	gopool.AddTask(func() {
+		buf := make([]byte, 65536)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				kcpConn.Close()
+				return
+			}
+			kcpConn.input(buf[:n])
+		}
+	})
+	return kcpConn
+}
+
+func (client *KCPClient) connect() {
+	defer client.wg.Done()
+
+reconnect:
+	kcpConn := client.dial()
+	if kcpConn == nil {
+		if client.getOpts().AutoReconnect && client.sleep(client.getOpts().ConnectInterval) {
+			goto reconnect
+		}
+		return
+	}
+
+	client.mu.Lock()
+	if client.isClosed() {
+		client.mu.Unlock()
+		kcpConn.Close()
+		return
+	}
+	client.conns[kcpConn] = struct{}{}
+	client.mu.Unlock()
+
+	agent := client.newAgent(kcpConn)
+	agent.OnConnect()
+	agent.Run()
+
+	// cleanup
+	kcpConn.Close()
+	client.mu.Lock()
+	delete(client.conns, kcpConn)
+	client.mu.Unlock()
+	agent.OnClose()
+
+	if client.getOpts().AutoReconnect && client.sleep(client.getOpts().ConnectInterval) {
+		goto reconnect
+	}
+}
+
+func (client *KCPClient) Close() {
+	if !atomic.CompareAndSwapInt32(&client.closed, pkg.StatusRunning, pkg.StatusClosed) {
+		return
+	}
+	close(client.closeChan)
+
+	client.mu.Lock()
+	conns := make([]*KCPConn, 0, len(client.conns))
+	for kcpConn := range client.conns {
+		conns = append(conns, kcpConn)
+	}
+	client.mu.Unlock()
+
+	for _, kcpConn := range conns {
+		kcpConn.Close()
+	}
+	client.wg.Wait()
+}
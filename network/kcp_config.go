@@ -0,0 +1,132 @@
+package network
+
+import (
+	"math"
+	"time"
+
+	"github.com/pyihe/gogame/network/kcp"
+)
+
+// KCPOption KCP协议参数，客户端与服务端需要一致
+type KCPOption struct {
+	// 是否启用nodelay模式
+	NoDelay bool
+	// 内部工作间隔，单位毫秒，默认10
+	Interval int
+	// 快速重传，被跳过Resend次确认后立即重传，0表示关闭
+	Resend int
+	// 是否关闭拥塞控制
+	NoCongestion bool
+	// 发送窗口，单位为分片，默认32
+	SndWnd int
+	// 接收窗口，单位为分片，默认128
+	RcvWnd int
+	// MTU，默认1400
+	MTU int
+}
+
+func (opt *KCPOption) setDefault() {
+	if opt.Interval <= 0 {
+		opt.Interval = 10
+	}
+	if opt.MTU <= 0 {
+		opt.MTU = 1400
+	}
+}
+
+type KCPServerOption struct {
+	// UDP地址
+	Addr string
+	// 最大连接数
+	MaxConnNum int
+	// 写缓冲区大小，等待发送的分片数量达到该值时按照SlowConsumer处理
+	// 注意单位是分片而不是TCP与WebSocket的消息数量，可以使用KCPWriteBuffer换算
+	WriteBuffer int
+	// 写缓冲区已满时的处理策略，为nil时断开连接，原因为pkg.ErrSlowConsumer
+	// SlowCoalesce时消息继续进入KCP发送队列，等待发送的字节数超过CoalesceMax后断开连接
+	SlowConsumer *SlowConsumerOption
+	// 单个消息的最大长度
+	MsgMaxLen uint32
+	// 读空闲超时，UDP没有断开通知，超过该时间没有收到任何数据则断开连接，默认30秒
+	ReadIdleTimeout time.Duration
+	// 写空闲超时，已经发送的数据超过该时间没有被对端确认则断开连接，为0时不限制
+	WriteIdleTimeout time.Duration
+
+	KCP *KCPOption
+}
+
+func (opt *KCPServerOption) setDefault() {
+	if opt.MaxConnNum <= 0 {
+		opt.MaxConnNum = math.MaxInt
+	}
+	if opt.WriteBuffer <= 0 {
+		opt.WriteBuffer = 1000
+	}
+	if opt.MsgMaxLen == 0 {
+		opt.MsgMaxLen = 4096
+	}
+	if opt.ReadIdleTimeout <= 0 {
+		opt.ReadIdleTimeout = 30 * time.Second
+	}
+	if opt.KCP == nil {
+		opt.KCP = &KCPOption{}
+	}
+	opt.KCP.setDefault()
+	opt.SlowConsumer.setDefault()
+}
+
+type KCPClientOption struct {
+	Addr            string
+	ConnNum         int
+	AutoReconnect   bool
+	ConnectInterval time.Duration
+	WriteBuffer     int
+	MsgMaxLen       uint32
+	ReadIdleTimeout time.Duration
+	// 写空闲超时，含义与KCPServerOption.WriteIdleTimeout相同
+	WriteIdleTimeout time.Duration
+	// 写缓冲区已满时的处理策略，含义与KCPServerOption.SlowConsumer相同
+	SlowConsumer *SlowConsumerOption
+
+	KCP *KCPOption
+}
+
+func (opt *KCPClientOption) setDefault() {
+	if opt.ConnNum <= 0 {
+		opt.ConnNum = 1
+	}
+	if opt.ConnectInterval <= 0 {
+		opt.ConnectInterval = 3 * time.Second
+	}
+	if opt.WriteBuffer <= 0 {
+		opt.WriteBuffer = 1000
+	}
+	if opt.MsgMaxLen == 0 {
+		opt.MsgMaxLen = 4096
+	}
+	if opt.ReadIdleTimeout <= 0 {
+		opt.ReadIdleTimeout = 30 * time.Second
+	}
+	if opt.KCP == nil {
+		opt.KCP = &KCPOption{}
+	}
+	opt.KCP.setDefault()
+	opt.SlowConsumer.setDefault()
+}
+
+// KCPWriteBuffer 将能够容纳msgs个消息的写缓冲区换算为KCP的分片数量，每个消息按照msgMaxLen计算
+// msgMaxLen为0与opt为nil时使用默认值
+func KCPWriteBuffer(msgs int, msgMaxLen uint32, opt *KCPOption) int {
+	if msgs <= 0 {
+		return msgs
+	}
+	if msgMaxLen == 0 {
+		msgMaxLen = 4096
+	}
+	mtu := 1400
+	if opt != nil && opt.MTU > 0 {
+		mtu = opt.MTU
+	}
+	mss := mtu - kcp.Overhead
+	return msgs * ((int(msgMaxLen) + mss - 1) / mss)
+}
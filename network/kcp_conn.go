@@ -0,0 +1,391 @@
+package network
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pyihe/gogame/internal/gopool"
+	"github.com/pyihe/gogame/network/kcp"
+	"github.com/pyihe/gogame/pkg"
+	"github.com/pyihe/gogame/pkg/log"
+)
+
+// timeoutError 读超时，实现net.Error以便上层按超时处理
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// KCPConn 基于UDP的可靠连接，一个KCPConn对应一个KCP会话
+// 服务端所有会话共用同一个UDP socket，按对端地址区分
+type KCPConn struct {
+	mu           sync.Mutex // guard kcp, readDeadline, reason
+	kcp          *kcp.KCP
+	readDeadline time.Time
+	reason       error // 断开原因
+
+	conv        uint32
+	conn        net.PacketConn
+	remote      net.Addr
+	writeBuffer int    // 等待发送的分片数量上限
+	maxMsgLen   uint32 // 单个消息的最大长度
+	readIdle    time.Duration
+	writeIdle   time.Duration
+	slow        *SlowConsumerOption // 写缓冲区已满时的处理策略
+	writeMu     sync.Mutex          // 保证写入的顺序，SlowBlock等待期间不阻塞关闭
+	dropped     uint64              // 因为写缓冲区已满而丢弃的消息数量
+
+	readEvent chan struct{} // 收到数据时通知ReadMsg
+	closeChan chan struct{}
+	closeFlag int32
+	onClose   func(*KCPConn) // 连接关闭时调用，用于从服务端或者客户端移除
+}
+
+func newKCPConn(conv uint32, conn net.PacketConn, remote net.Addr, opt *KCPOption, writeBuffer int, maxMsgLen uint32, readIdle, writeIdle time.Duration, slow *SlowConsumerOption, onClose func(*KCPConn)) *KCPConn {
+	if slow == nil {
+		slow = &SlowConsumerOption{}
+		slow.setDefault()
+	}
+	kcpConn := new(KCPConn)
+	kcpConn.conv = conv
+	kcpConn.conn = conn
+	kcpConn.remote = remote
+	kcpConn.writeBuffer = writeBuffer
+	kcpConn.maxMsgLen = maxMsgLen
+	kcpConn.readIdle = readIdle
+	kcpConn.writeIdle = writeIdle
+	kcpConn.slow = slow
+	kcpConn.readEvent = make(chan struct{}, 1)
+	kcpConn.closeChan = make(chan struct{})
+	kcpConn.onClose = onClose
+	kcpConn.closeFlag = pkg.StatusRunning
+
+	kcpConn.kcp = kcp.New(conv, kcpConn.output)
+	nodelay := 0
+	if opt.NoDelay {
+		nodelay = 1
+	}
+	kcpConn.kcp.NoDelay(nodelay, opt.Interval, opt.Resend, opt.NoCongestion)
+	kcpConn.kcp.SetWndSize(opt.SndWnd, opt.RcvWnd)
+	kcpConn.kcp.SetMtu(opt.MTU)
+
+	gopool.AddTask(func() {
+		kcpConn.updateLoop()
+	})
+	return kcpConn
+}
+
+// currentMs KCP使用的毫秒时钟，溢出后回绕不影响KCP计算时间差
+func currentMs() uint32 {
+	return uint32(time.Now().UnixNano() / int64(time.Millisecond))
+}
+
+func (kcpConn *KCPConn) isClosed() bool {
+	return atomic.LoadInt32(&kcpConn.closeFlag) == pkg.StatusClosed
+}
+
+// output KCP输出的UDP包直接发送给对端
+func (kcpConn *KCPConn) output(data []byte) {
+	kcpConn.conn.WriteTo(data, kcpConn.remote)
+}
+
+// input 输入从UDP socket收到的数据，对端关闭会话时以io.EOF断开
+func (kcpConn *KCPConn) input(data []byte) {
+	if kcp.IsFin(data) {
+		kcpConn.mu.Lock()
+		if kcpConn.reason == nil {
+			kcpConn.reason = io.EOF
+		}
+		kcpConn.mu.Unlock()
+		kcpConn.close(false)
+		return
+	}
+	kcpConn.mu.Lock()
+	err := kcpConn.kcp.Input(data)
+	kcpConn.mu.Unlock()
+	if err != nil {
+		return
+	}
+	select {
+	case kcpConn.readEvent <- struct{}{}:
+	default:
+	}
+}
+
+// updateLoop 按照Interval驱动KCP重传、确认和窗口探测，对端长时间不确认时关闭连接
+func (kcpConn *KCPConn) updateLoop() {
+	kcpConn.mu.Lock()
+	interval := time.Duration(kcpConn.kcp.Interval()) * time.Millisecond
+	una := kcpConn.kcp.SndUna()
+	kcpConn.mu.Unlock()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	acked := time.Now() // 最近一次对端确认数据或者没有等待确认的数据的时间
+	for {
+		now := time.Now()
+		kcpConn.mu.Lock()
+		kcpConn.kcp.Update(currentMs())
+		dead := kcpConn.kcp.Dead()
+		if kcpConn.kcp.WaitSnd() == 0 || kcpConn.kcp.SndUna() != una {
+			una, acked = kcpConn.kcp.SndUna(), now
+		}
+		stalled := kcpConn.writeIdle > 0 && now.Sub(acked) > kcpConn.writeIdle
+		if stalled {
+			kcpConn.reason = pkg.ErrIdleTimeout
+		}
+		kcpConn.mu.Unlock()
+		if dead || stalled {
+			kcpConn.Close()
+			return
+		}
+
+		select {
+		case <-ticker.C:
+		case <-kcpConn.closeChan:
+			return
+		}
+	}
+}
+
+// Close 关闭连接并通知对端，通知丢失时对端在ReadIdleTimeout后断开
+func (kcpConn *KCPConn) Close() {
+	kcpConn.close(true)
+}
+
+func (kcpConn *KCPConn) close(notify bool) {
+	if !atomic.CompareAndSwapInt32(&kcpConn.closeFlag, pkg.StatusRunning, pkg.StatusClosed) {
+		return
+	}
+	close(kcpConn.closeChan)
+	if notify {
+		kcpConn.output(kcp.FinPacket(kcpConn.conv))
+	}
+	if kcpConn.onClose != nil {
+		kcpConn.onClose(kcpConn)
+	}
+}
+
+// CloseGracefully 等待发送队列中的分片全部被对端确认后关闭，最多等待timeout
+func (kcpConn *KCPConn) CloseGracefully(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for !kcpConn.isClosed() && time.Now().Before(deadline) {
+		kcpConn.mu.Lock()
+		n := kcpConn.kcp.WaitSnd()
+		kcpConn.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	kcpConn.Close()
+}
+
+func (kcpConn *KCPConn) LocalAddr() net.Addr {
+	return kcpConn.conn.LocalAddr()
+}
+
+func (kcpConn *KCPConn) RemoteAddr() net.Addr {
+	return kcpConn.remote
+}
+
+func (kcpConn *KCPConn) Read(b []byte) (int, error) {
+	msg, err := kcpConn.ReadMsg()
+	if err != nil {
+		return 0, err
+	}
+	return copy(b, msg), nil
+}
+
+func (kcpConn *KCPConn) Write(b []byte) (int, error) {
+	if err := kcpConn.WriteMsg(b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// ReadMsg 读取一个完整的消息，UDP没有断开通知，readIdle时间内没有收到消息时返回超时错误
+func (kcpConn *KCPConn) ReadMsg() ([]byte, error) {
+	var idle time.Time
+	if kcpConn.readIdle > 0 {
+		idle = time.Now().Add(kcpConn.readIdle)
+	}
+
+	for {
+		if kcpConn.isClosed() {
+			return nil, kcpConn.closeErr()
+		}
+
+		kcpConn.mu.Lock()
+		msg := kcpConn.kcp.Recv()
+		deadline := kcpConn.readDeadline
+		kcpConn.mu.Unlock()
+
+		if msg != nil {
+			if uint32(len(msg)) > kcpConn.maxMsgLen {
+				return nil, pkg.ErrMessageTooLong
+			}
+			return msg, nil
+		}
+
+		if deadline.IsZero() || (!idle.IsZero() && idle.Before(deadline)) {
+			deadline = idle
+		}
+		if err := kcpConn.wait(deadline); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// wait 等待新的数据到达，deadline为零值时不超时
+func (kcpConn *KCPConn) wait(deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return timeoutError{}
+		}
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	select {
+	case <-kcpConn.readEvent:
+		return nil
+	case <-kcpConn.closeChan:
+		return kcpConn.closeErr()
+	case <-timeout:
+		return timeoutError{}
+	}
+}
+
+// WriteMsg 发送消息，等待发送的分片达到writeBuffer时认为对端无法及时接收，按照SlowConsumerOption处理
+func (kcpConn *KCPConn) WriteMsg(args ...[]byte) error {
+	if kcpConn.isClosed() {
+		return pkg.ErrConnClosed
+	}
+
+	var mLen uint32
+	for i := 0; i < len(args); i++ {
+		mLen += uint32(len(args[i]))
+	}
+
+	if mLen > kcpConn.maxMsgLen {
+		return pkg.ErrMessageTooLong
+	} else if mLen < 1 {
+		return pkg.ErrMessageTooShort
+	}
+
+	var mData []byte
+	switch len(args) {
+	case 1:
+		mData = args[0]
+	default:
+		mData = make([]byte, mLen)
+		at := 0
+		for _, m := range args {
+			copy(mData[at:], m)
+			at += len(m)
+		}
+	}
+
+	kcpConn.writeMu.Lock()
+	defer kcpConn.writeMu.Unlock()
+
+	if err := kcpConn.reserve(len(mData)); err != nil {
+		if err == pkg.ErrSlowConsumer {
+			kcpConn.mu.Lock()
+			kcpConn.reason = err
+			kcpConn.mu.Unlock()
+			log.Printf("disconnect %v: %v", kcpConn.remote, err)
+			kcpConn.Close()
+		}
+		return err
+	}
+
+	kcpConn.mu.Lock()
+	err := kcpConn.kcp.Send(mData)
+	if err == nil {
+		kcpConn.kcp.Flush(currentMs())
+	}
+	kcpConn.mu.Unlock()
+	return err
+}
+
+// reserve 等待发送的分片达到writeBuffer时按照SlowConsumerOption处理，返回nil时可以发送n字节
+// 返回pkg.ErrSlowConsumer时需要断开连接，SlowBlock在kcpConn.mu之外等待
+func (kcpConn *KCPConn) reserve(n int) error {
+	var deadline time.Time
+	for {
+		kcpConn.mu.Lock()
+		waitSnd, waitBytes := kcpConn.kcp.WaitSnd(), kcpConn.kcp.WaitSndBytes()
+		kcpConn.mu.Unlock()
+		if waitSnd < kcpConn.writeBuffer {
+			return nil
+		}
+
+		switch kcpConn.slow.Policy {
+		case SlowDrop:
+			atomic.AddUint64(&kcpConn.dropped, 1)
+			return pkg.ErrMessageDropped
+		case SlowCoalesce:
+			// KCP发送队列本身就会按照窗口合并发送
+			if waitBytes+n > kcpConn.slow.CoalesceMax {
+				return pkg.ErrSlowConsumer
+			}
+			return nil
+		case SlowBlock:
+			if deadline.IsZero() {
+				deadline = time.Now().Add(kcpConn.slow.BlockTimeout)
+			} else if time.Now().After(deadline) {
+				return pkg.ErrSlowConsumer
+			}
+			t := time.NewTimer(10 * time.Millisecond)
+			select {
+			case <-kcpConn.closeChan:
+				t.Stop()
+				return pkg.ErrConnClosed
+			case <-t.C:
+			}
+		default:
+			return pkg.ErrSlowConsumer
+		}
+	}
+}
+
+// closeErr 连接关闭后ReadMsg返回的错误
+func (kcpConn *KCPConn) closeErr() error {
+	kcpConn.mu.Lock()
+	defer kcpConn.mu.Unlock()
+	if kcpConn.reason != nil {
+		return kcpConn.reason
+	}
+	return pkg.ErrConnClosed
+}
+
+// Stats 发送统计
+func (kcpConn *KCPConn) Stats() ConnStats {
+	kcpConn.mu.Lock()
+	defer kcpConn.mu.Unlock()
+	return ConnStats{
+		QueuedBytes: int64(kcpConn.kcp.WaitSndBytes()),
+		Dropped:     atomic.LoadUint64(&kcpConn.dropped),
+	}
+}
+
+func (kcpConn *KCPConn) SetReadDeadline(t time.Time) error {
+	kcpConn.mu.Lock()
+	kcpConn.readDeadline = t
+	kcpConn.mu.Unlock()
+	return nil
+}
+
+// SetWriteDeadline 写入只进入KCP发送队列，不会阻塞，忽略写超时
+func (kcpConn *KCPConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
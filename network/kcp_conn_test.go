@@ -0,0 +1,270 @@
+package network
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pyihe/gogame/network/kcp"
+	"github.com/pyihe/gogame/pkg"
+)
+
+func TestKCPConn(t *testing.T) {
+	server, err := NewKCPServer(KCPServerOption{
+		Addr: "127.0.0.1:0",
+		KCP:  &KCPOption{NoDelay: true, Resend: 2, NoCongestion: true},
+	}, func(conn *KCPConn) Agent {
+		return &echoAgent{conn: conn}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Start()
+	defer server.Close()
+
+	agent := &recvAgent{recv: make(chan []byte, 10)}
+	connected := make(chan *KCPConn, 1)
+	client, err := NewKCPClient(KCPClientOption{
+		Addr: server.Addr().String(),
+		KCP:  &KCPOption{NoDelay: true, Resend: 2, NoCongestion: true},
+	}, func(conn *KCPConn) Agent {
+		agent.conn = conn
+		connected <- conn
+		return agent
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Start()
+	defer client.Close()
+
+	conn := <-connected
+	// 超过MTU的消息会被分片发送
+	large := bytes.Repeat([]byte("x"), 3000)
+	for _, msg := range [][]byte{[]byte("hello"), large} {
+		if err = conn.WriteMsg(msg[:1], msg[1:]); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case data := <-agent.recv:
+			if !bytes.Equal(data, msg) {
+				t.Fatalf("got %d bytes, want %d", len(data), len(msg))
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout")
+		}
+	}
+
+	if err = conn.WriteMsg(make([]byte, 5000)); err == nil {
+		t.Fatal("expected error for message over MsgMaxLen")
+	}
+}
+
+type errAgent struct {
+	conn Conn
+	err  chan error
+}
+
+func (a *errAgent) OnConnect() {}
+func (a *errAgent) OnClose()   {}
+func (a *errAgent) Run() {
+	for {
+		if _, err := a.conn.ReadMsg(); err != nil {
+			a.err <- err
+			return
+		}
+	}
+}
+
+func TestKCPWriteIdleTimeout(t *testing.T) {
+	accepted := make(chan *errAgent, 1)
+	server, err := NewKCPServer(KCPServerOption{
+		Addr:             "127.0.0.1:0",
+		WriteIdleTimeout: 100 * time.Millisecond,
+	}, func(conn *KCPConn) Agent {
+		a := &errAgent{conn: conn, err: make(chan error, 1)}
+		accepted <- a
+		return a
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Start()
+	defer server.Close()
+
+	// 客户端不再确认数据，服务端发送的消息超时未确认后断开
+	sendRawKCP(t, listenRawKCP(t), server.Addr(), 1, []byte("hello"))
+	a := <-accepted
+	if err = a.conn.WriteMsg([]byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err = <-a.err:
+		if err != pkg.ErrIdleTimeout {
+			t.Fatalf("got %v, want %v", err, pkg.ErrIdleTimeout)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("connection not closed")
+	}
+}
+
+func TestKCPSlowConsumer(t *testing.T) {
+	for _, policy := range []SlowPolicy{SlowDrop, SlowBlock} {
+		accepted := make(chan *KCPConn, 1)
+		server, err := NewKCPServer(KCPServerOption{
+			Addr:         "127.0.0.1:0",
+			WriteBuffer:  2,
+			SlowConsumer: &SlowConsumerOption{Policy: policy, BlockTimeout: 10 * time.Second},
+		}, func(conn *KCPConn) Agent {
+			accepted <- conn
+			return &errAgent{conn: conn, err: make(chan error, 1)}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.Start()
+
+		// 客户端不再确认数据，等待发送的分片达到WriteBuffer
+		sendRawKCP(t, listenRawKCP(t), server.Addr(), 1, []byte("hello"))
+		conn := <-accepted
+		for i := 0; i < 2; i++ {
+			if err = conn.WriteMsg([]byte("world")); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		switch policy {
+		case SlowDrop:
+			if err = conn.WriteMsg([]byte("world")); err != pkg.ErrMessageDropped {
+				t.Fatalf("drop: got %v, want %v", err, pkg.ErrMessageDropped)
+			}
+			if s := conn.Stats(); s.Dropped != 1 {
+				t.Fatalf("drop: unexpected stats %+v", s)
+			}
+		case SlowBlock:
+			// 写入阻塞等待期间关闭连接，写入返回错误
+			result := make(chan error, 1)
+			go func() {
+				result <- conn.WriteMsg([]byte("world"))
+			}()
+			time.Sleep(50 * time.Millisecond)
+			conn.Close()
+			select {
+			case err = <-result:
+				if err != pkg.ErrConnClosed {
+					t.Fatalf("block: got %v, want %v", err, pkg.ErrConnClosed)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("blocked write not returned")
+			}
+		}
+		server.Close()
+	}
+}
+
+func listenRawKCP(t *testing.T) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// sendRawKCP 使用会话号conv发送一个消息，之后不再收发数据，用于模拟消失的客户端
+func sendRawKCP(t *testing.T, conn net.PacketConn, addr net.Addr, conv uint32, msg []byte) {
+	k := kcp.New(conv, func(data []byte) {
+		conn.WriteTo(data, addr)
+	})
+	if err := k.Send(msg); err != nil {
+		t.Fatal(err)
+	}
+	// 第一次Update之后拥塞窗口才允许发送
+	k.Update(currentMs())
+	k.Flush(currentMs())
+}
+
+func TestKCPCloseNotify(t *testing.T) {
+	accepted := make(chan *errAgent, 1)
+	server, err := NewKCPServer(KCPServerOption{
+		Addr:            "127.0.0.1:0",
+		ReadIdleTimeout: 10 * time.Second,
+	}, func(conn *KCPConn) Agent {
+		a := &errAgent{conn: conn, err: make(chan error, 1)}
+		accepted <- a
+		return a
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Start()
+	defer server.Close()
+
+	connected := make(chan *KCPConn, 1)
+	client, err := NewKCPClient(KCPClientOption{
+		Addr: server.Addr().String(),
+	}, func(conn *KCPConn) Agent {
+		connected <- conn
+		return &echoAgent{conn: conn}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Start()
+	(<-connected).WriteMsg([]byte("hello"))
+	a := <-accepted
+
+	// 客户端关闭时通知服务端，不需要等待ReadIdleTimeout
+	client.Close()
+	select {
+	case err = <-a.err:
+		if err != io.EOF {
+			t.Fatalf("got %v, want %v", err, io.EOF)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("close not notified")
+	}
+}
+
+func TestKCPRecentConv(t *testing.T) {
+	accepted := make(chan *KCPConn, 2)
+	server, err := NewKCPServer(KCPServerOption{
+		Addr: "127.0.0.1:0",
+	}, func(conn *KCPConn) Agent {
+		accepted <- conn
+		return &errAgent{conn: conn, err: make(chan error, 1)}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Start()
+	defer server.Close()
+
+	raw := listenRawKCP(t)
+	sendRawKCP(t, raw, server.Addr(), 1, []byte("hello"))
+	(<-accepted).Close()
+
+	// 已经关闭的会话重传的数据不会建立新会话
+	sendRawKCP(t, raw, server.Addr(), 1, []byte("hello"))
+	select {
+	case <-accepted:
+		t.Fatal("closed conv accepted again")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	sendRawKCP(t, raw, server.Addr(), 2, []byte("hello"))
+	select {
+	case conn := <-accepted:
+		if conn.conv != 2 {
+			t.Fatalf("got conv %d, want 2", conn.conv)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("new conv not accepted")
+	}
+
+	if n := KCPWriteBuffer(10, 4096, nil); n != 10*3 {
+		t.Fatalf("got %d segments, want %d", n, 10*3)
+	}
+}
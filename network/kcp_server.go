@@ -0,0 +1,231 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pyihe/gogame/internal/gopool"
+	"github.com/pyihe/gogame/network/kcp"
+	"github.com/pyihe/gogame/pkg"
+	"github.com/pyihe/gogame/pkg/log"
+)
+
+// KCPServer 基于KCP的可靠UDP服务端，所有会话共用一个UDP socket
+// 收到未知地址发来的数据分片时建立新会话，会话ID(conv)由客户端决定
+// 会话关闭后ReadIdleTimeout内不再接受同一地址的同一conv，避免旧会话重传的数据建立新会话
+type KCPServer struct {
+	opts     atomic.Value
+	newAgent func(*KCPConn) Agent
+
+	conn net.PacketConn
+
+	// guard below
+	connsMu  sync.Mutex
+	conns    map[string]*KCPConn
+	recent   map[string]time.Time // 最近关闭的会话及其过期时间
+	pruneAt  time.Time            // 下次清理recent的时间
+	rejected int                  // 连接数已满时拒绝的数据包数量，记录日志后清零
+	logAt    time.Time            // 下次允许记录拒绝日志的时间
+
+	waiter sync.WaitGroup
+	closed int32
+}
+
+func NewKCPServer(opts KCPServerOption, newAgent func(*KCPConn) Agent) (*KCPServer, error) {
+	if newAgent == nil {
+		return nil, pkg.ErrNilNewAgent
+	}
+	opts.setDefault()
+
+	s := &KCPServer{
+		newAgent: newAgent,
+		conns:    make(map[string]*KCPConn),
+		recent:   make(map[string]time.Time),
+		closed:   pkg.StatusRunning,
+	}
+	s.swapOpts(&opts)
+	return s, nil
+}
+
+func (server *KCPServer) getOpts() *KCPServerOption {
+	return server.opts.Load().(*KCPServerOption)
+}
+
+func (server *KCPServer) swapOpts(opts *KCPServerOption) {
+	server.opts.Store(opts)
+}
+
+func (server *KCPServer) isClosed() bool {
+	return atomic.LoadInt32(&server.closed) == pkg.StatusClosed
+}
+
+func (server *KCPServer) Start() {
+	if server.isClosed() {
+		return
+	}
+
+	var err error
+	server.conn, err = net.ListenPacket("udp", server.getOpts().Addr)
+	if err != nil {
+		log.Fatalf("failed to listen udp: %s", err)
+	}
+
+	server.waiter.Add(1)
+	gopool.AddTask(func() {
+		defer server.waiter.Done()
+		server.readLoop()
+	})
+}
+
+func (server *KCPServer) readLoop() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := server.conn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return
+		}
+
+		if kcpConn := server.session(buf[:n], addr); kcpConn != nil {
+			kcpConn.input(buf[:n])
+		}
+	}
+}
+
+// session 获取数据对应的会话，没有时为携带数据的分片创建新会话
+// 同一地址使用新的conv发送数据时，说明客户端已经重新连接，关闭旧会话
+func (server *KCPServer) session(data []byte, addr net.Addr) *KCPConn {
+	conv, ok := kcp.Conv(data)
+	if !ok {
+		return nil
+	}
+
+	key := addr.String()
+	server.connsMu.Lock()
+	kcpConn := server.conns[key]
+	if kcpConn != nil && kcpConn.conv == conv {
+		server.connsMu.Unlock()
+		return kcpConn
+	}
+	if !kcp.IsPush(data) || server.isClosed() {
+		server.connsMu.Unlock()
+		return nil
+	}
+	if expire, ok := server.recent[recentKey(key, conv)]; ok && time.Now().Before(expire) {
+		server.connsMu.Unlock()
+		return nil
+	}
+
+	old := kcpConn
+	if old == nil && len(server.conns) >= server.getOpts().MaxConnNum {
+		// 被拒绝的客户端会持续重传，每秒最多记录一次
+		server.rejected++
+		now, rejected := time.Now(), server.rejected
+		logged := now.After(server.logAt)
+		if logged {
+			server.rejected, server.logAt = 0, now.Add(time.Second)
+		}
+		server.connsMu.Unlock()
+		if logged {
+			log.Printf("too many connections, %d packets rejected", rejected)
+		}
+		return nil
+	}
+
+	opts := server.getOpts()
+	kcpConn = newKCPConn(conv, server.conn, addr, opts.KCP, opts.WriteBuffer, opts.MsgMaxLen, opts.ReadIdleTimeout, opts.WriteIdleTimeout, opts.SlowConsumer, server.remove)
+	server.conns[key] = kcpConn
+	server.connsMu.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+
+	server.waiter.Add(1)
+	gopool.AddTask(func() {
+		defer server.waiter.Done()
+
+		agent := server.newAgent(kcpConn)
+		agent.OnConnect()
+		agent.Run()
+
+		kcpConn.Close()
+		agent.OnClose()
+	})
+	return kcpConn
+}
+
+// remove 会话关闭后从服务端移除并记录到recent，同一地址可能已经建立了新会话
+func (server *KCPServer) remove(kcpConn *KCPConn) {
+	key := kcpConn.remote.String()
+	now := time.Now()
+	ttl := server.getOpts().ReadIdleTimeout
+
+	server.connsMu.Lock()
+	if server.conns[key] == kcpConn {
+		delete(server.conns, key)
+	}
+	if now.After(server.pruneAt) {
+		for k, expire := range server.recent {
+			if now.After(expire) {
+				delete(server.recent, k)
+			}
+		}
+		server.pruneAt = now.Add(ttl)
+	}
+	server.recent[recentKey(key, kcpConn.conv)] = now.Add(ttl)
+	server.connsMu.Unlock()
+}
+
+func recentKey(addr string, conv uint32) string {
+	return fmt.Sprintf("%s/%d", addr, conv)
+}
+
+// Addr 返回监听的UDP地址
+func (server *KCPServer) Addr() net.Addr {
+	return server.conn.LocalAddr()
+}
+
+func (server *KCPServer) Close() {
+	if !atomic.CompareAndSwapInt32(&server.closed, pkg.StatusRunning, pkg.StatusClosed) {
+		return
+	}
+
+	server.connsMu.Lock()
+	conns := make([]*KCPConn, 0, len(server.conns))
+	for _, kcpConn := range server.conns {
+		conns = append(conns, kcpConn)
+	}
+	server.connsMu.Unlock()
+
+	// 关闭会话时需要通过UDP socket通知对端，之后才关闭socket
+	for _, kcpConn := range conns {
+		kcpConn.Close()
+	}
+	server.conn.Close()
+	server.waiter.Wait()
+}
+
+// Shutdown 不再建立新会话，等待每个会话已经发送的消息被对端确认后关闭，最多等待timeout
+func (server *KCPServer) Shutdown(timeout time.Duration) {
+	if !atomic.CompareAndSwapInt32(&server.closed, pkg.StatusRunning, pkg.StatusClosed) {
+		return
+	}
+
+	server.connsMu.Lock()
+	conns := make([]Conn, 0, len(server.conns))
+	for _, kcpConn := range server.conns {
+		conns = append(conns, kcpConn)
+	}
+	server.connsMu.Unlock()
+
+	// 确认需要通过UDP socket接收，所有会话关闭后才关闭socket
+	closeGracefully(conns, timeout)
+	server.conn.Close()
+	server.waiter.Wait()
+}
@@ -0,0 +1,176 @@
+package network
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pyihe/gogame/pkg"
+)
+
+// SlowPolicy 写缓冲区已满(对端接收太慢)时的处理策略
+type SlowPolicy int
+
+const (
+	SlowDisconnect SlowPolicy = iota // 断开连接，ReadMsg返回pkg.ErrSlowConsumer
+	SlowDrop                         // 丢弃当前消息，计入ConnStats.Dropped，WriteMsg返回pkg.ErrMessageDropped
+	SlowBlock                        // 阻塞等待写缓冲区有空位，超过BlockTimeout后断开连接
+	SlowCoalesce                     // 合并到一个批次中，写缓冲区清空后一次写出，批次超过CoalesceMax字节后断开连接
+)
+
+type SlowConsumerOption struct {
+	Policy SlowPolicy
+	// SlowBlock的最长等待时间，默认1秒
+	BlockTimeout time.Duration
+	// SlowCoalesce合并的最大字节数，默认1MB
+	CoalesceMax int
+}
+
+func (opt *SlowConsumerOption) setDefault() {
+	if opt == nil {
+		return
+	}
+	if opt.BlockTimeout <= 0 {
+		opt.BlockTimeout = time.Second
+	}
+	if opt.CoalesceMax <= 0 {
+		opt.CoalesceMax = 1 << 20
+	}
+}
+
+// ConnStats 连接的发送统计，用于区分网络状况差的客户端与服务端的问题
+type ConnStats struct {
+	QueuedBytes int64  // 等待发送的字节数
+	Dropped     uint64 // 因为写缓冲区已满而丢弃的消息数量
+}
+
+// sendQueue 按照SlowConsumerOption处理写缓冲区已满的情况，并记录发送统计，TCPConn与WSConn共用
+type sendQueue struct {
+	slow  *SlowConsumerOption
+	space chan struct{} // 写goroutine发送数据后通知SlowBlock等待中的写入
+
+	mu       sync.Mutex // guard batch, batchLen, reason
+	batch    [][]byte   // SlowCoalesce时写缓冲区满后合并的数据
+	batchLen int
+	reason   error // 断开原因
+
+	queued  int64
+	dropped uint64
+}
+
+func newSendQueue(slow *SlowConsumerOption) *sendQueue {
+	if slow == nil {
+		slow = &SlowConsumerOption{}
+		slow.setDefault()
+	}
+	return &sendQueue{slow: slow, space: make(chan struct{}, 1)}
+}
+
+// push 通过send将b放入写缓冲区，调用方需要保证同一时间只有一个push
+// send不阻塞地写入，写缓冲区已满时返回false，连接已经关闭时返回错误
+// 返回pkg.ErrSlowConsumer时需要断开连接，返回pkg.ErrMessageDropped时b被丢弃
+// SlowBlock在q.mu之外等待，done关闭(写goroutine退出)时不再等待
+func (q *sendQueue) push(send func([]byte) (bool, error), b []byte, done <-chan struct{}) error {
+	q.mu.Lock()
+	// 已经有合并的数据时直接合并，保证消息的顺序
+	if q.batchLen == 0 {
+		ok, err := send(b)
+		if err != nil || ok {
+			q.mu.Unlock()
+			if ok {
+				atomic.AddInt64(&q.queued, int64(len(b)))
+			}
+			return err
+		}
+	}
+
+	switch q.slow.Policy {
+	case SlowDrop:
+		q.mu.Unlock()
+		atomic.AddUint64(&q.dropped, 1)
+		return pkg.ErrMessageDropped
+	case SlowCoalesce:
+		defer q.mu.Unlock()
+		if q.batchLen+len(b) > q.slow.CoalesceMax {
+			return pkg.ErrSlowConsumer
+		}
+		q.batch = append(q.batch, b)
+		q.batchLen += len(b)
+		atomic.AddInt64(&q.queued, int64(len(b)))
+		return nil
+	case SlowBlock:
+		q.mu.Unlock()
+		return q.wait(send, b, done)
+	default:
+		q.mu.Unlock()
+		return pkg.ErrSlowConsumer
+	}
+}
+
+// wait 等待写缓冲区有空位后写入b，超过BlockTimeout时返回pkg.ErrSlowConsumer
+func (q *sendQueue) wait(send func([]byte) (bool, error), b []byte, done <-chan struct{}) error {
+	t := time.NewTimer(q.slow.BlockTimeout)
+	defer t.Stop()
+	for {
+		select {
+		case <-q.space:
+		case <-done:
+			return pkg.ErrConnClosed
+		case <-t.C:
+			return pkg.ErrSlowConsumer
+		}
+		ok, err := send(b)
+		if err != nil {
+			return err
+		}
+		if ok {
+			atomic.AddInt64(&q.queued, int64(len(b)))
+			return nil
+		}
+	}
+}
+
+// take 取出合并的数据，由写goroutine在写缓冲区清空后调用
+func (q *sendQueue) take() [][]byte {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	batch := q.batch
+	q.batch = nil
+	q.batchLen = 0
+	return batch
+}
+
+// sent 已经写入底层连接n字节
+func (q *sendQueue) sent(n int) {
+	atomic.AddInt64(&q.queued, -int64(n))
+	select {
+	case q.space <- struct{}{}:
+	default:
+	}
+}
+
+// setReason 记录断开原因，只保留第一个
+func (q *sendQueue) setReason(err error) {
+	q.mu.Lock()
+	if q.reason == nil {
+		q.reason = err
+	}
+	q.mu.Unlock()
+}
+
+// readErr 连接因为setReason的原因断开时，用该原因代替读取错误
+func (q *sendQueue) readErr(err error) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.reason != nil {
+		return q.reason
+	}
+	return err
+}
+
+func (q *sendQueue) stats() ConnStats {
+	return ConnStats{
+		QueuedBytes: atomic.LoadInt64(&q.queued),
+		Dropped:     atomic.LoadUint64(&q.dropped),
+	}
+}
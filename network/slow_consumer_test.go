@@ -0,0 +1,190 @@
+package network
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pyihe/gogame/pkg"
+)
+
+// chanSend 不阻塞地写入ch
+func chanSend(ch chan []byte) func([]byte) (bool, error) {
+	return func(b []byte) (bool, error) {
+		select {
+		case ch <- b:
+			return true, nil
+		default:
+			return false, nil
+		}
+	}
+}
+
+func TestSendQueuePolicy(t *testing.T) {
+	newQueue := func(policy SlowPolicy) *sendQueue {
+		opt := &SlowConsumerOption{Policy: policy, BlockTimeout: 20 * time.Millisecond, CoalesceMax: 8}
+		opt.setDefault()
+		return newSendQueue(opt)
+	}
+
+	ch := make(chan []byte, 1)
+	send := chanSend(ch)
+	q := newQueue(SlowDisconnect)
+	if err := q.push(send, []byte("a"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.push(send, []byte("b"), nil); err != pkg.ErrSlowConsumer {
+		t.Fatalf("disconnect: got %v", err)
+	}
+
+	q = newQueue(SlowDrop)
+	if err := q.push(send, []byte("b"), nil); err != pkg.ErrMessageDropped {
+		t.Fatalf("drop: got %v", err)
+	}
+	if s := q.stats(); s.Dropped != 1 || s.QueuedBytes != 0 {
+		t.Fatalf("drop: unexpected stats %+v", s)
+	}
+
+	q = newQueue(SlowBlock)
+	if err := q.push(send, []byte("b"), nil); err != pkg.ErrSlowConsumer {
+		t.Fatalf("block: got %v", err)
+	}
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		<-ch
+		q.sent(0)
+	}()
+	if err := q.push(send, []byte("b"), nil); err != nil {
+		t.Fatalf("block: got %v", err)
+	}
+	done := make(chan struct{})
+	close(done)
+	if err := q.push(send, []byte("b"), done); err != pkg.ErrConnClosed {
+		t.Fatalf("block: got %v", err)
+	}
+
+	// 合并期间即使写缓冲区有空位也进入批次，保证顺序
+	q = newQueue(SlowCoalesce)
+	for _, b := range []string{"c", "d"} {
+		if err := q.push(send, []byte(b), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-ch
+	if err := q.push(send, []byte("e"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(ch) != 0 {
+		t.Fatal("message bypassed the batch")
+	}
+	if err := q.push(send, []byte("123456789"), nil); err != pkg.ErrSlowConsumer {
+		t.Fatalf("coalesce: got %v", err)
+	}
+	if batch := bytes.Join(q.take(), nil); string(batch) != "cde" {
+		t.Fatalf("coalesce: got %q", batch)
+	}
+	if s := q.stats(); s.QueuedBytes != 3 {
+		t.Fatalf("coalesce: unexpected stats %+v", s)
+	}
+}
+
+func TestSlowConsumerDisconnect(t *testing.T) {
+	agent := &idleAgent{err: make(chan error, 1)}
+	connected := make(chan *TCPConn, 1)
+	server, err := NewTCPServer(TCPServerOptions{
+		Addr:        "127.0.0.1:0",
+		WriteBuffer: 1,
+		MsgOption:   &TCPMsgOption{MsgHeaderLen: 4},
+	}, func(conn *TCPConn) Agent {
+		agent.conn = conn
+		connected <- conn
+		return agent
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Start()
+	defer server.Close()
+
+	// 客户端不读取数据
+	conn, err := net.Dial("tcp", server.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tcpConn := <-connected
+	payload := make([]byte, 64*1024)
+	for i := 0; i < 1000; i++ {
+		if tcpConn.WriteMsg(payload) != nil {
+			break
+		}
+	}
+	select {
+	case err = <-agent.err:
+		if err != pkg.ErrSlowConsumer {
+			t.Fatalf("got %v, want %v", err, pkg.ErrSlowConsumer)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("slow consumer not disconnected")
+	}
+}
+
+func TestSlowConsumerBlockClose(t *testing.T) {
+	connected := make(chan *TCPConn, 1)
+	server, err := NewTCPServer(TCPServerOptions{
+		Addr:         "127.0.0.1:0",
+		WriteBuffer:  1,
+		MsgOption:    &TCPMsgOption{MsgHeaderLen: 4},
+		SlowConsumer: &SlowConsumerOption{Policy: SlowBlock, BlockTimeout: 10 * time.Second},
+	}, func(conn *TCPConn) Agent {
+		connected <- conn
+		return &idleAgent{conn: conn, err: make(chan error, 1)}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Start()
+	defer server.Close()
+
+	// 客户端不读取数据
+	conn, err := net.Dial("tcp", server.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tcpConn := <-connected
+	result := make(chan error, 1)
+	go func() {
+		payload := make([]byte, 64*1024)
+		for {
+			if err := tcpConn.WriteMsg(payload); err != nil {
+				result <- err
+				return
+			}
+		}
+	}()
+
+	// 写入阻塞等待期间关闭连接不会被阻塞，写入返回错误
+	time.Sleep(100 * time.Millisecond)
+	closed := make(chan struct{})
+	go func() {
+		tcpConn.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("close blocked by SlowBlock writer")
+	}
+	select {
+	case err = <-result:
+		if err != pkg.ErrConnClosed {
+			t.Fatalf("got %v, want %v", err, pkg.ErrConnClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("blocked write not returned")
+	}
+}
@@ -23,8 +23,9 @@ type TCPClient struct {
 	mu    sync.RWMutex
 	conns tcpConnSet
 
-	wg     sync.WaitGroup
-	closed int32
+	wg        sync.WaitGroup
+	closed    int32
+	closeChan chan struct{}
 }
 
 func NewTCPClient(opts TCPClientOption, newAgent func(*TCPConn) Agent) (*TCPClient, error) {
@@ -45,6 +46,7 @@ func NewTCPClient(opts TCPClientOption, newAgent func(*TCPConn) Agent) (*TCPClie
 		newAgent:  newAgent,
 		conns:     make(tcpConnSet),
 		msgParser: packet.NewParser(msgOptions...),
+		closeChan: make(chan struct{}),
 	}
 
 	c.swapOpts(&opts)
@@ -82,6 +84,18 @@ func (client *TCPClient) Start() {
 	}
 }
 
+// sleep 等待d，客户端关闭时立即返回false
+func (client *TCPClient) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-client.closeChan:
+		return false
+	}
+}
+
 func (client *TCPClient) dial() net.Conn {
 	const maxRetry = 3
 	var err error
@@ -97,13 +111,16 @@ func (client *TCPClient) dial() net.Conn {
 		if err == nil || client.isClosed() {
 			return conn
 		}
-		if retry >= maxRetry {
+		// 开启了自动重连时，一直重试直到连接成功或者客户端关闭
+		if retry >= maxRetry && !client.getOpts().AutoReconnect {
 			log.Printf("tcp connect(%v): retry timeout", client.getOpts().Addr)
 			return conn
 		}
 		retry += 1
 		log.Printf("failed to connect TCP(%s) error: %v, retry: %d, maxRetry: %d", client.getOpts().Addr, err, retry, maxRetry)
-		time.Sleep(pkg.Get(nil, retry))
+		if !client.sleep(pkg.Get(nil, retry)) {
+			return nil
+		}
 		continue
 	}
 }
@@ -126,7 +143,24 @@ reconnect:
 	client.conns[conn] = struct{}{}
 	client.mu.Unlock()
 
-	tcpConn := newTCPConn(conn, client.getOpts().WriteBuffer, client.msgParser)
+	var c *sessionCipher
+	if cryptoOpt := client.getOpts().CryptoOption; cryptoOpt != nil {
+		var err error
+		c, err = handshake(conn, client.msgParser, true, cryptoOpt.HandshakeTimeout)
+		if err != nil {
+			log.Printf("handshake with %v error: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			client.mu.Lock()
+			delete(client.conns, conn)
+			client.mu.Unlock()
+			if client.getOpts().AutoReconnect && client.sleep(client.getOpts().ConnectInterval) {
+				goto reconnect
+			}
+			return
+		}
+	}
+
+	tcpConn := newTCPConn(conn, client.getOpts().WriteBuffer, client.msgParser, c, 0, 0, nil)
 	agent := client.newAgent(tcpConn)
 	agent.OnConnect()
 	agent.Run()
@@ -138,8 +172,7 @@ reconnect:
 	client.mu.Unlock()
 	agent.OnClose()
 
-	if client.getOpts().AutoReconnect {
-		time.Sleep(client.getOpts().ConnectInterval)
+	if client.getOpts().AutoReconnect && client.sleep(client.getOpts().ConnectInterval) {
 		goto reconnect
 	}
 }
@@ -148,6 +181,7 @@ func (client *TCPClient) Close() {
 	if !atomic.CompareAndSwapInt32(&client.closed, pkg.StatusRunning, pkg.StatusClosed) {
 		return
 	}
+	close(client.closeChan)
 	client.mu.RLock()
 	for conn := range client.conns {
 		conn.Close()
@@ -29,6 +29,18 @@ type TCPMsgOption struct {
 	LittleEndian bool
 }
 
+// CryptoOption 非TLS连接的会话加密配置，客户端与服务端需要同时开启
+type CryptoOption struct {
+	// 密钥交换的超时时间
+	HandshakeTimeout time.Duration
+}
+
+func (opt *CryptoOption) setDefault() {
+	if opt != nil && opt.HandshakeTimeout <= 0 {
+		opt.HandshakeTimeout = 5 * time.Second
+	}
+}
+
 type TCPServerOptions struct {
 	// 服务相关属性配置
 	// TCP地址
@@ -39,10 +51,21 @@ type TCPServerOptions struct {
 	MaxConnNum int
 	// 写缓冲区大小
 	WriteBuffer int
+	// 读空闲超时，超过该时间没有收到任何数据则断开连接，为0时不限制
+	ReadIdleTimeout time.Duration
+	// 写空闲超时，单次写入阻塞超过该时间(对端长时间不读取)则断开连接，为0时不限制
+	WriteIdleTimeout time.Duration
 
 	// TLS相关配置
 	TLSOption *TLSOption
 
+	// 会话加密配置，为nil时不加密
+	CryptoOption *CryptoOption
+
+	// 写缓冲区已满时的处理策略，为nil时断开连接
+	// 开启会话加密时丢弃消息会导致对端无法解密之后的消息，SlowDrop按照SlowDisconnect处理
+	SlowConsumer *SlowConsumerOption
+
 	// 消息相关配置
 	MsgOption *TCPMsgOption
 }
@@ -69,6 +92,8 @@ func (opt *TCPServerOptions) setDefault() {
 	if opt.MaxRetry <= 0 {
 		opt.MaxRetry = 7
 	}
+	opt.CryptoOption.setDefault()
+	opt.SlowConsumer.setDefault()
 }
 
 type TCPClientOption struct {
@@ -80,6 +105,8 @@ type TCPClientOption struct {
 
 	TLSOption *TLSOption
 
+	CryptoOption *CryptoOption
+
 	MsgOption *TCPMsgOption
 }
 
@@ -93,6 +120,7 @@ func (opt *TCPClientOption) setDefault() {
 	if opt.WriteBuffer <= 0 {
 		opt.WriteBuffer = 100
 	}
+	opt.CryptoOption.setDefault()
 
 	if opt.MsgOption == nil {
 		opt.MsgOption = &TCPMsgOption{}
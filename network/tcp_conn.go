@@ -1,27 +1,43 @@
 package network
 
 import (
+	"bytes"
 	"net"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/pyihe/gogame/internal/gopool"
 	"github.com/pyihe/gogame/network/packet"
 	"github.com/pyihe/gogame/pkg"
+	"github.com/pyihe/gogame/pkg/log"
 )
 
 type TCPConn struct {
 	msgParser packet.Parser
 	conn      net.Conn
+	mu        sync.Mutex // guard writeChan的写入与关闭
+	writeMu   sync.Mutex // 保证写入的顺序，SlowBlock等待期间不阻塞关闭
 	writeChan chan []byte
+	writeDone chan struct{}
+	queue     *sendQueue // 写缓冲区满时的处理与发送统计
 	closeFlag int32
+	cipher    *sessionCipher // 会话加密，为nil时不加密
+	readIdle  time.Duration  // 读空闲超时
+	writeIdle time.Duration  // 写空闲超时
 }
 
-func newTCPConn(conn net.Conn, writeBuffer int, msgParser packet.Parser) *TCPConn {
+func newTCPConn(conn net.Conn, writeBuffer int, msgParser packet.Parser, cipher *sessionCipher, readIdle, writeIdle time.Duration, slow *SlowConsumerOption) *TCPConn {
 	tcpConn := new(TCPConn)
 	tcpConn.conn = conn
 	tcpConn.writeChan = make(chan []byte, writeBuffer)
+	tcpConn.writeDone = make(chan struct{})
+	tcpConn.queue = newSendQueue(slow)
 	tcpConn.msgParser = msgParser
+	tcpConn.cipher = cipher
+	tcpConn.readIdle = readIdle
+	tcpConn.writeIdle = writeIdle
+	tcpConn.closeFlag = pkg.StatusRunning
 
 	gopool.AddTask(func() {
 		tcpConn.writeLoop()
@@ -35,40 +51,110 @@ func (tcpConn *TCPConn) isClosed() bool {
 }
 
 func (tcpConn *TCPConn) writeLoop() {
+	defer close(tcpConn.writeDone)
 	for b := range tcpConn.writeChan {
-		if b == nil {
+		if b != nil && !tcpConn.write(net.Buffers{b}) {
 			break
 		}
-		_, err := tcpConn.conn.Write(b)
-		if err != nil {
+		// 写缓冲区清空后写出合并的数据
+		if len(tcpConn.writeChan) == 0 || b == nil {
+			if batch := tcpConn.queue.take(); len(batch) > 0 && !tcpConn.write(batch) {
+				break
+			}
+		}
+		if b == nil {
 			break
 		}
 	}
 }
 
+func (tcpConn *TCPConn) write(bufs net.Buffers) bool {
+	if tcpConn.writeIdle > 0 {
+		tcpConn.conn.SetWriteDeadline(time.Now().Add(tcpConn.writeIdle))
+	}
+	n, err := bufs.WriteTo(tcpConn.conn)
+	tcpConn.queue.sent(int(n))
+	if err != nil {
+		tcpConn.writeFailed(err)
+		return false
+	}
+	return true
+}
+
+// writeFailed 写入失败时断开连接，写空闲超时的原因为pkg.ErrIdleTimeout
+func (tcpConn *TCPConn) writeFailed(err error) {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		tcpConn.queue.setReason(pkg.ErrIdleTimeout)
+	}
+	tcpConn.doDestroy()
+}
+
 func (tcpConn *TCPConn) doDestroy() {
+	tcpConn.mu.Lock()
+	defer tcpConn.mu.Unlock()
+	tcpConn.destroy()
+}
+
+func (tcpConn *TCPConn) destroy() {
 	if !atomic.CompareAndSwapInt32(&tcpConn.closeFlag, pkg.StatusRunning, pkg.StatusClosed) {
 		return
 	}
-	tcpConn.conn.(*net.TCPConn).SetLinger(0)
+	if conn, ok := tcpConn.conn.(*net.TCPConn); ok {
+		conn.SetLinger(0)
+	}
 	tcpConn.conn.Close()
 	close(tcpConn.writeChan)
 }
 
-func (tcpConn *TCPConn) WriteBytes(b []byte) {
-	if b == nil {
+func (tcpConn *TCPConn) CloseGracefully(timeout time.Duration) {
+	tcpConn.mu.Lock()
+	if !atomic.CompareAndSwapInt32(&tcpConn.closeFlag, pkg.StatusRunning, pkg.StatusClosed) {
+		tcpConn.mu.Unlock()
 		return
 	}
-	// conn已经关闭
+	tcpConn.mu.Unlock()
+
+	// 已经标记为关闭，不会再有写入，等待发送完毕时不需要持有锁
+	flush(tcpConn.writeChan, tcpConn.writeDone, timeout)
+	tcpConn.conn.Close()
+	close(tcpConn.writeChan)
+}
+
+// trySend 不阻塞地将b放入写缓冲区
+func (tcpConn *TCPConn) trySend(b []byte) (bool, error) {
+	tcpConn.mu.Lock()
+	defer tcpConn.mu.Unlock()
 	if tcpConn.isClosed() {
-		return
+		return false, pkg.ErrConnClosed
 	}
+	select {
+	case tcpConn.writeChan <- b:
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+// WriteBytes 将已经打包的b放入写缓冲区，返回pkg.ErrSlowConsumer时连接已经断开，返回pkg.ErrMessageDropped时b被丢弃
+func (tcpConn *TCPConn) WriteBytes(b []byte) error {
+	if b == nil {
+		return nil
+	}
+	tcpConn.writeMu.Lock()
+	defer tcpConn.writeMu.Unlock()
 
-	if len(tcpConn.writeChan) == cap(tcpConn.writeChan) {
+	err := tcpConn.queue.push(tcpConn.trySend, b, tcpConn.writeDone)
+	if err == pkg.ErrSlowConsumer {
+		log.Printf("disconnect %v: %v, %d bytes queued", tcpConn.conn.RemoteAddr(), err, tcpConn.queue.stats().QueuedBytes)
+		tcpConn.queue.setReason(err)
 		tcpConn.doDestroy()
-		return
 	}
-	tcpConn.writeChan <- b
+	return err
+}
+
+// Stats 发送统计
+func (tcpConn *TCPConn) Stats() ConnStats {
+	return tcpConn.queue.stats()
 }
 
 func (tcpConn *TCPConn) SetReadDeadline(t time.Time) error {
@@ -103,18 +189,52 @@ func (tcpConn *TCPConn) ReadMsg() ([]byte, error) {
 	if tcpConn.isClosed() {
 		return nil, pkg.ErrConnClosed
 	}
-	return tcpConn.msgParser.UnPacket(tcpConn.conn)
+	if tcpConn.readIdle > 0 {
+		tcpConn.conn.SetReadDeadline(time.Now().Add(tcpConn.readIdle))
+	}
+	data, err := tcpConn.msgParser.UnPacket(tcpConn.conn)
+	if err != nil {
+		return nil, tcpConn.queue.readErr(err)
+	}
+	if tcpConn.cipher == nil {
+		return data, nil
+	}
+	return tcpConn.cipher.decrypt(data)
 }
 
 func (tcpConn *TCPConn) WriteMsg(args ...[]byte) error {
 	if tcpConn.isClosed() {
 		return pkg.ErrConnClosed
 	}
+	if tcpConn.cipher != nil {
+		return tcpConn.writeEncrypted(args...)
+	}
 	mData, err := tcpConn.msgParser.Packet(args...)
 	if err != nil {
 		return err
 	}
 
-	tcpConn.WriteBytes(mData)
-	return nil
+	return tcpConn.WriteBytes(mData)
+}
+
+// writeEncrypted 加密后写入，加密与入队在同一把锁内完成，保证入队的顺序与序号一致
+// 加密后的消息没有进入写缓冲区时序号已经使用，之后的消息对端都无法解密，需要断开连接
+func (tcpConn *TCPConn) writeEncrypted(args ...[]byte) error {
+	c := tcpConn.cipher
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	mData, err := tcpConn.msgParser.Packet(c.encrypt(bytes.Join(args, nil)))
+	if err != nil {
+		tcpConn.doDestroy()
+		return err
+	}
+	err = tcpConn.WriteBytes(mData)
+	if err == pkg.ErrMessageDropped {
+		err = pkg.ErrSlowConsumer
+		log.Printf("disconnect %v: %v, encrypted message dropped", tcpConn.conn.RemoteAddr(), err)
+		tcpConn.queue.setReason(err)
+		tcpConn.doDestroy()
+	}
+	return err
 }
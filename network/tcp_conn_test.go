@@ -0,0 +1,142 @@
+package network
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pyihe/gogame/pkg"
+)
+
+type idleAgent struct {
+	conn Conn
+	err  chan error
+}
+
+func (a *idleAgent) OnConnect() {}
+func (a *idleAgent) OnClose()   {}
+func (a *idleAgent) Run() {
+	_, err := a.conn.ReadMsg()
+	a.err <- err
+}
+
+func TestReadIdleTimeout(t *testing.T) {
+	agent := &idleAgent{err: make(chan error, 1)}
+	server, err := NewTCPServer(TCPServerOptions{
+		Addr:            "127.0.0.1:0",
+		ReadIdleTimeout: 50 * time.Millisecond,
+	}, func(conn *TCPConn) Agent {
+		agent.conn = conn
+		return agent
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Start()
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	select {
+	case err = <-agent.err:
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Fatalf("got %v, want timeout", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("idle connection not closed")
+	}
+}
+
+func TestWriteIdleTimeout(t *testing.T) {
+	agent := &idleAgent{err: make(chan error, 1)}
+	connected := make(chan *TCPConn, 1)
+	server, err := NewTCPServer(TCPServerOptions{
+		Addr:             "127.0.0.1:0",
+		WriteIdleTimeout: 50 * time.Millisecond,
+		MsgOption:        &TCPMsgOption{MsgHeaderLen: 4},
+		SlowConsumer:     &SlowConsumerOption{Policy: SlowBlock, BlockTimeout: 10 * time.Second},
+	}, func(conn *TCPConn) Agent {
+		agent.conn = conn
+		connected <- conn
+		return agent
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Start()
+	defer server.Close()
+
+	// 客户端不读取数据
+	conn, err := net.Dial("tcp", server.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tcpConn := <-connected
+	go func() {
+		payload := make([]byte, 64*1024)
+		for tcpConn.WriteMsg(payload) == nil {
+		}
+	}()
+
+	select {
+	case err = <-agent.err:
+		if err != pkg.ErrIdleTimeout {
+			t.Fatalf("got %v, want %v", err, pkg.ErrIdleTimeout)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("write idle connection not closed")
+	}
+}
+
+func TestShutdownFlushesWrites(t *testing.T) {
+	connected := make(chan *TCPConn, 1)
+	server, err := NewTCPServer(TCPServerOptions{
+		Addr:        "127.0.0.1:0",
+		WriteBuffer: 2000,
+	}, func(conn *TCPConn) Agent {
+		connected <- conn
+		return &idleAgent{conn: conn, err: make(chan error, 1)}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Start()
+
+	conn, err := net.Dial("tcp", server.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	const n = 1000
+	payload := make([]byte, 1024)
+	tcpConn := <-connected
+	for i := 0; i < n; i++ {
+		if err = tcpConn.WriteMsg(payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		server.Shutdown(time.Second)
+		close(done)
+	}()
+
+	// 关闭前写入的消息全部送达，之后读到EOF
+	parser := server.msgParser
+	for i := 0; i < n; i++ {
+		if _, err = parser.UnPacket(conn); err != nil {
+			t.Fatalf("message %d lost: %v", i, err)
+		}
+	}
+	if _, err = parser.UnPacket(conn); err == nil {
+		t.Fatal("connection not closed")
+	}
+	<-done
+}
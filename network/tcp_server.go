@@ -19,6 +19,9 @@ import (
 
 type tcpConnSet map[net.Conn]struct{}
 
+// tcpConnMap 服务端的连接，握手完成前value为nil
+type tcpConnMap map[net.Conn]*TCPConn
+
 type TCPServer struct {
 	opts     atomic.Value
 	newAgent func(*TCPConn) Agent
@@ -30,7 +33,7 @@ type TCPServer struct {
 
 	// guard below
 	connsMu sync.RWMutex
-	conns   tcpConnSet
+	conns   tcpConnMap
 
 	waiter sync.WaitGroup
 	closed int32
@@ -53,7 +56,7 @@ func NewTCPServer(opts TCPServerOptions, newAgent func(*TCPConn) Agent) (*TCPSer
 
 	s := &TCPServer{
 		newAgent:  newAgent,
-		conns:     make(tcpConnSet),
+		conns:     make(tcpConnMap),
 		msgParser: packet.NewParser(msgOptions...),
 		closed:    pkg.StatusRunning,
 	}
@@ -120,7 +123,13 @@ func (server *TCPServer) Start() {
 			}
 			retryNum = 0
 
+			// Close与Shutdown会将conns置为nil，需要在锁内确认服务端没有关闭
 			server.connsMu.Lock()
+			if server.isClosed() {
+				server.connsMu.Unlock()
+				conn.Close()
+				return
+			}
 			if existCount := len(server.conns); existCount >= server.getOpts().MaxConnNum {
 				server.connsMu.Unlock()
 				conn.Close()
@@ -128,13 +137,39 @@ func (server *TCPServer) Start() {
 				continue
 			}
 
-			server.conns[conn] = struct{}{}
+			server.conns[conn] = nil
 			server.connsMu.Unlock()
 
-			tcpConn := newTCPConn(conn, server.getOpts().WriteBuffer, server.msgParser)
-			agent := server.newAgent(tcpConn)
 			server.waiter.Add(1)
 			gopool.AddTask(func() {
+				defer server.waiter.Done()
+
+				// 握手在连接自己的goroutine中进行，不阻塞accept
+				var c *sessionCipher
+				if cryptoOpt := server.getOpts().CryptoOption; cryptoOpt != nil {
+					var err error
+					c, err = handshake(conn, server.msgParser, false, cryptoOpt.HandshakeTimeout)
+					if err != nil {
+						log.Printf("handshake with %v error: %v", conn.RemoteAddr(), err)
+						conn.Close()
+						server.connsMu.Lock()
+						delete(server.conns, conn)
+						server.connsMu.Unlock()
+						return
+					}
+				}
+
+				tcpConn := newTCPConn(conn, server.getOpts().WriteBuffer, server.msgParser, c, server.getOpts().ReadIdleTimeout, server.getOpts().WriteIdleTimeout, server.getOpts().SlowConsumer)
+				server.connsMu.Lock()
+				if server.isClosed() {
+					server.connsMu.Unlock()
+					tcpConn.Close()
+					return
+				}
+				server.conns[conn] = tcpConn
+				server.connsMu.Unlock()
+
+				agent := server.newAgent(tcpConn)
 				agent.OnConnect()
 				agent.Run()
 
@@ -143,25 +178,51 @@ func (server *TCPServer) Start() {
 				delete(server.conns, conn)
 				server.connsMu.Unlock()
 				agent.OnClose()
-
-				server.waiter.Done()
 			})
 		}
 	})
 }
 
+// Addr 返回监听的地址
+func (server *TCPServer) Addr() net.Addr {
+	return server.listener.Addr()
+}
+
 func (server *TCPServer) Close() {
 	if !atomic.CompareAndSwapInt32(&server.closed, pkg.StatusRunning, pkg.StatusClosed) {
 		return
 	}
 	server.listener.Close()
 
-	server.connsMu.RLock()
+	server.connsMu.Lock()
 	for conn := range server.conns {
 		conn.Close()
 	}
 	server.conns = nil
-	server.connsMu.RUnlock()
+	server.connsMu.Unlock()
+	server.waiter.Wait()
+}
+
+// Shutdown 停止接受新连接，等待每个连接已经写入的消息发送完毕后关闭，最多等待timeout
+func (server *TCPServer) Shutdown(timeout time.Duration) {
+	if !atomic.CompareAndSwapInt32(&server.closed, pkg.StatusRunning, pkg.StatusClosed) {
+		return
+	}
+	server.listener.Close()
+
+	var conns []Conn
+	server.connsMu.Lock()
+	for conn, tcpConn := range server.conns {
+		if tcpConn == nil {
+			conn.Close()
+			continue
+		}
+		conns = append(conns, tcpConn)
+	}
+	server.conns = nil
+	server.connsMu.Unlock()
+
+	closeGracefully(conns, timeout)
 	server.waiter.Wait()
 }
 
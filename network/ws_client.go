@@ -116,7 +116,7 @@ reconnect:
 	client.conns[conn] = struct{}{}
 	client.mu.Unlock()
 
-	wsConn := newWSConn(conn, client.getOpts().WriteBuffer, client.getOpts().MsgMaxLen)
+	wsConn := newWSConn(conn, client.getOpts().WriteBuffer, client.getOpts().MsgMaxLen, client.getOpts().TextMode, 0, 0, nil)
 	agent := client.newAgent(wsConn)
 	agent.OnConnect()
 	agent.Run()
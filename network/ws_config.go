@@ -12,6 +12,12 @@ type WSServerOption struct {
 	MsgMaxLen   uint32
 	HTTPTimeout time.Duration
 	TLSOption   *TLSOption
+	TextMode    bool // 是否使用文本帧发送消息
+
+	ReadIdleTimeout  time.Duration // 读空闲超时，超过该时间没有收到任何数据则断开连接，为0时不限制
+	WriteIdleTimeout time.Duration // 写空闲超时，单次写入阻塞超过该时间(对端长时间不读取)则断开连接，为0时不限制
+
+	SlowConsumer *SlowConsumerOption // 写缓冲区已满时的处理策略，为nil时断开连接
 }
 
 func (opt *WSServerOption) setDefault() {
@@ -29,6 +35,7 @@ func (opt *WSServerOption) setDefault() {
 	if opt.HTTPTimeout <= 0 {
 		opt.HTTPTimeout = 10 * time.Second
 	}
+	opt.SlowConsumer.setDefault()
 }
 
 type WSClientOption struct {
@@ -39,6 +46,7 @@ type WSClientOption struct {
 	MsgMaxLen        uint32
 	WriteBuffer      int
 	HandshakeTimeout time.Duration
+	TextMode         bool // 是否使用文本帧发送消息
 
 	TLSOption *TLSOption
 }
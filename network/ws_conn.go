@@ -2,26 +2,44 @@ package network
 
 import (
 	"net"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/pyihe/gogame/internal/gopool"
 	"github.com/pyihe/gogame/pkg"
+	"github.com/pyihe/gogame/pkg/log"
 )
 
 type WSConn struct {
 	conn      *websocket.Conn
+	mu        sync.Mutex // guard writeChan的写入与关闭
+	writeMu   sync.Mutex // 保证写入的顺序，SlowBlock等待期间不阻塞关闭
 	writeChan chan []byte
+	writeDone chan struct{}
+	queue     *sendQueue // 写缓冲区满时的处理与发送统计
 	maxMsgLen uint32
 	closeFlag int32
+	msgType   int           // 发送消息使用的帧类型
+	readIdle  time.Duration // 读空闲超时
+	writeIdle time.Duration // 写空闲超时
 }
 
-func newWSConn(conn *websocket.Conn, writeBuffer int, maxMsgLen uint32) *WSConn {
+func newWSConn(conn *websocket.Conn, writeBuffer int, maxMsgLen uint32, textMode bool, readIdle, writeIdle time.Duration, slow *SlowConsumerOption) *WSConn {
 	wsConn := new(WSConn)
 	wsConn.conn = conn
 	wsConn.writeChan = make(chan []byte, writeBuffer)
+	wsConn.writeDone = make(chan struct{})
+	wsConn.queue = newSendQueue(slow)
 	wsConn.maxMsgLen = maxMsgLen
+	wsConn.readIdle = readIdle
+	wsConn.writeIdle = writeIdle
+	wsConn.closeFlag = pkg.StatusRunning
+	wsConn.msgType = websocket.BinaryMessage
+	if textMode {
+		wsConn.msgType = websocket.TextMessage
+	}
 
 	gopool.AddTask(func() {
 		wsConn.writeLoop()
@@ -34,23 +52,58 @@ func (wsConn *WSConn) isClosed() bool {
 }
 
 func (wsConn *WSConn) writeLoop() {
+	defer close(wsConn.writeDone)
 	for b := range wsConn.writeChan {
-		if b == nil {
+		if b != nil && !wsConn.write(b) {
 			break
 		}
-
-		err := wsConn.conn.WriteMessage(websocket.BinaryMessage, b)
-		if err != nil {
+		// 写缓冲区清空后写出合并的数据，每个消息仍然是单独的帧
+		if len(wsConn.writeChan) == 0 || b == nil {
+			for _, m := range wsConn.queue.take() {
+				if !wsConn.write(m) {
+					return
+				}
+			}
+		}
+		if b == nil {
 			break
 		}
 	}
 }
 
+func (wsConn *WSConn) write(b []byte) bool {
+	if wsConn.writeIdle > 0 {
+		wsConn.conn.SetWriteDeadline(time.Now().Add(wsConn.writeIdle))
+	}
+	if err := wsConn.conn.WriteMessage(wsConn.msgType, b); err != nil {
+		wsConn.writeFailed(err)
+		return false
+	}
+	wsConn.queue.sent(len(b))
+	return true
+}
+
+// writeFailed 写入失败时断开连接，写空闲超时的原因为pkg.ErrIdleTimeout
+func (wsConn *WSConn) writeFailed(err error) {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		wsConn.queue.setReason(pkg.ErrIdleTimeout)
+	}
+	wsConn.doDestroy()
+}
+
 func (wsConn *WSConn) doDestroy() {
+	wsConn.mu.Lock()
+	defer wsConn.mu.Unlock()
+	wsConn.destroy()
+}
+
+func (wsConn *WSConn) destroy() {
 	if !atomic.CompareAndSwapInt32(&wsConn.closeFlag, pkg.StatusRunning, pkg.StatusClosed) {
 		return
 	}
-	wsConn.conn.UnderlyingConn().(*net.TCPConn).SetLinger(0)
+	if conn, ok := wsConn.conn.UnderlyingConn().(*net.TCPConn); ok {
+		conn.SetLinger(0)
+	}
 	wsConn.conn.Close()
 	close(wsConn.writeChan)
 }
@@ -59,19 +112,59 @@ func (wsConn *WSConn) Close() {
 	wsConn.doDestroy()
 }
 
-func (wsConn *WSConn) doWrite(b []byte) {
-	if b == nil {
+// TextMode 是否使用文本帧发送消息，读取时两种帧都接受
+func (wsConn *WSConn) TextMode() bool {
+	return wsConn.msgType == websocket.TextMessage
+}
+
+func (wsConn *WSConn) CloseGracefully(timeout time.Duration) {
+	wsConn.mu.Lock()
+	if !atomic.CompareAndSwapInt32(&wsConn.closeFlag, pkg.StatusRunning, pkg.StatusClosed) {
+		wsConn.mu.Unlock()
 		return
 	}
+	wsConn.mu.Unlock()
+
+	// 已经标记为关闭，不会再有写入，等待发送完毕时不需要持有锁
+	flush(wsConn.writeChan, wsConn.writeDone, timeout)
+	wsConn.conn.Close()
+	close(wsConn.writeChan)
+}
+
+// trySend 不阻塞地将b放入写缓冲区
+func (wsConn *WSConn) trySend(b []byte) (bool, error) {
+	wsConn.mu.Lock()
+	defer wsConn.mu.Unlock()
 	if wsConn.isClosed() {
-		return
+		return false, pkg.ErrConnClosed
 	}
-	if len(wsConn.writeChan) == cap(wsConn.writeChan) {
+	select {
+	case wsConn.writeChan <- b:
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+func (wsConn *WSConn) doWrite(b []byte) error {
+	if b == nil {
+		return nil
+	}
+	wsConn.writeMu.Lock()
+	defer wsConn.writeMu.Unlock()
+
+	err := wsConn.queue.push(wsConn.trySend, b, wsConn.writeDone)
+	if err == pkg.ErrSlowConsumer {
+		log.Printf("disconnect %v: %v, %d bytes queued", wsConn.conn.RemoteAddr(), err, wsConn.queue.stats().QueuedBytes)
+		wsConn.queue.setReason(err)
 		wsConn.doDestroy()
-		return
 	}
+	return err
+}
 
-	wsConn.writeChan <- b
+// Stats 发送统计
+func (wsConn *WSConn) Stats() ConnStats {
+	return wsConn.queue.stats()
 }
 
 func (wsConn *WSConn) LocalAddr() net.Addr {
@@ -91,8 +184,14 @@ func (wsConn *WSConn) Write(b []byte) (int, error) {
 }
 
 func (wsConn *WSConn) ReadMsg() ([]byte, error) {
+	if wsConn.readIdle > 0 {
+		wsConn.conn.SetReadDeadline(time.Now().Add(wsConn.readIdle))
+	}
 	_, b, err := wsConn.conn.ReadMessage()
-	return b, err
+	if err != nil {
+		return nil, wsConn.queue.readErr(err)
+	}
+	return b, nil
 }
 
 func (wsConn *WSConn) WriteMsg(args ...[]byte) error {
@@ -129,8 +228,7 @@ func (wsConn *WSConn) WriteMsg(args ...[]byte) error {
 		}
 	}
 
-	wsConn.doWrite(mData)
-	return nil
+	return wsConn.doWrite(mData)
 }
 
 func (wsConn *WSConn) SetReadDeadline(t time.Time) error {
@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/pyihe/gogame/internal/gopool"
@@ -16,6 +17,9 @@ import (
 
 type websocketConnSet map[*websocket.Conn]struct{}
 
+// wsConnMap 服务端的连接
+type wsConnMap map[*websocket.Conn]*WSConn
+
 type WSServer struct {
 	opts      atomic.Value
 	newAgent  func(*WSConn) Agent
@@ -24,7 +28,7 @@ type WSServer struct {
 	upgrader  websocket.Upgrader
 	waiter    sync.WaitGroup
 	connsMu   sync.RWMutex
-	conns     websocketConnSet
+	conns     wsConnMap
 	closed    int32
 }
 
@@ -38,7 +42,7 @@ func NewWSServer(opts WSServerOption, newAgent func(*WSConn) Agent) (*WSServer,
 	var err error
 	var s = &WSServer{
 		newAgent: newAgent,
-		conns:    make(websocketConnSet),
+		conns:    make(wsConnMap),
 		closed:   pkg.StatusRunning,
 		upgrader: websocket.Upgrader{
 			HandshakeTimeout: opts.HTTPTimeout,
@@ -93,6 +97,11 @@ func (server *WSServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	conn.SetReadLimit(int64(opts.MsgMaxLen))
 
 	server.connsMu.Lock()
+	if server.isClosed() {
+		server.connsMu.Unlock()
+		conn.Close()
+		return
+	}
 	if existCount := len(server.conns); existCount >= opts.MaxConnNum {
 		server.connsMu.Unlock()
 		http.Error(w, "too many connection", http.StatusTooManyRequests)
@@ -101,12 +110,12 @@ func (server *WSServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	server.conns[conn] = struct{}{}
+	// 新建WSConn
+	wsConn := newWSConn(conn, opts.WriteBuff, opts.MsgMaxLen, opts.TextMode, opts.ReadIdleTimeout, opts.WriteIdleTimeout, opts.SlowConsumer)
+	server.conns[conn] = wsConn
 	server.connsMu.Unlock()
 
 	server.waiter.Add(1)
-	// 新建WSConn
-	wsConn := newWSConn(conn, opts.WriteBuff, opts.MsgMaxLen)
 	agent := server.newAgent(wsConn)
 	agent.OnConnect()
 	agent.Run()
@@ -168,3 +177,22 @@ func (server *WSServer) Close() {
 
 	server.waiter.Wait()
 }
+
+// Shutdown 停止接受新连接，等待每个连接已经写入的消息发送完毕后关闭，最多等待timeout
+func (server *WSServer) Shutdown(timeout time.Duration) {
+	if !atomic.CompareAndSwapInt32(&server.closed, pkg.StatusRunning, pkg.StatusClosed) {
+		return
+	}
+	server.ln.Close()
+
+	server.connsMu.Lock()
+	conns := make([]Conn, 0, len(server.conns))
+	for _, wsConn := range server.conns {
+		conns = append(conns, wsConn)
+	}
+	server.conns = nil
+	server.connsMu.Unlock()
+
+	closeGracefully(conns, timeout)
+	server.waiter.Wait()
+}
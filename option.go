@@ -1,5 +1,11 @@
 package gogame
 
+import (
+	"time"
+
+	"github.com/pyihe/gogame/registry"
+)
+
 // Options 服务器选项
 type Options struct {
 	ServeId uint16 // 服务器ID
@@ -7,6 +13,17 @@ type Options struct {
 	// cluster option
 	ClusterAddr      string
 	ClusterConnAddrs []string
+	// 集群连接的心跳间隔，默认5秒
+	ClusterPingInterval time.Duration
+	// 超过该时间没有收到对端任何消息则认为对端已失效并断开连接，默认为3倍心跳间隔
+	ClusterDeadTimeout time.Duration
+	// 同步调用其他节点的超时时间，对端没有响应时返回pkg.ErrCallTimeout，默认10秒
+	ClusterCallTimeout time.Duration
+
+	// registry option
+	// 设置后本节点以ClusterAddr注册到注册中心，并自动连接/断开其他节点
+	Registry    registry.Registry
+	RegistryTTL time.Duration
 
 	// pprof port
 	ProfileAddr string
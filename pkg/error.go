@@ -20,4 +20,26 @@ var (
 	ErrTimerClosed              = errors.New("timer closed")
 	ErrInvalidCronExpr          = errors.New("invalid cron expr")
 	ErrTaskCronClosed           = errors.New("task cron closed")
+	ErrNodeNotConnected         = errors.New("node not connected")
+	ErrRegistryClosed           = errors.New("registry closed")
+	ErrNoAvailableNode          = errors.New("no available node")
+	ErrNodeDown                 = errors.New("node down")
+	ErrArgsMismatch             = errors.New("arguments mismatch")
+	ErrResultMismatch           = errors.New("result mismatch")
+	ErrNoFuture                 = errors.New("no future")
+	ErrMessageFiltered          = errors.New("message filtered")
+	ErrMessageIDReserved        = errors.New("message id reserved")
+	ErrInvalidPublicKey         = errors.New("invalid public key")
+	ErrDecryptFailed            = errors.New("decrypt failed")
+	ErrIdleTimeout              = errors.New("idle timeout")
+	ErrKicked                   = errors.New("kicked")
+	ErrProtocolOutdated         = errors.New("protocol version outdated")
+	ErrInvalidConv              = errors.New("invalid conv")
+	ErrInvalidCommand           = errors.New("invalid command")
+	ErrInvalidMtu               = errors.New("invalid mtu")
+	ErrSlowConsumer             = errors.New("slow consumer")
+	ErrAmbiguousName            = errors.New("ambiguous message name")
+	ErrMessageDropped           = errors.New("message dropped")
+	ErrCallTimeout              = errors.New("call timeout")
+	ErrMailboxFull              = errors.New("mailbox full")
 )
@@ -0,0 +1,341 @@
+package etcd
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pyihe/gogame/internal/gopool"
+	"github.com/pyihe/gogame/pkg"
+	"github.com/pyihe/gogame/pkg/log"
+	"github.com/pyihe/gogame/registry"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	defaultPrefix  = "/gogame/nodes"
+	defaultTTL     = 10 * time.Second
+	requestTimeout = 3 * time.Second
+	retryInterval  = time.Second // 重新注册或者重新监听失败后的重试间隔
+)
+
+// Registry 基于etcd的注册中心，节点信息以json格式保存在prefix/nodeID下，并绑定租约
+type Registry struct {
+	client     *clientv3.Client
+	prefix     string
+	status     int32
+	ctx        context.Context
+	cancelFunc context.CancelFunc
+
+	mu     sync.Mutex
+	leases map[uint16]clientv3.LeaseID // 本实例注册的节点租约
+}
+
+func New(client *clientv3.Client, prefix string) *Registry {
+	if prefix == "" {
+		prefix = defaultPrefix
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Registry{
+		client:     client,
+		prefix:     prefix,
+		status:     pkg.StatusRunning,
+		ctx:        ctx,
+		cancelFunc: cancel,
+		leases:     make(map[uint16]clientv3.LeaseID),
+	}
+}
+
+func (r *Registry) isClosed() bool {
+	return atomic.LoadInt32(&r.status) == pkg.StatusClosed
+}
+
+func (r *Registry) buildKey(id uint16) string {
+	return path.Join(r.prefix, strconv.Itoa(int(id)))
+}
+
+func (r *Registry) Register(node *registry.Node, ttl time.Duration) error {
+	if r.isClosed() {
+		return pkg.ErrRegistryClosed
+	}
+	if node == nil {
+		return pkg.ErrPointerRequired
+	}
+	if ttl < time.Second {
+		ttl = defaultTTL
+	}
+
+	vBytes, err := json.Marshal(node)
+	if err != nil {
+		return err
+	}
+
+	key, value := r.buildKey(node.ID), string(vBytes)
+	lease, keepAlive, err := r.grant(key, value, ttl)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	oldLease, ok := r.leases[node.ID]
+	r.leases[node.ID] = lease
+	r.mu.Unlock()
+
+	if ok {
+		r.revoke(oldLease)
+	}
+	gopool.AddTask(func() {
+		r.keepAlive(node.ID, key, value, ttl, lease, keepAlive)
+	})
+	return nil
+}
+
+// grant 创建租约，写入绑定租约的节点信息并开始续约
+func (r *Registry) grant(key, value string, ttl time.Duration) (clientv3.LeaseID, <-chan *clientv3.LeaseKeepAliveResponse, error) {
+	ctx, cancel := context.WithTimeout(r.ctx, requestTimeout)
+	defer cancel()
+
+	rsp, err := r.client.Grant(ctx, int64(ttl/time.Second))
+	if err != nil {
+		return 0, nil, err
+	}
+	if _, err = r.client.Put(ctx, key, value, clientv3.WithLease(rsp.ID)); err != nil {
+		return 0, nil, err
+	}
+
+	// 续约直到租约被撤销或者关闭
+	keepAlive, err := r.client.KeepAlive(r.ctx, rsp.ID)
+	if err != nil {
+		return 0, nil, err
+	}
+	return rsp.ID, keepAlive, nil
+}
+
+func (r *Registry) revoke(lease clientv3.LeaseID) {
+	ctx, cancel := context.WithTimeout(r.ctx, requestTimeout)
+	defer cancel()
+	r.client.Revoke(ctx, lease)
+}
+
+func (r *Registry) getLease(id uint16) clientv3.LeaseID {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.leases[id]
+}
+
+// keepAlive 续约停止时，如果节点没有注销或者重新注册，说明租约已经丢失(例如etcd长时间不可用)
+// 此时重新创建租约并写入节点信息，直到成功或者注册中心关闭
+func (r *Registry) keepAlive(id uint16, key, value string, ttl time.Duration, lease clientv3.LeaseID, keepAlive <-chan *clientv3.LeaseKeepAliveResponse) {
+	for {
+		for range keepAlive {
+		}
+		if r.isClosed() || r.getLease(id) != lease {
+			return
+		}
+		log.Printf("registry keepalive for node %d stopped, register again", id)
+
+		var newLease clientv3.LeaseID
+		var err error
+		for {
+			if newLease, keepAlive, err = r.grant(key, value, ttl); err == nil {
+				break
+			}
+			log.Printf("registry register node %d error: %v", id, err)
+			select {
+			case <-r.ctx.Done():
+				return
+			case <-time.After(retryInterval):
+			}
+			if r.getLease(id) != lease {
+				return
+			}
+		}
+
+		// 重新注册期间节点已经注销或者重新注册
+		r.mu.Lock()
+		if r.leases[id] != lease {
+			r.mu.Unlock()
+			r.revoke(newLease)
+			return
+		}
+		r.leases[id] = newLease
+		r.mu.Unlock()
+		lease = newLease
+	}
+}
+
+func (r *Registry) Deregister(node *registry.Node) error {
+	if r.isClosed() {
+		return pkg.ErrRegistryClosed
+	}
+	if node == nil {
+		return pkg.ErrPointerRequired
+	}
+
+	ctx, cancel := context.WithTimeout(r.ctx, requestTimeout)
+	defer cancel()
+
+	r.mu.Lock()
+	lease, ok := r.leases[node.ID]
+	delete(r.leases, node.ID)
+	r.mu.Unlock()
+
+	if ok {
+		if _, err := r.client.Revoke(ctx, lease); err != nil {
+			return err
+		}
+	}
+	_, err := r.client.Delete(ctx, r.buildKey(node.ID))
+	return err
+}
+
+func (r *Registry) Nodes() ([]*registry.Node, error) {
+	if r.isClosed() {
+		return nil, pkg.ErrRegistryClosed
+	}
+
+	ctx, cancel := context.WithTimeout(r.ctx, requestTimeout)
+	defer cancel()
+
+	rsp, err := r.client.Get(ctx, r.prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := make([]*registry.Node, 0, len(rsp.Kvs))
+	for _, kv := range rsp.Kvs {
+		var node *registry.Node
+		if err = json.Unmarshal(kv.Value, &node); err != nil || node == nil {
+			continue
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+func (r *Registry) Watch(handler func(*registry.Event)) error {
+	if r.isClosed() {
+		return pkg.ErrRegistryClosed
+	}
+	if handler == nil {
+		return nil
+	}
+
+	watchChan := r.client.Watch(r.ctx, r.prefix, clientv3.WithPrefix())
+	gopool.AddTask(func() {
+		r.watch(handler, watchChan)
+	})
+	return nil
+}
+
+// watch 分发节点变化事件
+// 监听出错(例如需要的版本已经被压缩)时会停止，此时重新同步全部节点，再从同步的版本继续监听
+func (r *Registry) watch(handler func(*registry.Event), watchChan clientv3.WatchChan) {
+	known := make(map[uint16]bool)
+	for {
+		for events := range watchChan {
+			if err := events.Err(); err != nil {
+				log.Printf("registry watch error: %v", err)
+				continue
+			}
+			for _, evt := range events.Events {
+				if e := r.parseEvent(evt); e != nil {
+					known[e.Node.ID] = e.Type == registry.EventPut
+					handler(e)
+				}
+			}
+		}
+
+		for {
+			if r.isClosed() {
+				return
+			}
+			rev, err := r.resync(handler, known)
+			if err == nil {
+				watchChan = r.client.Watch(r.ctx, r.prefix, clientv3.WithPrefix(), clientv3.WithRev(rev+1))
+				break
+			}
+			log.Printf("registry resync error: %v", err)
+			select {
+			case <-r.ctx.Done():
+			case <-time.After(retryInterval):
+			}
+		}
+	}
+}
+
+// resync 按照当前的全部节点补发事件，known为已经通知过的节点，返回同步时的版本
+func (r *Registry) resync(handler func(*registry.Event), known map[uint16]bool) (int64, error) {
+	ctx, cancel := context.WithTimeout(r.ctx, requestTimeout)
+	defer cancel()
+
+	rsp, err := r.client.Get(ctx, r.prefix, clientv3.WithPrefix())
+	if err != nil {
+		return 0, err
+	}
+
+	nodes := make(map[uint16]bool, len(rsp.Kvs))
+	for _, kv := range rsp.Kvs {
+		var node *registry.Node
+		if err = json.Unmarshal(kv.Value, &node); err != nil || node == nil {
+			continue
+		}
+		nodes[node.ID] = true
+		handler(&registry.Event{Type: registry.EventPut, Node: node})
+	}
+	for id, ok := range known {
+		if ok && !nodes[id] {
+			handler(&registry.Event{Type: registry.EventDelete, Node: &registry.Node{ID: id}})
+		}
+	}
+	for id := range known {
+		delete(known, id)
+	}
+	for id := range nodes {
+		known[id] = true
+	}
+	return rsp.Header.Revision, nil
+}
+
+func (r *Registry) parseEvent(evt *clientv3.Event) *registry.Event {
+	switch evt.Type {
+	case mvccpb.PUT:
+		var node *registry.Node
+		if err := json.Unmarshal(evt.Kv.Value, &node); err != nil || node == nil {
+			return nil
+		}
+		return &registry.Event{Type: registry.EventPut, Node: node}
+
+	case mvccpb.DELETE:
+		id, err := strconv.ParseUint(path.Base(string(evt.Kv.Key)), 10, 16)
+		if err != nil {
+			return nil
+		}
+		return &registry.Event{Type: registry.EventDelete, Node: &registry.Node{ID: uint16(id)}}
+	}
+	return nil
+}
+
+func (r *Registry) Close() error {
+	if !atomic.CompareAndSwapInt32(&r.status, pkg.StatusRunning, pkg.StatusClosed) {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	r.mu.Lock()
+	for id, lease := range r.leases {
+		r.client.Revoke(ctx, lease)
+		delete(r.leases, id)
+	}
+	r.mu.Unlock()
+
+	r.cancelFunc()
+	return nil
+}
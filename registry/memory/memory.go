@@ -0,0 +1,145 @@
+package memory
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pyihe/gogame/pkg"
+	"github.com/pyihe/gogame/registry"
+)
+
+// store 多个Registry共享的节点信息
+type store struct {
+	mu       sync.Mutex
+	nodes    map[uint16]*registry.Node
+	owners   map[uint16]*Registry // 注册节点的实例
+	watchers map[*Registry][]func(*registry.Event)
+}
+
+// Registry 基于内存的注册中心，一般用于测试
+// 同一进程内的多个节点各自使用通过Fork得到的实例，共享同一份节点信息
+// 节点不会因为ttl到期而离开，只能通过Deregister注销，或者在注册它的实例Close时离开
+type Registry struct {
+	s      *store
+	closed bool // guard by s.mu
+}
+
+func New() *Registry {
+	return &Registry{
+		s: &store{
+			nodes:    make(map[uint16]*registry.Node),
+			owners:   make(map[uint16]*Registry),
+			watchers: make(map[*Registry][]func(*registry.Event)),
+		},
+	}
+}
+
+// Fork 返回与r共享节点信息的新实例，Close只影响新实例自己注册的节点与监听
+func (r *Registry) Fork() *Registry {
+	return &Registry{s: r.s}
+}
+
+func (r *Registry) notify(evt *registry.Event) {
+	r.s.mu.Lock()
+	var watchers []func(*registry.Event)
+	for _, fns := range r.s.watchers {
+		watchers = append(watchers, fns...)
+	}
+	r.s.mu.Unlock()
+
+	for _, fn := range watchers {
+		fn(evt)
+	}
+}
+
+func (r *Registry) Register(node *registry.Node, _ time.Duration) error {
+	if node == nil {
+		return pkg.ErrPointerRequired
+	}
+	r.s.mu.Lock()
+	if r.closed {
+		r.s.mu.Unlock()
+		return pkg.ErrRegistryClosed
+	}
+	n := *node
+	r.s.nodes[n.ID] = &n
+	r.s.owners[n.ID] = r
+	r.s.mu.Unlock()
+
+	r.notify(&registry.Event{Type: registry.EventPut, Node: &n})
+	return nil
+}
+
+func (r *Registry) Deregister(node *registry.Node) error {
+	if node == nil {
+		return pkg.ErrPointerRequired
+	}
+	r.s.mu.Lock()
+	if r.closed {
+		r.s.mu.Unlock()
+		return pkg.ErrRegistryClosed
+	}
+	n, ok := r.s.nodes[node.ID]
+	delete(r.s.nodes, node.ID)
+	delete(r.s.owners, node.ID)
+	r.s.mu.Unlock()
+
+	if ok {
+		r.notify(&registry.Event{Type: registry.EventDelete, Node: n})
+	}
+	return nil
+}
+
+func (r *Registry) Nodes() ([]*registry.Node, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	if r.closed {
+		return nil, pkg.ErrRegistryClosed
+	}
+	nodes := make([]*registry.Node, 0, len(r.s.nodes))
+	for _, n := range r.s.nodes {
+		c := *n
+		nodes = append(nodes, &c)
+	}
+	return nodes, nil
+}
+
+func (r *Registry) Watch(handler func(*registry.Event)) error {
+	if handler == nil {
+		return nil
+	}
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	if r.closed {
+		return pkg.ErrRegistryClosed
+	}
+	r.s.watchers[r] = append(r.s.watchers[r], handler)
+	return nil
+}
+
+// Close 停止r的监听，并注销r注册的节点，其他实例不受影响
+func (r *Registry) Close() error {
+	r.s.mu.Lock()
+	if r.closed {
+		r.s.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	delete(r.s.watchers, r)
+	var nodes []*registry.Node
+	for id, owner := range r.s.owners {
+		if owner == r {
+			nodes = append(nodes, r.s.nodes[id])
+			delete(r.s.nodes, id)
+			delete(r.s.owners, id)
+		}
+	}
+	r.s.mu.Unlock()
+
+	for _, n := range nodes {
+		r.notify(&registry.Event{Type: registry.EventDelete, Node: n})
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/pyihe/gogame/registry"
+)
+
+func TestRegistry(t *testing.T) {
+	r := New()
+
+	var events []*registry.Event
+	if err := r.Watch(func(evt *registry.Event) {
+		events = append(events, evt)
+	}); err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+
+	node := &registry.Node{ID: 1, Addr: "127.0.0.1:9001", Modules: []string{"game"}}
+	if err := r.Register(node, 0); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	nodes, _ := r.Nodes()
+	if len(nodes) != 1 || !nodes[0].HasModule("game") {
+		t.Fatalf("unexpected nodes: %+v", nodes)
+	}
+
+	if err := r.Deregister(node); err != nil {
+		t.Fatalf("deregister: %v", err)
+	}
+	nodes, _ = r.Nodes()
+	if len(nodes) != 0 {
+		t.Fatalf("unexpected nodes: %+v", nodes)
+	}
+
+	if len(events) != 2 || events[0].Type != registry.EventPut || events[1].Type != registry.EventDelete {
+		t.Fatalf("unexpected events: %+v", events)
+	}
+
+	r.Close()
+	if err := r.Register(node, 0); err == nil {
+		t.Fatalf("register after close should fail")
+	}
+}
+
+func TestFork(t *testing.T) {
+	r1 := New()
+	r2 := r1.Fork()
+
+	var events []*registry.Event
+	r2.Watch(func(evt *registry.Event) {
+		events = append(events, evt)
+	})
+	r1.Watch(func(evt *registry.Event) {})
+	r1.Register(&registry.Node{ID: 1}, 0)
+	r2.Register(&registry.Node{ID: 2}, 0)
+
+	// r1关闭只注销r1注册的节点，r2的监听不受影响
+	r1.Close()
+	nodes, err := r2.Nodes()
+	if err != nil || len(nodes) != 1 || nodes[0].ID != 2 {
+		t.Fatalf("unexpected nodes: %+v, %v", nodes, err)
+	}
+	if len(events) != 3 || events[2].Type != registry.EventDelete || events[2].Node.ID != 1 {
+		t.Fatalf("unexpected events: %+v", events)
+	}
+	if len(r1.s.watchers) != 1 {
+		t.Fatalf("watchers of r1 not removed")
+	}
+}
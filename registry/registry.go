@@ -0,0 +1,51 @@
+package registry
+
+import "time"
+
+// Node 集群中的节点信息
+type Node struct {
+	ID      uint16   `json:"id"`                // 节点ID，对应Options.ServeId
+	Addr    string   `json:"addr"`              // 集群通信地址，对应Options.ClusterAddr
+	Modules []string `json:"modules,omitempty"` // 节点导出的chanrpc server名
+}
+
+// HasModule 节点是否导出了名为name的chanrpc server
+func (n *Node) HasModule(name string) bool {
+	for _, m := range n.Modules {
+		if m == name {
+			return true
+		}
+	}
+	return false
+}
+
+type EventType uint8
+
+const (
+	EventPut    EventType = iota + 1 // 节点加入或更新
+	EventDelete                      // 节点离开，此时Node只保证ID有效
+)
+
+// Event 节点变化事件
+type Event struct {
+	Type EventType
+	Node *Node
+}
+
+// Registry 注册中心
+type Registry interface {
+	// Register 注册节点，节点需要在ttl内续约，否则视为离开
+	Register(node *Node, ttl time.Duration) error
+
+	// Deregister 注销节点
+	Deregister(node *Node) error
+
+	// Nodes 获取当前所有已注册的节点
+	Nodes() ([]*Node, error)
+
+	// Watch 监听节点变化，handler可能在任意goroutine中执行
+	Watch(handler func(*Event)) error
+
+	// Close 关闭注册中心，停止续约与监听
+	Close() error
+}
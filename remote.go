@@ -0,0 +1,65 @@
+package gogame
+
+import (
+	"github.com/pyihe/gogame/pkg/log"
+)
+
+// ChanRPC 本地与远程chanrpc server共同的调用方式
+// *chanrpc.Server与*RemoteServer均实现了该接口，调用方无需关心目标模块部署在哪个节点
+type ChanRPC interface {
+	Go(id interface{}, args ...interface{})
+	Post(id interface{}, args ...interface{}) error
+	Call0(id interface{}, args ...interface{}) error
+	Call1(id interface{}, args ...interface{}) (interface{}, error)
+	CallN(id interface{}, args ...interface{}) ([]interface{}, error)
+}
+
+// RemoteServer 集群中nodeID节点通过RegisterClusterServer导出的名为name的chanrpc server
+// 当nodeID为本节点的ServeId时，直接调用本节点导出的chanrpc server
+type RemoteServer struct {
+	nodeID uint16
+	name   string
+}
+
+func NewRemoteServer(nodeID uint16, name string) *RemoteServer {
+	return &RemoteServer{
+		nodeID: nodeID,
+		name:   name,
+	}
+}
+
+func (rs *RemoteServer) NodeID() uint16 {
+	return rs.nodeID
+}
+
+func (rs *RemoteServer) Name() string {
+	return rs.name
+}
+
+// goroutine safe
+func (rs *RemoteServer) Go(id interface{}, args ...interface{}) {
+	if err := rs.Post(id, args...); err != nil {
+		log.Printf("remote server(%d:%s) go %v error: %v", rs.nodeID, rs.name, id, err)
+	}
+}
+
+// Post 与Go相同，返回投递的结果
+// goroutine safe
+func (rs *RemoteServer) Post(id interface{}, args ...interface{}) error {
+	return ClusterGo(rs.nodeID, rs.name, id, args...)
+}
+
+// goroutine safe
+func (rs *RemoteServer) Call0(id interface{}, args ...interface{}) error {
+	return ClusterCall0(rs.nodeID, rs.name, id, args...)
+}
+
+// goroutine safe
+func (rs *RemoteServer) Call1(id interface{}, args ...interface{}) (interface{}, error) {
+	return ClusterCall1(rs.nodeID, rs.name, id, args...)
+}
+
+// goroutine safe
+func (rs *RemoteServer) CallN(id interface{}, args ...interface{}) ([]interface{}, error) {
+	return ClusterCallN(rs.nodeID, rs.name, id, args...)
+}
@@ -0,0 +1,268 @@
+package gogame
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/pyihe/gogame/network"
+	"github.com/pyihe/gogame/pkg/log"
+)
+
+// 会话恢复
+// Gate.ResumeTimeout大于0时，连接建立(以及版本握手)后客户端发送: token (16byte) + 已收到的消息数量 (4byte, 大端)
+// 新连接的token全为0；gate回复: status (1byte) + token (16byte)
+// status为ResumeNew时为新会话，客户端从0开始计数收到的消息(不包括握手回复与心跳)
+// status为ResumeOK时恢复到token对应的会话，gate先按顺序重发客户端未收到的消息，客户端从自己上报的数量继续计数
+// 连接断开后会话保留ResumeTimeout，期间发送的消息进入缓冲区，超时后才调用AgentHook.OnClose
+// 文本模式下请求为{"token": "hex", "seq": 0}，回复为{"status": 0, "token": "hex"}
+const (
+	ResumeNew uint8 = iota // 新会话
+	ResumeOK               // 会话已恢复
+)
+
+const (
+	tokenLen         = 16
+	resumeReqLen     = tokenLen + 4
+	defaultResumeBuf = 256
+)
+
+type textResume struct {
+	Status uint8  `json:"status,omitempty"`
+	Token  string `json:"token"`
+	Seq    uint32 `json:"seq,omitempty"`
+}
+
+// session 可恢复的会话，guard by gateAgent.mu，buffer的追加与重发由gateAgent.writeMu保证顺序
+type session struct {
+	token    []byte
+	seq      uint32   // 已经交给连接发送的消息数量，不包括被连接丢弃的消息
+	buffer   [][]byte // 尚未确认的消息，最后一个的序号为seq
+	detached bool     // 连接已经断开，等待恢复
+	epoch    uint32   // 每次断开时加一，用于判断保留期的定时器是否已经失效
+}
+
+// push 记录发送的消息，超过max时丢弃最早的消息
+func (s *session) push(data []byte, max int) {
+	s.seq++
+	s.buffer = append(s.buffer, data)
+	if n := len(s.buffer); n > max {
+		s.buffer = s.buffer[n-max:]
+	}
+}
+
+// ack 确认客户端已经收到seq个消息，需要的消息已经被丢弃时返回false
+func (s *session) ack(seq uint32) bool {
+	first := s.seq - uint32(len(s.buffer))
+	if seq > s.seq || seq < first {
+		return false
+	}
+	s.buffer = s.buffer[seq-first:]
+	return true
+}
+
+// handshakeResume 新建或者恢复会话，返回连接所属的逻辑agent，返回nil时需要断开连接
+func (a *gateAgent) handshakeResume() *gateAgent {
+	if t := a.gate.HandshakeTimeout; t > 0 {
+		a.conn.SetReadDeadline(time.Now().Add(t))
+		defer a.conn.SetReadDeadline(time.Time{})
+	}
+
+	data, err := a.conn.ReadMsg()
+	if err != nil {
+		log.Printf("read session token from %v: %v", a.conn.RemoteAddr(), err)
+		return nil
+	}
+	token, seq, ok := a.decodeResume(data)
+	if !ok {
+		log.Printf("invalid session token from %v", a.conn.RemoteAddr())
+		return nil
+	}
+
+	if old := a.gate.session(token); old != nil {
+		if old.resume(a.conn, a.text, a.version, seq) {
+			return old
+		}
+		// 需要重发的消息已经丢弃，或者客户端切换了协议，旧会话无法恢复
+		log.Printf("session of %v can not be resumed", a.conn.RemoteAddr())
+		old.Close()
+	}
+
+	token = make([]byte, tokenLen)
+	if _, err = rand.Read(token); err != nil {
+		log.Printf("generate session token error: %v", err)
+		return nil
+	}
+	a.session = &session{token: token}
+	if err = a.conn.WriteMsg(a.encodeResume(ResumeNew, token)); err != nil {
+		return nil
+	}
+	a.gate.addSession(a)
+	a.connected()
+	return a
+}
+
+// resume 将会话绑定到新的连接conn，重发客户端未收到的消息
+func (a *gateAgent) resume(conn network.Conn, text bool, version uint16, seq uint32) bool {
+	// 持有writeMu直到重发完毕，保证之后的消息排在重发的消息后面
+	a.writeMu.Lock()
+	defer a.writeMu.Unlock()
+
+	a.mu.Lock()
+	s := a.session
+	if a.closed || a.text != text || a.version != version || !s.ack(seq) {
+		a.mu.Unlock()
+		return false
+	}
+	old := a.conn
+	a.conn = conn
+	a.reason = nil
+	s.detached = false
+	s.epoch++
+	buffer := s.buffer
+	a.mu.Unlock()
+
+	err := conn.WriteMsg(a.encodeResume(ResumeOK, s.token))
+	for i := 0; err == nil && i < len(buffer); i++ {
+		err = conn.WriteMsg(buffer[i])
+	}
+
+	// 旧连接可能还没有检测到断开
+	if old != conn {
+		old.Close()
+	}
+	return err == nil
+}
+
+// detach 连接conn断开，会话进入保留期
+func (a *gateAgent) detach(conn network.Conn, reason error) {
+	a.mu.Lock()
+	// 会话已经在新的连接上恢复
+	if a.conn != conn {
+		a.mu.Unlock()
+		return
+	}
+	if a.reason == nil {
+		a.reason = reason
+	}
+	s := a.session
+	s.detached = true
+	s.epoch++
+	epoch := s.epoch
+	closed := a.closed
+	a.mu.Unlock()
+
+	if closed || !a.gate.holdSession(a) {
+		a.finalize()
+		return
+	}
+	time.AfterFunc(a.gate.ResumeTimeout, func() {
+		a.expire(epoch)
+	})
+}
+
+// expire 保留期结束，会话没有恢复时关闭
+func (a *gateAgent) expire(epoch uint32) {
+	a.mu.Lock()
+	expired := a.session.detached && a.session.epoch == epoch
+	a.mu.Unlock()
+	if expired {
+		a.finalize()
+	}
+}
+
+// detached 会话是否处于保留期
+func (a *gateAgent) detached() bool {
+	return a.session != nil && a.session.detached
+}
+
+func (a *gateAgent) decodeResume(data []byte) ([]byte, uint32, bool) {
+	if a.text {
+		var req textResume
+		if err := json.Unmarshal(data, &req); err != nil {
+			return nil, 0, false
+		}
+		token, err := hex.DecodeString(req.Token)
+		if err != nil || (len(token) != 0 && len(token) != tokenLen) {
+			return nil, 0, false
+		}
+		return token, req.Seq, true
+	}
+	if len(data) != resumeReqLen {
+		return nil, 0, false
+	}
+	return data[:tokenLen], binary.BigEndian.Uint32(data[tokenLen:]), true
+}
+
+func (a *gateAgent) encodeResume(status uint8, token []byte) []byte {
+	if a.text {
+		data, _ := json.Marshal(&textResume{
+			Status: status,
+			Token:  hex.EncodeToString(token),
+		})
+		return data
+	}
+	resp := make([]byte, 1+tokenLen)
+	resp[0] = status
+	copy(resp[1:], token)
+	return resp
+}
+
+func (gate *Gate) session(token []byte) *gateAgent {
+	gate.sessionsMu.Lock()
+	defer gate.sessionsMu.Unlock()
+	return gate.sessions[string(token)]
+}
+
+func (gate *Gate) addSession(a *gateAgent) {
+	gate.sessionsMu.Lock()
+	if gate.sessions == nil {
+		gate.sessions = make(map[string]*gateAgent)
+	}
+	gate.sessions[string(a.session.token)] = a
+	gate.sessionsMu.Unlock()
+}
+
+// holdSession 会话是否可以进入保留期，gate关闭后不再保留
+func (gate *Gate) holdSession(a *gateAgent) bool {
+	gate.sessionsMu.Lock()
+	defer gate.sessionsMu.Unlock()
+	return !gate.sessionsClosed && gate.sessions[string(a.session.token)] == a
+}
+
+func (gate *Gate) removeSession(a *gateAgent) {
+	gate.sessionsMu.Lock()
+	if gate.sessions[string(a.session.token)] == a {
+		delete(gate.sessions, string(a.session.token))
+	}
+	gate.sessionsMu.Unlock()
+}
+
+// closeSessions gate关闭时结束所有保留期中的会话
+func (gate *Gate) closeSessions() {
+	gate.sessionsMu.Lock()
+	gate.sessionsClosed = true
+	agents := make([]*gateAgent, 0, len(gate.sessions))
+	for _, a := range gate.sessions {
+		agents = append(agents, a)
+	}
+	gate.sessionsMu.Unlock()
+
+	for _, a := range agents {
+		a.mu.Lock()
+		detached := a.detached()
+		a.mu.Unlock()
+		if detached {
+			a.finalize()
+		}
+	}
+}
+
+func (gate *Gate) resumeBuffer() int {
+	if gate.ResumeBuffer > 0 {
+		return gate.ResumeBuffer
+	}
+	return defaultResumeBuf
+}
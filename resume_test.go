@@ -0,0 +1,356 @@
+package gogame
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pyihe/gogame/network"
+	"github.com/pyihe/gogame/pkg"
+	"github.com/pyihe/gogame/route"
+	jsonc "github.com/pyihe/gogame/route/json"
+)
+
+// pipeConn 内存中的network.Conn，in为客户端发送的消息，out为gate发送的消息
+type pipeConn struct {
+	in     chan []byte
+	out    chan []byte
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newPipeConn() *pipeConn {
+	return &pipeConn{
+		in:     make(chan []byte, 16),
+		out:    make(chan []byte, 16),
+		closed: make(chan struct{}),
+	}
+}
+
+func (c *pipeConn) Close()                           { c.once.Do(func() { close(c.closed) }) }
+func (c *pipeConn) CloseGracefully(time.Duration)    { c.Close() }
+func (c *pipeConn) LocalAddr() net.Addr              { return &net.TCPAddr{} }
+func (c *pipeConn) RemoteAddr() net.Addr             { return &net.TCPAddr{} }
+func (c *pipeConn) Read([]byte) (int, error)         { return 0, io.EOF }
+func (c *pipeConn) Write(b []byte) (int, error)      { return len(b), nil }
+func (c *pipeConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *pipeConn) SetWriteDeadline(time.Time) error { return nil }
+func (c *pipeConn) Stats() network.ConnStats         { return network.ConnStats{} }
+
+func (c *pipeConn) ReadMsg() ([]byte, error) {
+	select {
+	case data := <-c.in:
+		return data, nil
+	case <-c.closed:
+		return nil, io.EOF
+	}
+}
+
+func (c *pipeConn) WriteMsg(args ...[]byte) error {
+	select {
+	case <-c.closed:
+		return pkg.ErrConnClosed
+	default:
+	}
+	c.out <- bytes.Join(args, nil)
+	return nil
+}
+
+func (c *pipeConn) recv(t *testing.T) []byte {
+	t.Helper()
+	select {
+	case data := <-c.out:
+		return data
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+		return nil
+	}
+}
+
+type hookRecorder struct {
+	connect chan Agent
+	close   chan Agent
+}
+
+func (h *hookRecorder) OnConnect(a Agent) { h.connect <- a }
+func (h *hookRecorder) OnClose(a Agent)   { h.close <- a }
+
+type resumeMsg struct{ N int }
+
+// serveConn 模拟network层对一个连接的处理
+func serveConn(gate *Gate, conn *pipeConn) {
+	a := &gateAgent{conn: conn, gate: gate}
+	go func() {
+		a.OnConnect()
+		a.Run()
+		conn.Close()
+		a.OnClose()
+	}()
+}
+
+func TestSessionResume(t *testing.T) {
+	p := route.NewProcessor(false, route.GetCodec(jsonc.Name))
+	p.Register(route.NewMessage(1, &resumeMsg{}))
+	hook := &hookRecorder{connect: make(chan Agent, 2), close: make(chan Agent, 2)}
+	gate := &Gate{
+		Processor:     p,
+		AgentHandler:  hook,
+		ResumeTimeout: 100 * time.Millisecond,
+	}
+
+	conn1 := newPipeConn()
+	serveConn(gate, conn1)
+	conn1.in <- make([]byte, resumeReqLen)
+	resp := conn1.recv(t)
+	if resp[0] != ResumeNew || len(resp) != 1+tokenLen {
+		t.Fatalf("unexpected resume response %v", resp)
+	}
+	token := resp[1:]
+	agent := <-hook.connect
+	agent.SetUserData("player")
+
+	agent.WriteMsg(&resumeMsg{N: 1})
+	agent.WriteMsg(&resumeMsg{N: 2})
+	conn1.recv(t)
+	msg2 := conn1.recv(t)
+
+	// 断开期间发送的消息进入缓冲区，不触发OnClose
+	conn1.Close()
+	time.Sleep(10 * time.Millisecond)
+	agent.WriteMsg(&resumeMsg{N: 3})
+	select {
+	case <-hook.close:
+		t.Fatal("OnClose called before resume timeout")
+	default:
+	}
+
+	// 客户端只收到了第一个消息
+	conn2 := newPipeConn()
+	serveConn(gate, conn2)
+	req := append(append([]byte{}, token...), 0, 0, 0, 1)
+	conn2.in <- req
+	if resp = conn2.recv(t); resp[0] != ResumeOK || !bytes.Equal(resp[1:], token) {
+		t.Fatalf("unexpected resume response %v", resp)
+	}
+	if data := conn2.recv(t); !bytes.Equal(data, msg2) {
+		t.Fatalf("replayed %q, want %q", data, msg2)
+	}
+	msg3, _ := p.Marshal(&resumeMsg{N: 3})
+	if data := conn2.recv(t); !bytes.Equal(data, msg3) {
+		t.Fatalf("replayed %q, want %q", data, msg3)
+	}
+	if agent.UserData() != "player" {
+		t.Fatalf("user data lost: %v", agent.UserData())
+	}
+
+	// 保留期结束后才关闭
+	conn2.Close()
+	select {
+	case a := <-hook.close:
+		if a != agent {
+			t.Fatal("closed a different agent")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("session not expired")
+	}
+	select {
+	case <-hook.connect:
+		t.Fatal("OnConnect called for resumed session")
+	default:
+	}
+
+	// 过期的token作为新会话处理
+	conn3 := newPipeConn()
+	serveConn(gate, conn3)
+	conn3.in <- req
+	if resp = conn3.recv(t); resp[0] != ResumeNew {
+		t.Fatalf("expired session resumed")
+	}
+	<-hook.connect
+	gate.closeSessions()
+	conn3.Close()
+	<-hook.close
+}
+
+// tcpClientAgent 客户端连接，收到的消息写入recv
+type tcpClientAgent struct {
+	conn *network.TCPConn
+	recv chan []byte
+}
+
+func (a *tcpClientAgent) OnConnect() {}
+func (a *tcpClientAgent) OnClose()   {}
+func (a *tcpClientAgent) Run() {
+	for {
+		data, err := a.conn.ReadMsg()
+		if err != nil {
+			close(a.recv)
+			return
+		}
+		a.recv <- data
+	}
+}
+
+func dialGate(t *testing.T, addr string) (*network.TCPClient, *tcpClientAgent) {
+	connected := make(chan *tcpClientAgent, 1)
+	client, err := network.NewTCPClient(network.TCPClientOption{Addr: addr}, func(conn *network.TCPConn) network.Agent {
+		a := &tcpClientAgent{conn: conn, recv: make(chan []byte, 1024)}
+		connected <- a
+		return a
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Start()
+	return client, <-connected
+}
+
+func TestResumeReplayOverWriteBuffer(t *testing.T) {
+	const n = 300
+	p := route.NewProcessor(false, route.GetCodec(jsonc.Name))
+	p.Register(route.NewMessage(1, &resumeMsg{}))
+	hook := &hookRecorder{connect: make(chan Agent, 1), close: make(chan Agent, 1)}
+	gate := &Gate{
+		TCPAddr:       "127.0.0.1:0",
+		Processor:     p,
+		AgentHandler:  hook,
+		ResumeTimeout: time.Second,
+		ResumeBuffer:  n,
+	}
+	gate.Start()
+	defer gate.Close()
+	addr := gate.tcpServer.Addr().String()
+
+	client, a := dialGate(t, addr)
+	a.conn.WriteMsg(make([]byte, resumeReqLen))
+	resp := <-a.recv
+	token := resp[1:]
+	agent := <-hook.connect
+	client.Close()
+
+	// 断开期间缓存的消息数量超过了网络层默认的写缓冲区大小
+	logical := gate.session(token)
+	for {
+		logical.mu.Lock()
+		detached := logical.detached()
+		logical.mu.Unlock()
+		if detached {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < n; i++ {
+		agent.WriteMsg(&resumeMsg{N: i})
+	}
+
+	client, a = dialGate(t, addr)
+	defer client.Close()
+	a.conn.WriteMsg(append(append([]byte{}, token...), 0, 0, 0, 0))
+	if resp = <-a.recv; len(resp) == 0 || resp[0] != ResumeOK {
+		t.Fatalf("unexpected resume response %v", resp)
+	}
+	for i := 0; i < n; i++ {
+		select {
+		case data, ok := <-a.recv:
+			if !ok {
+				t.Fatalf("connection closed after %d replayed messages", i)
+			}
+			want, _ := p.Marshal(&resumeMsg{N: i})
+			if !bytes.Equal(data, want) {
+				t.Fatalf("replayed %q, want %q", data, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout after %d replayed messages", i)
+		}
+	}
+}
+
+// stubConn 可以控制写入结果的pipeConn
+type stubConn struct {
+	*pipeConn
+	write func(data []byte) error
+}
+
+func (c *stubConn) WriteMsg(args ...[]byte) error {
+	if c.write != nil {
+		if err := c.write(bytes.Join(args, nil)); err != nil {
+			return err
+		}
+	}
+	return c.pipeConn.WriteMsg(args...)
+}
+
+func TestResumeSkipsDropped(t *testing.T) {
+	p := route.NewProcessor(false, route.GetCodec(jsonc.Name))
+	p.Register(route.NewMessage(1, &resumeMsg{}))
+	hook := &hookRecorder{connect: make(chan Agent, 1), close: make(chan Agent, 1)}
+	gate := &Gate{
+		Processor:     p,
+		AgentHandler:  hook,
+		ResumeTimeout: time.Second,
+	}
+	defer gate.closeSessions()
+
+	conn1 := &stubConn{pipeConn: newPipeConn()}
+	a := &gateAgent{conn: conn1, gate: gate}
+	go func() {
+		a.Run()
+		conn1.Close()
+	}()
+	conn1.in <- make([]byte, resumeReqLen)
+	resp := conn1.recv(t)
+	token := resp[1:]
+	agent := <-hook.connect
+
+	// 第二个消息被连接丢弃，客户端收到两个消息
+	msg2, _ := p.Marshal(&resumeMsg{N: 2})
+	conn1.write = func(data []byte) error {
+		if bytes.Equal(data, msg2) {
+			return pkg.ErrMessageDropped
+		}
+		return nil
+	}
+	for i := 1; i <= 3; i++ {
+		agent.WriteMsg(&resumeMsg{N: i})
+	}
+	conn1.recv(t)
+	conn1.recv(t)
+
+	// 写入阻塞期间不影响获取连接信息
+	release := make(chan struct{})
+	conn1.write = func([]byte) error {
+		<-release
+		return pkg.ErrConnClosed
+	}
+	go agent.WriteMsg(&resumeMsg{N: 4})
+	time.Sleep(10 * time.Millisecond)
+	done := make(chan struct{})
+	go func() {
+		agent.RemoteAddr()
+		agent.CloseReason()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("agent locked by blocked write")
+	}
+	conn1.Close()
+	close(release)
+
+	// 恢复时只重发连接断开时被拒绝的消息
+	conn2 := newPipeConn()
+	serveConn(gate, conn2)
+	conn2.in <- append(append([]byte{}, token...), 0, 0, 0, 2)
+	if resp = conn2.recv(t); resp[0] != ResumeOK {
+		t.Fatalf("unexpected resume response %v", resp)
+	}
+	msg4, _ := p.Marshal(&resumeMsg{N: 4})
+	if data := conn2.recv(t); !bytes.Equal(data, msg4) {
+		t.Fatalf("replayed %q, want %q", data, msg4)
+	}
+	conn2.Close()
+}
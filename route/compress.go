@@ -0,0 +1,51 @@
+package route
+
+import (
+	"strings"
+)
+
+// 消息ID的最高位用作压缩标志，开启压缩后消息ID不能超过0x7fff
+const compressFlag uint16 = 0x8000
+
+// 解压后的消息体默认长度上限，与network默认的MsgMaxLen一致
+const defaultMsgMaxLen = 4096
+
+// Compressor 消息体压缩算法
+type Compressor interface {
+	Name() string
+	Compress([]byte) ([]byte, error)
+	// Decompress 解压data，解压后的长度超过maxLen时返回pkg.ErrMessageTooLong
+	Decompress(data []byte, maxLen uint32) ([]byte, error)
+}
+
+var (
+	compressorMap = make(map[string]Compressor)
+)
+
+func RegisterCompressor(c Compressor) {
+	if c != nil {
+		compressorMap[strings.ToLower(c.Name())] = c
+	}
+}
+
+func GetCompressor(name string) Compressor {
+	return compressorMap[strings.ToLower(name)]
+}
+
+// WithCompression 开启压缩，序列化后的消息体长度不小于threshold时使用c压缩，并在消息ID的最高位打上标志
+// 反序列化时根据标志自动解压，因此TCP与WebSocket的对端都可以使用同一个Processor配置
+// 可以通过Message.SetCompressThreshold为单个消息单独设置阈值
+func WithCompression(c Compressor, threshold int) Option {
+	return func(p *processor) {
+		p.compressor = c
+		p.threshold = threshold
+	}
+}
+
+// WithMsgMaxLen 设置解压后的消息体长度上限，默认4096，一般与Gate.MsgMaxLen一致
+// 避免很小的压缩数据解压出超大的消息
+func WithMsgMaxLen(maxLen uint32) Option {
+	return func(p *processor) {
+		p.msgMaxLen = maxLen
+	}
+}
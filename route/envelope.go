@@ -0,0 +1,36 @@
+package route
+
+// 信封模式下消息头中flags的取值
+const (
+	FlagPush     uint8 = iota // 服务器主动推送
+	FlagRequest               // 客户端请求
+	FlagResponse              // 对请求的响应
+	FlagError                 // 对请求的错误响应，此时Code有效，消息体为空
+)
+
+// 信封模式下消息头的长度: flags(1) + seq(4) + code(2)
+const envelopeLen = 7
+
+// Envelope 信封模式下的消息，用于请求与响应的对应
+// 格式为
+//
+//	 ----------------------------------------------------------------
+//	| mid (2byte) | flags (1byte) | seq (4byte) | code (2byte) | msg |
+//	 ----------------------------------------------------------------
+type Envelope struct {
+	ID   uint16      // 消息ID
+	Flag uint8       // 消息类型
+	Seq  uint32      // 请求序列号，响应中原样返回，推送时为0
+	Code uint16      // 错误码，Flag为FlagError时有效
+	Msg  interface{} // 消息，Flag为FlagError时为nil
+}
+
+// Option 消息处理器选项
+type Option func(*processor)
+
+// WithEnvelope 开启信封模式，Unmarshal返回*Envelope，Marshal按推送消息封装
+func WithEnvelope() Option {
+	return func(p *processor) {
+		p.envelope = true
+	}
+}
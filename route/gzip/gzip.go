@@ -0,0 +1,71 @@
+package gzipc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"sync"
+
+	"github.com/pyihe/gogame/pkg"
+	"github.com/pyihe/gogame/route"
+)
+
+const Name = "gzip"
+
+func init() {
+	route.RegisterCompressor(New(gzip.DefaultCompression))
+}
+
+// New 创建压缩等级为level的gzip压缩器，level取值同compress/gzip
+func New(level int) route.Compressor {
+	if _, err := gzip.NewWriterLevel(io.Discard, level); err != nil {
+		panic(err)
+	}
+	c := &gzCompressor{}
+	c.writers.New = func() interface{} {
+		w, _ := gzip.NewWriterLevel(nil, level)
+		return w
+	}
+	return c
+}
+
+type gzCompressor struct {
+	writers sync.Pool
+}
+
+func (c *gzCompressor) Name() string {
+	return Name
+}
+
+func (c *gzCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := c.writers.Get().(*gzip.Writer)
+	defer c.writers.Put(w)
+
+	w.Reset(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *gzCompressor) Decompress(data []byte, maxLen uint32) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	// 多读一个字节用于判断是否超出上限
+	out, err := io.ReadAll(io.LimitReader(r, int64(maxLen)+1))
+	if err != nil {
+		return nil, err
+	}
+	if uint32(len(out)) > maxLen {
+		return nil, pkg.ErrMessageTooLong
+	}
+	return out, nil
+}
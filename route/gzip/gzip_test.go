@@ -0,0 +1,69 @@
+package gzipc
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/pyihe/gogame/pkg"
+	"github.com/pyihe/gogame/route"
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string                            { return "json" }
+func (jsonCodec) Encode(v interface{}) ([]byte, error)    { return json.Marshal(v) }
+func (jsonCodec) Decode(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+type roomList struct {
+	Rooms []string
+}
+
+func TestCompression(t *testing.T) {
+	p := route.NewProcessor(false, jsonCodec{}, route.WithCompression(route.GetCompressor(Name), 64))
+	p.Register(route.NewMessage(1, &roomList{}))
+
+	for _, n := range []int{1, 100} {
+		rooms := make([]string, n)
+		for i := range rooms {
+			rooms[i] = strings.Repeat("room", 4)
+		}
+		data, err := p.Marshal(&roomList{Rooms: rooms})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 只有超过阈值的消息带压缩标志
+		if compressed := data[0]&0x80 != 0; compressed != (n > 1) {
+			t.Fatalf("rooms %d: compressed %v", n, compressed)
+		}
+		msg, err := p.Unmarshal(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := msg.(*roomList).Rooms; len(got) != n || got[0] != rooms[0] {
+			t.Fatalf("rooms %d: got %v", n, got)
+		}
+	}
+}
+
+func TestDecompressLimit(t *testing.T) {
+	c := route.GetCompressor(Name)
+	data, err := c.Compress(make([]byte, 1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Decompress(data, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	// 很小的压缩数据解压后超过上限
+	if _, err = c.Decompress(data, 4096); err != pkg.ErrMessageTooLong {
+		t.Fatalf("got %v, want %v", err, pkg.ErrMessageTooLong)
+	}
+
+	p := route.NewProcessor(false, jsonCodec{}, route.WithCompression(c, 0), route.WithMsgMaxLen(64))
+	p.Register(route.NewMessage(1, &roomList{}))
+	msg, _ := p.Marshal(&roomList{Rooms: []string{strings.Repeat("room", 100)}})
+	if _, err = p.Unmarshal(msg); err != pkg.ErrMessageTooLong {
+		t.Fatalf("got %v, want %v", err, pkg.ErrMessageTooLong)
+	}
+}
@@ -0,0 +1,118 @@
+package route
+
+import (
+	"runtime"
+	"sync"
+
+	"github.com/pyihe/gogame/internal/gopool"
+	"github.com/pyihe/gogame/pkg"
+	"github.com/pyihe/gogame/pkg/log"
+)
+
+// Executor handler的执行者，比如模块的Skeleton
+// Post必须按调用顺序执行投递的函数，无法投递时返回error，不能阻塞
+type Executor interface {
+	Post(f func()) error
+}
+
+// MailboxOwner 拥有有序邮箱的userData，比如gate的agent
+// 开启有序模式后，同一个MailboxOwner的handler按消息到达的顺序串行执行
+type MailboxOwner interface {
+	Mailbox() *Mailbox
+}
+
+// Mailbox 有序邮箱，投递的函数按投递顺序在gopool中依次执行，同一时刻最多只有一个在执行
+// 零值可以直接使用
+type Mailbox struct {
+	mu      sync.Mutex
+	tasks   []func()
+	running bool
+}
+
+// defaultMailboxSize 有序模式下邮箱的默认容量
+const defaultMailboxSize = 1024
+
+// Post 投递f，邮箱没有容量限制，总是返回nil
+func (mb *Mailbox) Post(f func()) error {
+	return mb.post(f, 0)
+}
+
+// post 投递f，尚未执行的函数达到size时返回pkg.ErrMailboxFull，size不大于0时不限制
+func (mb *Mailbox) post(f func(), size int) error {
+	if f == nil {
+		return nil
+	}
+	mb.mu.Lock()
+	if size > 0 && len(mb.tasks) >= size {
+		mb.mu.Unlock()
+		return pkg.ErrMailboxFull
+	}
+	mb.tasks = append(mb.tasks, f)
+	if mb.running {
+		mb.mu.Unlock()
+		return nil
+	}
+	mb.running = true
+	mb.mu.Unlock()
+
+	gopool.AddTask(mb.run)
+	return nil
+}
+
+// Len 尚未执行的函数数量
+func (mb *Mailbox) Len() int {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	return len(mb.tasks)
+}
+
+func (mb *Mailbox) run() {
+	for {
+		mb.mu.Lock()
+		if len(mb.tasks) == 0 {
+			mb.tasks = nil
+			mb.running = false
+			mb.mu.Unlock()
+			return
+		}
+		f := mb.tasks[0]
+		mb.tasks[0] = nil
+		mb.tasks = mb.tasks[1:]
+		mb.mu.Unlock()
+
+		mb.exec(f)
+	}
+}
+
+func (mb *Mailbox) exec(f func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			buf := make([]byte, pkg.StackSize)
+			n := runtime.Stack(buf, false)
+			log.Printf("%v: %s", r, buf[:n])
+		}
+	}()
+	f()
+}
+
+// WithOrdered 开启有序模式，userData实现了MailboxOwner时，未绑定Executor的handler在其邮箱中串行执行
+// 邮箱中尚未执行的handler达到容量(默认1024)时Route返回pkg.ErrMailboxFull，gate会断开该连接
+func WithOrdered() Option {
+	return func(p *processor) {
+		p.ordered = true
+	}
+}
+
+// WithMailboxSize 设置有序模式下每个邮箱的容量，size小于0时不限制
+func WithMailboxSize(size int) Option {
+	return func(p *processor) {
+		p.mailboxSize = size
+	}
+}
+
+func (p *processor) mailboxCap() int {
+	if p.mailboxSize == 0 {
+		return defaultMailboxSize
+	}
+	return p.mailboxSize
+}
@@ -0,0 +1,63 @@
+package route
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/pyihe/gogame/pkg"
+)
+
+func TestMailbox(t *testing.T) {
+	var mb Mailbox
+	var wg sync.WaitGroup
+	var got []int
+
+	const n = 1000
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		i := i
+		mb.Post(func() {
+			defer wg.Done()
+			got = append(got, i)
+		})
+	}
+	wg.Wait()
+
+	for i, v := range got {
+		if v != i {
+			t.Fatalf("got %d at %d", v, i)
+		}
+	}
+}
+
+type mailboxOwner struct{ mb Mailbox }
+
+func (o *mailboxOwner) Mailbox() *Mailbox { return &o.mb }
+
+func TestMailboxFull(t *testing.T) {
+	p := NewProcessor(false, testCodec{}, WithOrdered(), WithMailboxSize(2))
+	p.Register(NewMessage(1, &chatReq{}))
+
+	started := make(chan struct{}, 3)
+	release := make(chan struct{})
+	p.SetHandler(1, func(args ...interface{}) {
+		started <- struct{}{}
+		<-release
+	})
+
+	owner := &mailboxOwner{}
+	if err := p.Route(&chatReq{}, owner); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	// 第一个handler正在执行，邮箱中还能容纳两个
+	for i := 0; i < 2; i++ {
+		if err := p.Route(&chatReq{}, owner); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.Route(&chatReq{}, owner); err != pkg.ErrMailboxFull {
+		t.Fatalf("got %v, want %v", err, pkg.ErrMailboxFull)
+	}
+	close(release)
+}
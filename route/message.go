@@ -10,11 +10,17 @@ import (
 type MessageHandler func(...interface{})
 
 type Message struct {
-	id      uint16
-	mType   reflect.Type
-	router  *chanrpc.Server
-	handler MessageHandler
-	initial bool
+	id       uint16
+	name     string // 消息名，文本模式下代替消息ID
+	named    bool   // 是否通过SetName指定了消息名
+	mType    reflect.Type
+	router   *chanrpc.Server
+	handler  MessageHandler
+	executor Executor
+
+	compressThreshold int       // 压缩阈值，0表示使用Processor的配置，小于0表示不压缩
+	legacies          []*legacy // 旧协议版本中的结构，按maxVersion升序
+	initial           bool
 }
 
 func NewMessage(id uint16, m interface{}) *Message {
@@ -24,6 +30,7 @@ func NewMessage(id uint16, m interface{}) *Message {
 	}
 	return &Message{
 		id:      id,
+		name:    mType.Elem().Name(),
 		mType:   mType,
 		initial: true,
 	}
@@ -46,3 +53,27 @@ func (m *Message) SetHandler(handler MessageHandler) *Message {
 	m.handler = handler
 	return m
 }
+
+// SetExecutor 将handler绑定到executor上执行，比如模块的Skeleton
+func (m *Message) SetExecutor(executor Executor) *Message {
+	m.assert()
+	m.executor = executor
+	return m
+}
+
+// SetCompressThreshold 单独设置该消息的压缩阈值，小于0表示该消息不压缩
+func (m *Message) SetCompressThreshold(threshold int) *Message {
+	m.assert()
+	m.compressThreshold = threshold
+	return m
+}
+
+// SetName 设置文本模式下使用的消息名，默认为结构体名
+// 指定的消息名不能重复，不同包中的同名结构体需要通过SetName区分才能在文本模式下使用
+// 需要在注册之前调用
+func (m *Message) SetName(name string) *Message {
+	m.assert()
+	m.name = name
+	m.named = true
+	return m
+}
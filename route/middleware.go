@@ -0,0 +1,29 @@
+package route
+
+// Context 中间件上下文
+type Context struct {
+	ID       uint16      // 消息ID
+	Msg      interface{} // 消息，错误响应时为nil
+	UserData interface{} // 路由或者发送时的userData，gate中为Agent
+	Envelope *Envelope   // 信封模式下的信封，否则为nil
+	Data     []byte      // 出站时序列化后的数据，由最内层的handler填充
+}
+
+// Handler 处理一条入站或者出站消息
+type Handler func(ctx *Context) error
+
+// Middleware 消息中间件，可以在调用next前后检查消息，也可以不调用next直接拦截
+// 入站：在路由给router/handler之前执行，拦截时消息被丢弃，返回错误时gate会断开连接
+// 出站：在序列化之前执行，拦截时消息不会发送
+// 比如：登录前只允许登录消息、按消息限流、按消息ID打点、参数校验、出站过滤
+type Middleware func(ctx *Context, next Handler) error
+
+func chain(mws []Middleware, h Handler) Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		mw, next := mws[i], h
+		h = func(ctx *Context) error {
+			return mw(ctx, next)
+		}
+	}
+	return h
+}
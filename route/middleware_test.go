@@ -0,0 +1,76 @@
+package route
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/pyihe/gogame/pkg"
+)
+
+type testCodec struct{}
+
+func (testCodec) Name() string                         { return "test" }
+func (testCodec) Encode(v interface{}) ([]byte, error) { return json.Marshal(v) }
+func (testCodec) Decode(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type loginReq struct{ Name string }
+
+type chatReq struct{ Text string }
+
+func TestMiddleware(t *testing.T) {
+	p := NewProcessor(false, testCodec{})
+	p.Register(NewMessage(1, &loginReq{}))
+	p.Register(NewMessage(2, &chatReq{}))
+
+	handled := make(chan interface{}, 2)
+	p.SetHandler(1, func(args ...interface{}) { handled <- args[0] })
+	p.SetHandler(2, func(args ...interface{}) { handled <- args[0] })
+
+	errKicked := errors.New("kicked")
+	var order []string
+	p.UseInbound(func(ctx *Context, next Handler) error {
+		order = append(order, "first")
+		return next(ctx)
+	}, func(ctx *Context, next Handler) error {
+		order = append(order, "auth")
+		// 未登录时只允许登录消息
+		if ctx.UserData == nil && ctx.ID != 1 {
+			return errKicked
+		}
+		return next(ctx)
+	})
+	p.UseOutbound(func(ctx *Context, next Handler) error {
+		if ctx.ID == 2 {
+			return nil
+		}
+		return next(ctx)
+	})
+
+	if err := p.Route(&chatReq{}, nil); err != errKicked {
+		t.Fatalf("got %v, want %v", err, errKicked)
+	}
+	if err := p.Route(&loginReq{Name: "a"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if m := <-handled; m.(*loginReq).Name != "a" {
+		t.Fatalf("unexpected message %v", m)
+	}
+	if len(order) != 4 || order[0] != "first" || order[1] != "auth" {
+		t.Fatalf("unexpected order %v", order)
+	}
+
+	if _, err := p.Marshal(&chatReq{}); err != pkg.ErrMessageFiltered {
+		t.Fatalf("got %v, want %v", err, pkg.ErrMessageFiltered)
+	}
+	data, err := p.Marshal(&loginReq{Name: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := p.Unmarshal(data)
+	if err != nil || msg.(*loginReq).Name != "b" {
+		t.Fatalf("got %v, %v", msg, err)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/pyihe/gogame/chanrpc"
 	"github.com/pyihe/gogame/internal/gopool"
 	"github.com/pyihe/gogame/pkg"
+	"github.com/pyihe/gogame/pkg/log"
 )
 
 const idLen = 2
@@ -47,9 +48,18 @@ type Processor interface {
 	// handler和router同时设置了的话，只执行handler
 	SetHandler(msgID uint16, handler MessageHandler)
 
+	// SetExecutor 将消息handler绑定到executor上执行，比如模块的Skeleton
+	SetExecutor(msgID uint16, executor Executor)
+
 	// Route must goroutine safe
 	Route(msg interface{}, userData interface{}) error
 
+	// UseInbound 添加入站中间件，按添加顺序执行，需要在开始路由之前调用
+	UseInbound(mws ...Middleware)
+
+	// UseOutbound 添加出站中间件，按添加顺序执行，需要在开始发送之前调用
+	UseOutbound(mws ...Middleware)
+
 	// Marshal must goroutine safe
 	// 序列化消息，序列化后的格式为
 	//  --------------------------
@@ -57,27 +67,67 @@ type Processor interface {
 	//  --------------------------
 	Marshal(msg interface{}) ([]byte, error)
 
+	// MarshalWith must goroutine safe
+	// 与Marshal相同，userData传递给出站中间件，消息被中间件拦截时返回pkg.ErrMessageFiltered
+	MarshalWith(msg interface{}, userData interface{}) ([]byte, error)
+
 	// Unmarshal must goroutine safe
+	// 信封模式下返回*Envelope
 	Unmarshal(data []byte) (interface{}, error)
+
+	// UnmarshalWith must goroutine safe
+	// 与Unmarshal相同，userData实现了Versioned时按其协议版本反序列化
+	UnmarshalWith(data []byte, userData interface{}) (interface{}, error)
+
+	// RegisterVersion 注册消息在旧协议版本中的结构，协议版本不超过maxVersion的连接使用msg的类型收发该消息
+	// 收到旧版本的消息时通过upgrade转换为当前版本，发送时通过downgrade转换为旧版本
+	// upgrade为nil时旧结构原样路由给该消息的router/handler，handler需要同时处理两种结构
+	RegisterVersion(msgID uint16, maxVersion uint16, msg interface{}, upgrade, downgrade VersionHook)
+
+	// Envelope 是否开启了信封模式
+	Envelope() bool
+
+	// MessageID 获取消息对应的消息ID
+	MessageID(msg interface{}) (uint16, bool)
+
+	// MarshalEnvelope must goroutine safe
+	// 按照信封格式序列化消息
+	MarshalEnvelope(env *Envelope, userData interface{}) ([]byte, error)
 }
 
 type processor struct {
 	littleEndian bool
+	envelope     bool
+	ordered      bool
+	mailboxSize  int // 有序模式下邮箱的容量
+	compressor   Compressor
+	threshold    int
+	msgMaxLen    uint32 // 解压后的消息体长度上限
 	codec        Codec
 	msgMap       *pkg.Map
 	typeMap      *pkg.Map
+	nameMap      *pkg.Map
+	conflicts    map[string]bool // 重复的默认消息名
+	inbound      []Middleware
+	outbound     []Middleware
 }
 
-func NewProcessor(littleEndian bool, codec Codec) Processor {
+func NewProcessor(littleEndian bool, codec Codec, opts ...Option) Processor {
 	if codec == nil {
 		panic(pkg.ErrCodecRequired)
 	}
-	return &processor{
+	p := &processor{
 		codec:        codec,
 		littleEndian: littleEndian,
 		msgMap:       &pkg.Map{},
 		typeMap:      &pkg.Map{},
+		nameMap:      &pkg.Map{},
+		conflicts:    make(map[string]bool),
+	}
+	for _, op := range opts {
+		op(p)
 	}
+	return p
 }
 
 func (p *processor) byteOrder() binary.ByteOrder {
@@ -110,6 +160,14 @@ func (p *processor) Register(msg *Message) {
 	if _, ok := p.isRegistered(msg.id); ok {
 		panic(pkg.ErrRepeatedRegister)
 	}
+	if old, ok := p.isNamed(msg.name); ok && old.named && msg.named {
+		panic(pkg.ErrRepeatedRegister)
+	}
+
+	// 开启压缩后消息ID的最高位被占用
+	if p.compressor != nil && msg.id&compressFlag != 0 {
+		panic(pkg.ErrMessageIDReserved)
+	}
 
 	// 消息数量达到上限
 	if p.msgMap.Len() > math.MaxUint16 {
@@ -117,6 +175,7 @@ func (p *processor) Register(msg *Message) {
 	}
 	p.msgMap.Set(msg.id, msg)
 	p.typeMap.Set(msg.mType, msg)
+	p.setName(msg)
 }
 
 func (p *processor) SetRouter(messageID uint16, router *chanrpc.Server) {
@@ -136,52 +195,289 @@ func (p *processor) SetHandler(messageID uint16, handler MessageHandler) {
 	m.handler = handler
 }
 
-func (p *processor) Route(msg interface{}, userData interface{}) (err error) {
-	mType := reflect.TypeOf(msg)
-	m, ok := p.typeMap.Get(mType).(*Message)
+func (p *processor) SetExecutor(messageID uint16, executor Executor) {
+	m, ok := p.isRegistered(messageID)
 	if !ok {
-		err = pkg.ErrNotRegistered
-		return
+		panic(pkg.ErrNotRegistered)
+	}
+	m.executor = executor
+}
+
+func (p *processor) UseInbound(mws ...Middleware) {
+	p.inbound = append(p.inbound, mws...)
+}
+
+func (p *processor) UseOutbound(mws ...Middleware) {
+	p.outbound = append(p.outbound, mws...)
+}
+
+func (p *processor) Route(msg interface{}, userData interface{}) error {
+	ctx := &Context{Msg: msg, UserData: userData}
+	if env, ok := msg.(*Envelope); ok {
+		ctx.Envelope = env
+		ctx.Msg = env.Msg
+	}
+	m, ok := p.typeMap.Get(reflect.TypeOf(ctx.Msg)).(*Message)
+	if !ok {
+		return pkg.ErrNotRegistered
 	}
+	ctx.ID = m.id
+
+	if len(p.inbound) == 0 {
+		return p.dispatch(m, ctx)
+	}
+	return chain(p.inbound, func(ctx *Context) error {
+		return p.dispatch(m, ctx)
+	})(ctx)
+}
+
+// dispatch 将消息交给handler与router
+func (p *processor) dispatch(m *Message, ctx *Context) (err error) {
+	msg, userData := ctx.Msg, ctx.UserData
 	if m.handler != nil {
-		gopool.AddTask(func() {
-			m.handler(msg, userData)
-		})
+		if err = p.handle(m, msg, userData); err != nil {
+			return
+		}
 	}
 	if m.router != nil {
-		m.router.Go(mType, msg, userData)
+		err = m.router.Post(m.mType, msg, userData)
 	}
 	return
 }
 
+// handle 执行handler：优先在绑定的Executor中执行，其次在userData的有序邮箱中执行，否则在gopool中执行
+// 有序邮箱已满时返回pkg.ErrMailboxFull
+func (p *processor) handle(m *Message, msg interface{}, userData interface{}) error {
+	f := func() {
+		m.handler(msg, userData)
+	}
+	if m.executor != nil {
+		if err := m.executor.Post(f); err != nil {
+			log.Printf("post message %v error: %v", m.mType, err)
+		}
+		return nil
+	}
+	if p.ordered {
+		if owner, ok := userData.(MailboxOwner); ok {
+			return owner.Mailbox().post(f, p.mailboxCap())
+		}
+	}
+	gopool.AddTask(f)
+	return nil
+}
+
+func (p *processor) Envelope() bool {
+	return p.envelope
+}
+
+func (p *processor) MessageID(msg interface{}) (uint16, bool) {
+	m, ok := p.typeMap.Get(reflect.TypeOf(msg)).(*Message)
+	if !ok {
+		return 0, false
+	}
+	return m.id, true
+}
+
 func (p *processor) Marshal(msg interface{}) ([]byte, error) {
-	mType := reflect.TypeOf(msg)
-	m, ok := p.typeMap.Get(mType).(*Message)
+	return p.MarshalWith(msg, nil)
+}
+
+func (p *processor) MarshalWith(msg interface{}, userData interface{}) ([]byte, error) {
+	if p.envelope {
+		return p.MarshalEnvelope(&Envelope{Flag: FlagPush, Msg: msg}, userData)
+	}
+
+	id, ok := p.MessageID(msg)
 	if !ok {
 		return nil, pkg.ErrNotRegistered
 	}
+	ctx := &Context{
+		ID:       id,
+		Msg:      msg,
+		UserData: userData,
+	}
+	return p.outboundRun(ctx, func(ctx *Context) (err error) {
+		msg := p.downgrade(ctx.ID, ctx.Msg, ctx.UserData)
+		if isText(ctx.UserData) {
+			ctx.Data, err = p.marshalText(&Envelope{ID: ctx.ID, Msg: msg})
+			return
+		}
+		ctx.Data, err = p.marshal(ctx.ID, msg)
+		return
+	})
+}
 
+func (p *processor) MarshalEnvelope(env *Envelope, userData interface{}) ([]byte, error) {
+	if env.Msg != nil {
+		id, ok := p.MessageID(env.Msg)
+		if !ok {
+			return nil, pkg.ErrNotRegistered
+		}
+		env.ID = id
+	}
+	ctx := &Context{
+		ID:       env.ID,
+		Msg:      env.Msg,
+		UserData: userData,
+		Envelope: env,
+	}
+	return p.outboundRun(ctx, func(ctx *Context) (err error) {
+		env := *ctx.Envelope
+		if env.Msg != nil {
+			env.Msg = p.downgrade(env.ID, env.Msg, ctx.UserData)
+		}
+		if isText(ctx.UserData) {
+			ctx.Data, err = p.marshalText(&env)
+			return
+		}
+		ctx.Data, err = p.marshalEnvelope(&env)
+		return
+	})
+}
+
+// outboundRun 执行出站中间件，最内层的h负责序列化
+func (p *processor) outboundRun(ctx *Context, h Handler) ([]byte, error) {
+	if len(p.outbound) > 0 {
+		h = chain(p.outbound, h)
+	}
+	if err := h(ctx); err != nil {
+		return nil, err
+	}
+	if ctx.Data == nil {
+		return nil, pkg.ErrMessageFiltered
+	}
+	return ctx.Data, nil
+}
+
+// encode 序列化消息体，超过压缩阈值时压缩，并返回带压缩标志的消息ID
+func (p *processor) encode(id uint16, msg interface{}) ([]byte, uint16, error) {
 	mBytes, err := p.codec.Encode(msg)
+	if err != nil {
+		return nil, id, err
+	}
+	if !p.shouldCompress(id, len(mBytes)) {
+		return mBytes, id, nil
+	}
+	cBytes, err := p.compressor.Compress(mBytes)
+	if err != nil {
+		return nil, id, err
+	}
+	return cBytes, id | compressFlag, nil
+}
+
+func (p *processor) shouldCompress(id uint16, n int) bool {
+	if p.compressor == nil {
+		return false
+	}
+	threshold := p.threshold
+	if m, ok := p.isRegistered(id); ok && m.compressThreshold != 0 {
+		threshold = m.compressThreshold
+	}
+	return threshold >= 0 && n >= threshold
+}
+
+// decompress 根据消息ID上的压缩标志解压消息体，返回去掉标志的消息ID
+func (p *processor) decompress(id uint16, payload []byte) (uint16, []byte, error) {
+	if p.compressor == nil || id&compressFlag == 0 {
+		return id, payload, nil
+	}
+	maxLen := p.msgMaxLen
+	if maxLen == 0 {
+		maxLen = defaultMsgMaxLen
+	}
+	data, err := p.compressor.Decompress(payload, maxLen)
+	return id &^ compressFlag, data, err
+}
+
+func (p *processor) marshal(id uint16, msg interface{}) ([]byte, error) {
+	mBytes, id, err := p.encode(id, msg)
 	if err != nil {
 		return nil, err
 	}
 
 	mData := make([]byte, len(mBytes)+idLen)
-	p.byteOrder().PutUint16(mData[:idLen], m.id)
+	p.byteOrder().PutUint16(mData[:idLen], id)
 	copy(mData[2:], mBytes)
 
 	return mData, nil
 }
 
+func (p *processor) marshalEnvelope(env *Envelope) ([]byte, error) {
+	var mBytes []byte
+	id := env.ID
+	if env.Msg != nil {
+		var err error
+		if mBytes, id, err = p.encode(env.ID, env.Msg); err != nil {
+			return nil, err
+		}
+	}
+
+	byteOrder := p.byteOrder()
+	mData := make([]byte, idLen+envelopeLen+len(mBytes))
+	byteOrder.PutUint16(mData, id)
+	mData[idLen] = env.Flag
+	byteOrder.PutUint32(mData[idLen+1:], env.Seq)
+	byteOrder.PutUint16(mData[idLen+5:], env.Code)
+	copy(mData[idLen+envelopeLen:], mBytes)
+
+	return mData, nil
+}
+
 func (p *processor) Unmarshal(data []byte) (interface{}, error) {
-	mId := p.byteOrder().Uint16(data[:2])
+	return p.UnmarshalWith(data, nil)
+}
+
+func (p *processor) UnmarshalWith(data []byte, userData interface{}) (interface{}, error) {
+	if isText(userData) {
+		return p.unmarshalText(data, userData)
+	}
+	if p.envelope {
+		return p.unmarshalEnvelope(data, userData)
+	}
+	if len(data) < idLen {
+		return nil, pkg.ErrMessageTooShort
+	}
+
+	mId, payload, err := p.decompress(p.byteOrder().Uint16(data[:2]), data[2:])
+	if err != nil {
+		return nil, err
+	}
 
 	m, ok := p.isRegistered(mId)
 	if !ok {
 		return nil, pkg.ErrNotRegistered
 	}
-	msg := reflect.New(m.mType.Elem()).Interface()
-	err := p.codec.Decode(data[2:], msg)
+	return p.decode(m, payload, userData)
+}
+
+func (p *processor) unmarshalEnvelope(data []byte, userData interface{}) (interface{}, error) {
+	if len(data) < idLen+envelopeLen {
+		return nil, pkg.ErrMessageTooShort
+	}
+
+	byteOrder := p.byteOrder()
+	env := &Envelope{
+		ID:   byteOrder.Uint16(data),
+		Flag: data[idLen],
+		Seq:  byteOrder.Uint32(data[idLen+1:]),
+		Code: byteOrder.Uint16(data[idLen+5:]),
+	}
+	if env.Flag == FlagError {
+		return env, nil
+	}
+
+	var payload []byte
+	var err error
+	env.ID, payload, err = p.decompress(env.ID, data[idLen+envelopeLen:])
+	if err != nil {
+		return nil, err
+	}
+
+	m, ok := p.isRegistered(env.ID)
+	if !ok {
+		return nil, pkg.ErrNotRegistered
+	}
+	env.Msg, err = p.decode(m, payload, userData)
 
-	return msg, err
+	return env, err
 }
@@ -0,0 +1,123 @@
+package route
+
+import (
+	"encoding/json"
+
+	"github.com/pyihe/gogame/pkg"
+)
+
+// TextMode 以文本格式收发消息的userData，比如文本模式的WebSocket连接上的agent
+// 文本格式的消息为JSON对象，以消息名代替消息ID，消息体固定使用JSON编码，不压缩:
+//
+//	{"id": "Hello", "data": {...}}
+//
+// 信封模式下额外带有seq、flag、code字段，含义与Envelope相同
+type TextMode interface {
+	TextMode() bool
+}
+
+type textMsg struct {
+	ID   string          `json:"id"`
+	Seq  uint32          `json:"seq,omitempty"`
+	Flag uint8           `json:"flag,omitempty"`
+	Code uint16          `json:"code,omitempty"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+type textCodec struct{}
+
+func (textCodec) Name() string {
+	return "text"
+}
+
+func (textCodec) Encode(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (textCodec) Decode(data []byte, v interface{}) error {
+	if len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
+
+func isText(userData interface{}) bool {
+	t, ok := userData.(TextMode)
+	return ok && t.TextMode()
+}
+
+// codecFor 文本模式下固定使用JSON编码消息体
+func (p *processor) codecFor(userData interface{}) Codec {
+	if isText(userData) {
+		return textCodec{}
+	}
+	return p.codec
+}
+
+// setName 登记文本模式下的消息名，只有文本模式需要消息名唯一，因此默认名重复时不报错
+// 指定的名字优先于默认名；默认名互相重复时这些消息都不能在文本模式下使用
+func (p *processor) setName(msg *Message) {
+	old, ok := p.isNamed(msg.name)
+	switch {
+	case !ok && !msg.named && p.conflicts[msg.name]:
+	case !ok || msg.named:
+		p.nameMap.Set(msg.name, msg)
+	case !old.named:
+		p.nameMap.Del(msg.name)
+		p.conflicts[msg.name] = true
+	}
+}
+
+func (p *processor) isNamed(name string) (*Message, bool) {
+	m, ok := p.nameMap.Get(name).(*Message)
+	return m, ok
+}
+
+func (p *processor) marshalText(env *Envelope) ([]byte, error) {
+	m, ok := p.isRegistered(env.ID)
+	if !ok {
+		return nil, pkg.ErrNotRegistered
+	}
+	if named, _ := p.isNamed(m.name); named != m {
+		return nil, pkg.ErrAmbiguousName
+	}
+	tm := textMsg{ID: m.name}
+	if p.envelope {
+		tm.Seq, tm.Flag, tm.Code = env.Seq, env.Flag, env.Code
+	}
+	if env.Msg != nil {
+		data, err := json.Marshal(env.Msg)
+		if err != nil {
+			return nil, err
+		}
+		tm.Data = data
+	}
+	return json.Marshal(&tm)
+}
+
+func (p *processor) unmarshalText(data []byte, userData interface{}) (interface{}, error) {
+	var tm textMsg
+	if err := json.Unmarshal(data, &tm); err != nil {
+		return nil, err
+	}
+	m, ok := p.isNamed(tm.ID)
+	if !ok {
+		return nil, pkg.ErrNotRegistered
+	}
+	if !p.envelope {
+		return p.decode(m, tm.Data, userData)
+	}
+
+	env := &Envelope{
+		ID:   m.id,
+		Flag: tm.Flag,
+		Seq:  tm.Seq,
+		Code: tm.Code,
+	}
+	if env.Flag == FlagError {
+		return env, nil
+	}
+	var err error
+	env.Msg, err = p.decode(m, tm.Data, userData)
+	return env, err
+}
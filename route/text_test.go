@@ -0,0 +1,87 @@
+package route
+
+import (
+	"testing"
+
+	"github.com/pyihe/gogame/pkg"
+)
+
+type textAgent struct{}
+
+func (textAgent) TextMode() bool { return true }
+
+func TestTextMode(t *testing.T) {
+	p := NewProcessor(false, testCodec{}, WithEnvelope())
+	p.Register(NewMessage(1, &loginReq{}))
+	p.Register(NewMessage(2, &chatReq{}).SetName("Chat"))
+
+	msg, err := p.UnmarshalWith([]byte(`{"id":"Chat","seq":7,"flag":1,"data":{"Text":"hi"}}`), textAgent{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := msg.(*Envelope)
+	if env.ID != 2 || env.Seq != 7 || env.Flag != FlagRequest || env.Msg.(*chatReq).Text != "hi" {
+		t.Fatalf("unexpected envelope %+v", env)
+	}
+
+	data, err := p.MarshalEnvelope(&Envelope{Flag: FlagResponse, Seq: 7, Msg: &loginReq{Name: "a"}}, textAgent{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"id":"loginReq","seq":7,"flag":2,"data":{"Name":"a"}}`; string(data) != want {
+		t.Fatalf("got %s, want %s", data, want)
+	}
+
+	if _, err = p.UnmarshalWith([]byte(`{"id":"Unknown"}`), textAgent{}); err == nil {
+		t.Fatal("expect error")
+	}
+}
+
+func TestDuplicateName(t *testing.T) {
+	// 不同作用域中的同名结构体，模拟不同包中的同名消息
+	newMsg := func(id uint16) *Message {
+		type dup struct{ N int }
+		return NewMessage(id, &dup{})
+	}
+	type dup struct{ S string }
+
+	// 默认名重复不影响二进制格式
+	p := NewProcessor(false, testCodec{})
+	p.Register(newMsg(1))
+	p.Register(NewMessage(2, &dup{}))
+	p.Register(NewMessage(3, &chatReq{}))
+	data, err := p.Marshal(&dup{S: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := p.Unmarshal(data); err != nil || msg.(*dup).S != "a" {
+		t.Fatalf("unexpected message %+v, %v", msg, err)
+	}
+
+	// 文本模式下重复的默认名无法使用
+	if _, err = p.MarshalWith(&dup{}, textAgent{}); err != pkg.ErrAmbiguousName {
+		t.Fatalf("got %v, want %v", err, pkg.ErrAmbiguousName)
+	}
+	if _, err = p.UnmarshalWith([]byte(`{"id":"dup"}`), textAgent{}); err != pkg.ErrNotRegistered {
+		t.Fatalf("got %v, want %v", err, pkg.ErrNotRegistered)
+	}
+
+	// SetName指定的名字优先
+	p = NewProcessor(false, testCodec{})
+	p.Register(newMsg(1))
+	p.Register(NewMessage(2, &dup{}).SetName("dup"))
+	if data, err = p.MarshalWith(&dup{S: "a"}, textAgent{}); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := p.UnmarshalWith(data, textAgent{}); err != nil || msg.(*dup).S != "a" {
+		t.Fatalf("unexpected message %+v, %v", msg, err)
+	}
+
+	// 指定的名字不能重复
+	defer func() {
+		if recover() != pkg.ErrRepeatedRegister {
+			t.Fatal("expect panic")
+		}
+	}()
+	p.Register(NewMessage(3, &chatReq{}).SetName("dup"))
+}
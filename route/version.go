@@ -0,0 +1,107 @@
+package route
+
+import (
+	"reflect"
+	"sort"
+
+	"github.com/pyihe/gogame/pkg"
+)
+
+// Versioned 带有协议版本的userData，比如gate的agent
+// 版本为0表示未协商版本，按当前版本处理
+type Versioned interface {
+	ProtocolVersion() uint16
+}
+
+// VersionHook 在旧版本与当前版本的消息之间转换
+type VersionHook func(msg interface{}) interface{}
+
+// legacy 消息在旧协议版本中的结构
+type legacy struct {
+	maxVersion uint16       // 协议版本不超过maxVersion的连接使用该结构
+	mType      reflect.Type // 旧版本的消息类型
+	upgrade    VersionHook  // 旧版本 -> 当前版本，为nil时旧结构原样交给router/handler
+	downgrade  VersionHook  // 当前版本 -> 旧版本，为nil时原样发送
+}
+
+// legacyFor 获取userData的协议版本所对应的旧结构，使用当前结构时返回nil
+func (m *Message) legacyFor(userData interface{}) *legacy {
+	if len(m.legacies) == 0 {
+		return nil
+	}
+	v, ok := userData.(Versioned)
+	if !ok || v.ProtocolVersion() == 0 {
+		return nil
+	}
+	version := v.ProtocolVersion()
+	for _, l := range m.legacies {
+		if version <= l.maxVersion {
+			return l
+		}
+	}
+	return nil
+}
+
+func (p *processor) RegisterVersion(messageID uint16, maxVersion uint16, msg interface{}, upgrade, downgrade VersionHook) {
+	m, ok := p.isRegistered(messageID)
+	if !ok {
+		panic(pkg.ErrNotRegistered)
+	}
+	mType := reflect.TypeOf(msg)
+	if mType == nil || mType.Kind() != reflect.Ptr {
+		panic(pkg.ErrPointerRequired)
+	}
+	for _, l := range m.legacies {
+		if l.maxVersion == maxVersion {
+			panic(pkg.ErrRepeatedRegister)
+		}
+	}
+	// 不升级的旧结构需要能够被路由，将其类型也绑定到该消息上
+	if upgrade == nil {
+		if old, ok := p.typeMap.Get(mType).(*Message); ok && old != m {
+			panic(pkg.ErrRepeatedRegister)
+		}
+		p.typeMap.Set(mType, m)
+	}
+	m.legacies = append(m.legacies, &legacy{
+		maxVersion: maxVersion,
+		mType:      mType,
+		upgrade:    upgrade,
+		downgrade:  downgrade,
+	})
+	sort.Slice(m.legacies, func(i, j int) bool {
+		return m.legacies[i].maxVersion < m.legacies[j].maxVersion
+	})
+}
+
+// decode 按照userData的协议版本与格式反序列化消息，旧版本的消息升级为当前版本
+func (p *processor) decode(m *Message, payload []byte, userData interface{}) (interface{}, error) {
+	codec := p.codecFor(userData)
+	l := m.legacyFor(userData)
+	if l == nil {
+		msg := reflect.New(m.mType.Elem()).Interface()
+		return msg, codec.Decode(payload, msg)
+	}
+	msg := reflect.New(l.mType.Elem()).Interface()
+	if err := codec.Decode(payload, msg); err != nil {
+		return nil, err
+	}
+	if l.upgrade == nil {
+		return msg, nil
+	}
+	return l.upgrade(msg), nil
+}
+
+// downgrade 按照userData的协议版本将当前版本的消息降级为旧版本
+func (p *processor) downgrade(id uint16, msg interface{}, userData interface{}) interface{} {
+	m, ok := p.isRegistered(id)
+	if !ok {
+		return msg
+	}
+	// 发送的已经是旧结构(比如响应不升级的旧版本请求)时不需要降级
+	l := m.legacyFor(userData)
+	if l == nil || l.downgrade == nil || reflect.TypeOf(msg) != m.mType {
+		return msg
+	}
+	return l.downgrade(msg)
+}
@@ -0,0 +1,80 @@
+package route
+
+import (
+	"testing"
+)
+
+type versioned uint16
+
+func (v versioned) ProtocolVersion() uint16 { return uint16(v) }
+
+type helloV1 struct{ Name string }
+
+type hello struct{ FirstName, LastName string }
+
+func TestVersion(t *testing.T) {
+	p := NewProcessor(false, testCodec{})
+	p.Register(NewMessage(1, &hello{}))
+	p.RegisterVersion(1, 2, &helloV1{}, func(msg interface{}) interface{} {
+		return &hello{FirstName: msg.(*helloV1).Name}
+	}, func(msg interface{}) interface{} {
+		return &helloV1{Name: msg.(*hello).FirstName}
+	})
+
+	old, current := versioned(2), versioned(3)
+
+	// 旧版本的客户端收发旧结构
+	data, err := p.MarshalWith(&hello{FirstName: "a", LastName: "b"}, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data[idLen:]) != `{"Name":"a"}` {
+		t.Fatalf("unexpected payload %s", data[idLen:])
+	}
+	msg, err := p.UnmarshalWith(data, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h := msg.(*hello); h.FirstName != "a" || h.LastName != "" {
+		t.Fatalf("unexpected message %+v", h)
+	}
+
+	// 当前版本的客户端不受影响
+	data, err = p.MarshalWith(&hello{FirstName: "a", LastName: "b"}, current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err = p.UnmarshalWith(data, current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h := msg.(*hello); h.LastName != "b" {
+		t.Fatalf("unexpected message %+v", h)
+	}
+}
+
+func TestVersionWithoutUpgrade(t *testing.T) {
+	p := NewProcessor(false, testCodec{})
+	p.Register(NewMessage(1, &hello{}))
+	p.RegisterVersion(1, 2, &helloV1{}, nil, nil)
+
+	got := make(chan interface{}, 1)
+	p.SetHandler(1, func(args ...interface{}) { got <- args[0] })
+
+	// 不升级的旧结构原样路由给handler
+	old := versioned(2)
+	data, _ := p.MarshalWith(&helloV1{Name: "a"}, old)
+	msg, err := p.UnmarshalWith(data, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = p.Route(msg, old); err != nil {
+		t.Fatal(err)
+	}
+	if h, ok := (<-got).(*helloV1); !ok || h.Name != "a" {
+		t.Fatalf("unexpected message %+v", h)
+	}
+	if id, ok := p.MessageID(&helloV1{}); !ok || id != 1 {
+		t.Fatalf("got id %d, %v", id, ok)
+	}
+}
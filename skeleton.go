@@ -23,6 +23,7 @@ type Skeleton struct {
 	client     *chanrpc.Client
 	server     *chanrpc.Server
 	status     int32
+	done       chan struct{} // 模块goroutine退出时关闭
 }
 
 func NewSkeleton() *Skeleton {
@@ -34,6 +35,7 @@ func NewSkeleton() *Skeleton {
 		client:     chanrpc.NewClient(defaultChanSize),
 		server:     chanrpc.NewServer(defaultChanSize),
 		status:     pkg.StatusInitial,
+		done:       make(chan struct{}),
 	}
 
 	//s.Run()
@@ -57,6 +59,7 @@ func (s *Skeleton) Close() {
 	if !atomic.CompareAndSwapInt32(&s.status, pkg.StatusRunning, pkg.StatusClosed) {
 		return
 	}
+	unsubscribeAll(s.server)
 	s.cancelFunc()
 }
 
@@ -68,6 +71,7 @@ func (s *Skeleton) Run() {
 	ctx, s.cancelFunc = context.WithCancel(context.Background())
 
 	gopool.AddTask(func() {
+		defer close(s.done)
 		for {
 			select {
 			case <-ctx.Done():
@@ -111,10 +115,22 @@ func (s *Skeleton) Go(f func(), cb func()) {
 	}
 }
 
+// Post 将f投递到本模块的goroutine中执行，按投递顺序执行
+// 实现了route.Executor，可以通过Message.SetExecutor将消息handler绑定到本模块
+// 回调队列已满时不等待，返回pkg.ErrFullChannel，因此也可以在本模块的goroutine中调用；模块未运行时返回pkg.ErrServerClosed
+func (s *Skeleton) Post(f func()) error {
+	if !s.isRunning() {
+		return pkg.ErrServerClosed
+	}
+	if f == nil {
+		return nil
+	}
+	return s.g.TryPost(f)
+}
+
 func (s *Skeleton) AsynCall(server *chanrpc.Server, id interface{}, args ...interface{}) {
 	if s.isRunning() {
-		s.client.AttachSever(server)
-		s.client.AsynCall(id, args...)
+		s.client.AsynCallServer(server, id, args...)
 	}
 }
 
@@ -124,3 +140,94 @@ func (s *Skeleton) RegisterChanRPC(id interface{}, f interface{}) {
 		log.Printf("register chan rpc err: %v", err)
 	}
 }
+
+// ClusterAsynCall 异步调用集群中nodeID节点上名为name的chanrpc server
+// 最后一个参数为回调函数，回调在本模块的goroutine中执行，类型与chanrpc.Client.AsynCall一致
+// 远程调用超过Options.ClusterCallTimeout没有响应时以pkg.ErrCallTimeout回调
+// 与Await一样，Close不会等待尚未返回的调用，Close之后返回时不再执行回调
+func (s *Skeleton) ClusterAsynCall(nodeID uint16, name string, id interface{}, args ...interface{}) {
+	if !s.isRunning() {
+		return
+	}
+	if len(args) < 1 {
+		panic("callback function required")
+	}
+
+	_args := args[:len(args)-1]
+	cb := args[len(args)-1]
+
+	// call 执行调用，返回需要在本模块goroutine中执行的回调
+	var call func() func()
+	switch fn := cb.(type) {
+	case func(error):
+		call = func() func() {
+			err := ClusterCall0(nodeID, name, id, _args...)
+			return func() { fn(err) }
+		}
+	case func(interface{}, error):
+		call = func() func() {
+			value, err := ClusterCall1(nodeID, name, id, _args...)
+			return func() { fn(value, err) }
+		}
+	case func([]interface{}, error):
+		call = func() func() {
+			values, err := ClusterCallN(nodeID, name, id, _args...)
+			return func() { fn(values, err) }
+		}
+	default:
+		panic("unsupported callback type")
+	}
+
+	gopool.AddTask(func() {
+		s.g.Post(call())
+	})
+}
+
+// RemoteAsynCall 异步调用集群中的RemoteServer，用法与AsynCall一致
+func (s *Skeleton) RemoteAsynCall(rs *RemoteServer, id interface{}, args ...interface{}) {
+	s.ClusterAsynCall(rs.nodeID, rs.name, id, args...)
+}
+
+// OnNodeUp 订阅集群节点上线事件，f在本模块的goroutine中执行
+func (s *Skeleton) OnNodeUp(f func(nodeID uint16)) {
+	OnNodeUp(func(nodeID uint16) {
+		s.Go(nil, func() {
+			f(nodeID)
+		})
+	})
+}
+
+// OnNodeDown 订阅集群节点下线事件，f在本模块的goroutine中执行
+func (s *Skeleton) OnNodeDown(f func(nodeID uint16)) {
+	OnNodeDown(func(nodeID uint16) {
+		s.Go(nil, func() {
+			f(nodeID)
+		})
+	})
+}
+
+// Await 等待Future完成，cb在本模块的goroutine中执行
+// Close不会等待尚未完成的Future，Close之后完成时不再执行cb
+func (s *Skeleton) Await(f *chanrpc.Future, cb func(interface{}, error)) {
+	if !s.isRunning() || f == nil || cb == nil {
+		return
+	}
+	f.Then(func(value interface{}, err error) {
+		s.g.Post(func() {
+			cb(value, err)
+		})
+	})
+}
+
+// Subscribe 订阅topic，事件通过Publish/PublishCluster发布，handler在本模块的goroutine中执行
+// 需要在模块Init中调用
+func (s *Skeleton) Subscribe(topic string, handler func(args ...interface{})) {
+	if err := subscribe(topic, s.server, handler); err != nil {
+		log.Printf("subscribe %s err: %v", topic, err)
+	}
+}
+
+// Unsubscribe 取消订阅topic，之后发布的事件不再投递给本模块，Close时自动取消全部订阅
+func (s *Skeleton) Unsubscribe(topic string) {
+	unsubscribe(topic, s.server)
+}
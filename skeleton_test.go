@@ -0,0 +1,122 @@
+package gogame
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pyihe/gogame/chanrpc"
+	"github.com/pyihe/gogame/pkg"
+)
+
+func TestAwaitNeverCompletes(t *testing.T) {
+	// 没有执行者的server，调用永远不会完成
+	target := chanrpc.NewServer(1)
+	target.Register("never", func(args ...interface{}) interface{} {
+		return nil
+	})
+	future := target.CallAsync("never")
+
+	s := NewSkeleton()
+	s.Run()
+	result := make(chan error, 1)
+	s.Await(target.CallAsync("missing"), func(v interface{}, err error) {
+		result <- err
+	})
+	s.Await(future, func(v interface{}, err error) {
+		t.Error("callback of uncompleted future called")
+	})
+	select {
+	case err := <-result:
+		if err != pkg.ErrNotRegistered {
+			t.Fatalf("got %v, want %v", err, pkg.ErrNotRegistered)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("callback not called")
+	}
+
+	s.Close()
+	select {
+	case <-s.done:
+	case <-time.After(time.Second):
+		t.Fatal("skeleton blocked by uncompleted future")
+	}
+
+	// Close之后完成的Future不再执行回调
+	target.Close()
+	<-future.Done()
+}
+
+func TestPostFull(t *testing.T) {
+	s := NewSkeleton()
+	s.Run()
+	defer s.Close()
+
+	// 在模块goroutine中投递直到回调队列已满，不能死锁
+	var executed int
+	result := make(chan int, 1)
+	s.Post(func() {
+		n := 0
+		for {
+			err := s.Post(func() {
+				executed++
+			})
+			if err == pkg.ErrFullChannel {
+				break
+			}
+			if err != nil {
+				t.Error(err)
+				break
+			}
+			n++
+		}
+		result <- n
+	})
+
+	var n int
+	select {
+	case n = <-result:
+	case <-time.After(time.Second):
+		t.Fatal("post blocked in module goroutine")
+	}
+	if n != cap(s.g.ChanCb) {
+		t.Fatalf("posted %d, want %d", n, cap(s.g.ChanCb))
+	}
+
+	// 已经投递的回调全部执行
+	done := make(chan int)
+	for s.Post(func() { done <- executed }) != nil {
+		time.Sleep(time.Millisecond)
+	}
+	if got := <-done; got != n {
+		t.Fatalf("executed %d, want %d", got, n)
+	}
+}
+
+func TestClusterAsynCallNeverReturns(t *testing.T) {
+	setClusterTestOptions()
+
+	// 没有执行者的server，本节点的调用永远不会返回
+	never := chanrpc.NewServer(1)
+	never.Register("f", func(args ...interface{}) interface{} {
+		return nil
+	})
+	RegisterClusterServer("skeleton.never", never)
+
+	s := NewSkeleton()
+	s.Run()
+	s.ClusterAsynCall(1, "skeleton.never", "f", func(v interface{}, err error) {
+		t.Error("callback of unfinished call called")
+	})
+	time.Sleep(10 * time.Millisecond)
+
+	s.Close()
+	select {
+	case <-s.done:
+	case <-time.After(time.Second):
+		t.Fatal("skeleton blocked by unfinished cluster call")
+	}
+
+	// Close之后返回的调用不再执行回调
+	never.Close()
+	time.Sleep(10 * time.Millisecond)
+}
@@ -0,0 +1,102 @@
+package gogame
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	"github.com/pyihe/gogame/pkg"
+	"github.com/pyihe/gogame/pkg/log"
+)
+
+// 协议版本握手
+// Gate.ProtocolVersion大于0时，客户端连接后发送的第一个消息为自己的协议版本: version (2byte, 大端)
+// gate回复: status (1byte) + 服务器协议版本 (2byte, 大端) + 支持的最低协议版本 (2byte, 大端)
+// status为VersionUpdateRequired时，gate在回复发送完毕后断开连接，客户端应该提示玩家更新
+// 文本模式下请求为{"version": 1}，回复为{"status": 0, "version": 2, "min_version": 1}
+const (
+	VersionOK             uint8 = iota // 版本可用
+	VersionUpdateRequired              // 客户端版本过低，需要更新
+)
+
+const versionRespLen = 5
+
+type textVersion struct {
+	Status     uint8  `json:"status"`
+	Version    uint16 `json:"version"`
+	MinVersion uint16 `json:"min_version,omitempty"`
+}
+
+// 拒绝连接时等待回复发送完毕的最长时间
+const versionRejectTimeout = time.Second
+
+// handshakeVersion 与客户端协商协议版本，返回false时需要断开连接
+func (a *gateAgent) handshakeVersion() bool {
+	gate := a.gate
+	if t := gate.HandshakeTimeout; t > 0 {
+		a.conn.SetReadDeadline(time.Now().Add(t))
+		defer a.conn.SetReadDeadline(time.Time{})
+	}
+
+	data, err := a.conn.ReadMsg()
+	if err != nil {
+		log.Printf("read protocol version from %v: %v", a.conn.RemoteAddr(), err)
+		return false
+	}
+	version, ok := a.decodeVersion(data)
+	if !ok {
+		log.Printf("invalid protocol version from %v", a.conn.RemoteAddr())
+		return false
+	}
+
+	status := VersionOK
+	if version < gate.MinProtocolVersion {
+		status = VersionUpdateRequired
+	}
+	if err = a.conn.WriteMsg(a.encodeVersion(status)); err != nil {
+		return false
+	}
+	if status != VersionOK {
+		log.Printf("protocol version %d from %v is no longer supported", version, a.conn.RemoteAddr())
+		a.setCloseReason(pkg.ErrProtocolOutdated)
+		a.conn.CloseGracefully(versionRejectTimeout)
+		return false
+	}
+
+	a.version = version
+	return true
+}
+
+func (a *gateAgent) decodeVersion(data []byte) (uint16, bool) {
+	if a.text {
+		var req textVersion
+		if err := json.Unmarshal(data, &req); err != nil {
+			return 0, false
+		}
+		return req.Version, true
+	}
+	if len(data) != 2 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(data), true
+}
+
+func (a *gateAgent) encodeVersion(status uint8) []byte {
+	if a.text {
+		data, _ := json.Marshal(&textVersion{
+			Status:     status,
+			Version:    a.gate.ProtocolVersion,
+			MinVersion: a.gate.MinProtocolVersion,
+		})
+		return data
+	}
+	resp := make([]byte, versionRespLen)
+	resp[0] = status
+	binary.BigEndian.PutUint16(resp[1:], a.gate.ProtocolVersion)
+	binary.BigEndian.PutUint16(resp[3:], a.gate.MinProtocolVersion)
+	return resp
+}
+
+func (a *gateAgent) ProtocolVersion() uint16 {
+	return a.version
+}